@@ -24,25 +24,87 @@ func NewClient() *Client {
 }
 
 type PlaceLimitOrderParams struct {
+	Market server.Market
 	UserId int64
-	Size   float64
-	Price  float64
+	Size   orderbook.Amount
+	Price  orderbook.Amount
 	Bid    bool
-	// Market string
-	// Type string
+	// TimeInForce defaults to GTC, ExpiresAt (unix nano) is used by GTD orders
+	TimeInForce server.TimeInForce
+	ExpiresAt   int64
+	// PostOnly limit orders are rejected instead of crossing the spread,
+	// or repriced one tick away when Reprice is set
+	PostOnly bool
+	Reprice  bool
+	// DisplaySize turns a limit order into an iceberg
+	DisplaySize orderbook.Amount
+	// SelfTradePrevention defaults to CANCEL_NEWEST
+	SelfTradePrevention server.SelfTradePrevention
 }
 
 func (c *Client) PlaceLimitOrder(p *PlaceLimitOrderParams) (*server.PlaceOrderResponse, error) {
-	e := ENDPOINT + "/order"
+	params := &server.PlaceOrderRequest{
+		UserId:      p.UserId,
+		Type:        server.OrderType("LIMIT"), // Limit or Market
+		Bid:         p.Bid,
+		Size:        p.Size,
+		Price:       p.Price,
+		Market:      p.Market,
+		TimeInForce: p.TimeInForce,
+		ExpiresAt:   p.ExpiresAt,
+		PostOnly:    p.PostOnly,
+		Reprice:     p.Reprice,
+		DisplaySize: p.DisplaySize,
+
+		SelfTradePrevention: p.SelfTradePrevention,
+	}
+	return c.placeOrder(params)
+}
 
+type PlaceStopOrderParams struct {
+	Market    server.Market
+	UserId    int64
+	Size      orderbook.Amount
+	Bid       bool
+	StopPrice orderbook.Amount
+	// LimitPrice turns the order into a stop-limit order when set
+	LimitPrice orderbook.Amount
+}
+
+func (c *Client) PlaceStopOrder(p *PlaceStopOrderParams) (*server.PlaceOrderResponse, error) {
 	params := &server.PlaceOrderRequest{
-		UserId: p.UserId,
-		Type:   server.OrderType("LIMIT"), // Limit or Market
-		Bid:    p.Bid,
-		Size:   p.Size,
-		Price:  p.Price,
-		Market: server.Market("ETH"),
+		UserId:    p.UserId,
+		Type:      server.STOPMARKETORDER,
+		Bid:       p.Bid,
+		Size:      p.Size,
+		StopPrice: p.StopPrice,
+		Market:    p.Market,
+	}
+	if p.LimitPrice.Sign() > 0 {
+		params.Type = server.STOPLIMITORDER
+		params.Price = p.LimitPrice
 	}
+	return c.placeOrder(params)
+}
+
+func (c *Client) PlaceMarketOrder(p *PlaceLimitOrderParams) (*server.PlaceOrderResponse, error) {
+	params := &server.PlaceOrderRequest{
+		UserId:      p.UserId,
+		Type:        server.OrderType("MARKET"), // Limit or Market
+		Bid:         p.Bid,
+		Size:        p.Size,
+		Price:       p.Price,
+		Market:      p.Market,
+		TimeInForce: p.TimeInForce,
+
+		SelfTradePrevention: p.SelfTradePrevention,
+	}
+	return c.placeOrder(params)
+}
+
+// placeOrder posts the order and turns a rejection into an error.
+func (c *Client) placeOrder(params *server.PlaceOrderRequest) (*server.PlaceOrderResponse, error) {
+	e := ENDPOINT + "/order"
 
 	body, err := json.Marshal(params)
 	if err != nil {
@@ -58,9 +120,17 @@ func (c *Client) PlaceLimitOrder(p *PlaceLimitOrderParams) (*server.PlaceOrderRe
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	placeOrderResponse := &server.PlaceOrderResponse{}
+	if resp.StatusCode != http.StatusOK {
+		rejected := &server.OrderRejectedResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(rejected); err != nil {
+			return nil, fmt.Errorf("order failed with status %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("order rejected: %s", rejected.Reason)
+	}
 
+	placeOrderResponse := &server.PlaceOrderResponse{}
 	err = json.NewDecoder(resp.Body).Decode(placeOrderResponse)
 	if err != nil {
 		return nil, err
@@ -69,25 +139,10 @@ func (c *Client) PlaceLimitOrder(p *PlaceLimitOrderParams) (*server.PlaceOrderRe
 	return placeOrderResponse, nil
 }
 
-func (c *Client) PlaceMarketOrder(p *PlaceLimitOrderParams) error {
-	e := ENDPOINT + "/order"
-
-	params := &server.PlaceOrderRequest{
-		UserId: p.UserId,
-		Type:   server.OrderType("MARKET"), // Limit or Market
-		Bid:    p.Bid,
-		Size:   p.Size,
-		Price:  p.Price,
-		Market: server.Market("ETH"),
-	}
-
-	body, err := json.Marshal(params)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
+func (c *Client) CancelOrder(orderId int) error {
+	e := ENDPOINT + "/order/" + strconv.Itoa(orderId)
 
+	req, err := http.NewRequest(http.MethodDelete, e, nil)
 	if err != nil {
 		return err
 	}
@@ -95,60 +150,88 @@ func (c *Client) PlaceMarketOrder(p *PlaceLimitOrderParams) error {
 	if err != nil {
 		return err
 	}
-
-	_ = resp
-	// fmt.Printf("%v", resp)
+	fmt.Printf("%v", resp)
 	return nil
+}
 
+type AmendOrderParams struct {
+	// Market is looked up from the order when empty
+	Market server.Market
+	// Price and Size are the new limit price and the size left to fill,
+	// zero keeps the current one
+	Price orderbook.Amount
+	Size  orderbook.Amount
 }
 
-func (c *Client) CancelOrder(orderId int) error {
-	e := ENDPOINT + "/order/" + strconv.Itoa(orderId)
+func (c *Client) AmendOrder(orderId int64, p *AmendOrderParams) (*server.AmendOrderResponse, error) {
+	e := fmt.Sprintf("%s/order/%d", ENDPOINT, orderId)
 
-	req, err := http.NewRequest(http.MethodDelete, e, nil)
+	body, err := json.Marshal(&server.AmendOrderRequest{
+		Market: p.Market,
+		Price:  p.Price,
+		Size:   p.Size,
+	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPatch, e, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
 	}
 	resp, err := c.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Printf("%v", resp)
-	return nil
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		rejected := &server.OrderRejectedResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(rejected); err != nil {
+			return nil, fmt.Errorf("amend failed with status %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("amend rejected: %s", rejected.Reason)
+	}
+
+	amendOrderResponse := &server.AmendOrderResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(amendOrderResponse); err != nil {
+		return nil, err
+	}
+	return amendOrderResponse, nil
 }
 
-func (c *Client) GetBestBidPrice(market server.Market) (float64, error) {
+func (c *Client) GetBestBidPrice(market server.Market) (orderbook.Amount, error) {
 	e := ENDPOINT + "/book/" + string(market) + "/bid"
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
-		return 0, err
+		return orderbook.Amount{}, err
 	}
 	resp, err := c.Do(req)
 	if err != nil {
-		return 0, err
+		return orderbook.Amount{}, err
 	}
 	bestBidResponse := &server.BestBidResponse{}
 	err = json.NewDecoder(resp.Body).Decode(bestBidResponse)
 	if err != nil {
-		return 0, err
+		return orderbook.Amount{}, err
 	}
 	return bestBidResponse.Price, nil
 }
 
-func (c *Client) GetBestAskPrice(market server.Market) (float64, error) {
+func (c *Client) GetBestAskPrice(market server.Market) (orderbook.Amount, error) {
 	e := ENDPOINT + "/book/" + string(market) + "/ask"
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
-		return 0, err
+		return orderbook.Amount{}, err
 	}
 	resp, err := c.Do(req)
 	if err != nil {
-		return 0, err
+		return orderbook.Amount{}, err
 	}
 	bestAskResponse := &server.BestBidResponse{}
 	err = json.NewDecoder(resp.Body).Decode(bestAskResponse)
 	if err != nil {
-		return 0, err
+		return orderbook.Amount{}, err
 	}
 	return bestAskResponse.Price, nil
 }
@@ -188,3 +271,163 @@ func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
 	}
 	return trades, nil
 }
+
+func (c *Client) Deposit(userId int64, asset server.Asset, amount orderbook.Amount) (*server.BalancesResponse, error) {
+	return c.transfer("/deposit", userId, asset, amount)
+}
+
+// transfer posts a deposit and returns the balances after it.
+func (c *Client) transfer(path string, userId int64, asset server.Asset, amount orderbook.Amount) (*server.BalancesResponse, error) {
+	body, err := json.Marshal(&server.TransferRequest{
+		UserId: userId,
+		Asset:  asset,
+		Amount: amount,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ENDPOINT+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		failed := map[string]string{}
+		if err := json.NewDecoder(resp.Body).Decode(&failed); err != nil {
+			return nil, fmt.Errorf("%s failed with status %d", path, resp.StatusCode)
+		}
+		return nil, fmt.Errorf("%s failed: %s", path, failed["error"])
+	}
+
+	balances := &server.BalancesResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(balances); err != nil {
+		return nil, err
+	}
+	return balances, nil
+}
+
+// Withdraw queues a withdrawal of amount of asset to the address of the
+// user, follow it with GetWithdrawal.
+func (c *Client) Withdraw(userId int64, asset server.Asset, amount orderbook.Amount) (*server.Withdrawal, error) {
+	body, err := json.Marshal(&server.WithdrawalRequest{
+		UserId: userId,
+		Asset:  asset,
+		Amount: amount,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ENDPOINT+"/withdrawals", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		failed := map[string]string{}
+		if err := json.NewDecoder(resp.Body).Decode(&failed); err != nil {
+			return nil, fmt.Errorf("withdrawal failed with status %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("withdrawal failed: %s", failed["error"])
+	}
+
+	withdrawal := &server.Withdrawal{}
+	if err := json.NewDecoder(resp.Body).Decode(withdrawal); err != nil {
+		return nil, err
+	}
+	return withdrawal, nil
+}
+
+// GetWithdrawal returns the status of a withdrawal.
+func (c *Client) GetWithdrawal(id int64) (*server.Withdrawal, error) {
+	e := fmt.Sprintf("%s/withdrawals/%d", ENDPOINT, id)
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getting withdrawal %d failed with status %d", id, resp.StatusCode)
+	}
+	withdrawal := &server.Withdrawal{}
+	if err := json.NewDecoder(resp.Body).Decode(withdrawal); err != nil {
+		return nil, err
+	}
+	return withdrawal, nil
+}
+
+// GetDeposits returns the deposit address of a user and the deposits seen
+// on chain for them.
+func (c *Client) GetDeposits(userId int64) (*server.DepositsResponse, error) {
+	e := fmt.Sprintf("%s/deposits/%d", ENDPOINT, userId)
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	deposits := &server.DepositsResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(deposits); err != nil {
+		return nil, err
+	}
+	return deposits, nil
+}
+
+// GetMarkets returns the specs and states of the markets the exchange lists.
+func (c *Client) GetMarkets() ([]*server.MarketResponse, error) {
+	e := ENDPOINT + "/markets"
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	markets := []*server.MarketResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&markets); err != nil {
+		return nil, err
+	}
+	return markets, nil
+}
+
+func (c *Client) GetBalances(userId int64) (*server.BalancesResponse, error) {
+	e := fmt.Sprintf("%s/balances/%d", ENDPOINT, userId)
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	balances := &server.BalancesResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(balances); err != nil {
+		return nil, err
+	}
+	return balances, nil
+}
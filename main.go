@@ -2,21 +2,23 @@ package main
 
 import (
 	"fmt"
-	"math"
 	"time"
 
 	"github.com/Madhav-Gupta-28/crypto-exchange/client"
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
 	"github.com/Madhav-Gupta-28/crypto-exchange/server"
 )
 
 const (
 	maxOrders = 3
+	market    = server.MarketETHUSDC
 )
 
 var tick = 2 * time.Second
 
-var myAsks = make(map[float64]int64)
-var myBids = make(map[float64]int64)
+// myAsks and myBids map the price of each order placed to its id
+var myAsks = make(map[string]int64)
+var myBids = make(map[string]int64)
 
 func marketOrderPlacer(Client *client.Client) error {
 	ticker := time.NewTicker(tick)
@@ -24,21 +26,23 @@ func marketOrderPlacer(Client *client.Client) error {
 		<-ticker.C
 
 		marketSell := &client.PlaceLimitOrderParams{
+			Market: market,
 			UserId: 1,
-			Size:   2,
+			Size:   orderbook.AmountFromInt(2),
 			Bid:    false,
 		}
-		err := Client.PlaceMarketOrder(marketSell)
+		_, err := Client.PlaceMarketOrder(marketSell)
 		if err != nil {
 			return err
 		}
 
 		marketbuy := &client.PlaceLimitOrderParams{
+			Market: market,
 			UserId: 2,
-			Size:   2,
+			Size:   orderbook.AmountFromInt(2),
 			Bid:    true,
 		}
-		err = Client.PlaceMarketOrder(marketbuy)
+		_, err = Client.PlaceMarketOrder(marketbuy)
 		if err != nil {
 			return err
 		}
@@ -47,30 +51,34 @@ func marketOrderPlacer(Client *client.Client) error {
 
 func makeMarketSimple(Client *client.Client) error {
 	ticker := time.NewTicker(tick)
-	stradle := 100.0
+	stradle := orderbook.AmountFromInt(100)
 
-	bestAsk := 0.0
-	bestBid := 0.0
+	bestAsk := orderbook.Amount{}
+	bestBid := orderbook.Amount{}
 
 	for {
 		<-ticker.C
 
-		bestAsk, _ = Client.GetBestAskPrice(server.Market("ETH"))
+		bestAsk, _ = Client.GetBestAskPrice(market)
 		fmt.Println(bestAsk)
 		fmt.Println(bestAsk)
 
-		bestBid, _ = Client.GetBestBidPrice(server.Market("ETH"))
+		bestBid, _ = Client.GetBestBidPrice(market)
 		fmt.Println(bestBid)
 
-		spread := math.Abs(bestAsk - bestBid)
+		spread := bestAsk.Sub(bestBid)
+		if spread.Sign() < 0 {
+			spread = spread.Neg()
+		}
 		fmt.Println(spread)
 
 		if len(myBids) < maxOrders {
 			// Place a bid limit order
 			bidLimit := &client.PlaceLimitOrderParams{
+				Market: market,
 				UserId: 2,
-				Size:   2,
-				Price:  bestBid + stradle,
+				Size:   orderbook.AmountFromInt(2),
+				Price:  bestBid.Add(stradle),
 				Bid:    true,
 			}
 			orderId, err := Client.PlaceLimitOrder(bidLimit)
@@ -83,25 +91,23 @@ func makeMarketSimple(Client *client.Client) error {
 			}
 
 			fmt.Printf(" \n orders of user is these \n %v", orders)
-			myBids[bestBid+stradle] = orderId.OrderId
+			myBids[bestBid.Add(stradle).String()] = orderId.OrderId
 		}
 
 		// Place an ask limit order
 		if len(myAsks) < maxOrders {
 			askLimit := &client.PlaceLimitOrderParams{
+				Market: market,
 				UserId: 1,
-				Size:   1,
-				Price:  bestAsk - stradle,
+				Size:   orderbook.AmountFromInt(1),
+				Price:  bestAsk.Sub(stradle),
 				Bid:    false,
 			}
 			orderId, err := Client.PlaceLimitOrder(askLimit)
 			if err != nil {
 				return err
 			}
-			myAsks[bestAsk-stradle] = orderId.OrderId
-
-			spread := math.Abs(bestAsk - bestBid)
-			fmt.Println(spread)
+			myAsks[bestAsk.Sub(stradle).String()] = orderId.OrderId
 
 		}
 
@@ -109,17 +115,26 @@ func makeMarketSimple(Client *client.Client) error {
 }
 
 func seedMarket(c *client.Client) error {
+	// the users trade ETH they deposited with the exchange
+	for _, userId := range []int64{1, 2} {
+		if _, err := c.Deposit(userId, server.AssetETH, orderbook.AmountFromInt(50)); err != nil {
+			return err
+		}
+	}
+
 	ask := &client.PlaceLimitOrderParams{
+		Market: market,
 		UserId: 1,
-		Size:   7,
-		Price:  100,
+		Size:   orderbook.AmountFromInt(7),
+		Price:  orderbook.AmountFromInt(100),
 		Bid:    false,
 	}
 
 	bid := &client.PlaceLimitOrderParams{
+		Market: market,
 		UserId: 2,
-		Size:   7,
-		Price:  10,
+		Size:   orderbook.AmountFromInt(7),
+		Price:  orderbook.AmountFromInt(10),
 		Bid:    true,
 	}
 
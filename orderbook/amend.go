@@ -0,0 +1,94 @@
+package orderbook
+
+import "errors"
+
+var (
+	// ErrInvalidAmend is returned for an amend with a negative price or size.
+	ErrInvalidAmend = errors.New("amended price and size must be positive")
+	// ErrAmendStopOrder is returned when amending a pending stop order.
+	ErrAmendStopOrder = errors.New("stop orders can not be amended")
+)
+
+// AmendOrder changes the price and the size of a resting order in one step.
+// A zero price or size keeps the current one, and size is what is left of
+// the order, hidden iceberg reserve included. Reducing the size at the same
+// price keeps the order's time priority. A new price or a bigger size
+// takes the order out and places it again under the same id: it goes to
+// the back of the queue and can match like a new limit order, post-only
+// rules included. When the amend is rejected the order is left as it was.
+func (ob *Orderbook) AmendOrder(id int64, price, size Amount) ([]Match, error) {
+	return ob.amendOrderAt(ob.Clock.Now(), id, price, size)
+}
+
+// amendOrderAt is AmendOrder at the unix nano time now.
+func (ob *Orderbook) amendOrderAt(now int64, id int64, price, size Amount) ([]Match, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.selfTrades = nil
+	ob.expireOrders(now)
+
+	if _, ok := ob.stops[id]; ok {
+		return nil, ErrAmendStopOrder
+	}
+	o, ok := ob.orders[id]
+	if !ok {
+		return nil, ErrOrderNotFound
+	}
+
+	if price.Sign() < 0 || size.Sign() < 0 {
+		return nil, ErrInvalidAmend
+	}
+	if price.IsZero() {
+		price = o.Limit.Price
+	}
+	remaining := o.Size.Add(o.Hidden)
+	if size.IsZero() {
+		size = remaining
+	}
+	if size.Scale() > ob.SizeDecimals {
+		return nil, ErrSizePrecision
+	}
+	if price.Scale() > ob.PriceDecimals {
+		return nil, ErrPricePrecision
+	}
+
+	if price.Equal(o.Limit.Price) && size.Cmp(remaining) <= 0 {
+		ob.reduceOrder(o, size)
+		return []Match{}, nil
+	}
+
+	if o.PostOnly != PostOnlyOff {
+		if _, err := ob.postOnlyPrice(price, o); err != nil {
+			return nil, err
+		}
+	}
+
+	limit := o.Limit
+	limit.DeleteOrder(o)
+	ob.forget(o)
+	if limit.Len() == 0 {
+		ob.clearLimit(o.Bid, limit)
+	}
+
+	o.Size = size
+	o.Hidden = Amount{}
+	o.TimeStamp = now
+	matches, err := ob.placeLimitOrder(now, price, o)
+	if err != nil {
+		return nil, err
+	}
+	return append(matches, ob.triggerStops(now)...), nil
+}
+
+// reduceOrder cuts what is left of a resting order down to size in place,
+// taking it from the hidden reserve of an iceberg first.
+func (ob *Orderbook) reduceOrder(o *Order, size Amount) {
+	if size.Cmp(o.Size) >= 0 {
+		o.Hidden = size.Sub(o.Size)
+		return
+	}
+	o.Limit.TotalVolumne = o.Limit.TotalVolumne.Sub(o.Size.Sub(size))
+	o.Size = size
+	o.Hidden = Amount{}
+}
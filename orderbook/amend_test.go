@@ -0,0 +1,146 @@
+package orderbook
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func restingIds(l *Limit) []int64 {
+	ids := []int64{}
+	for _, o := range l.Orders() {
+		ids = append(ids, o.Id)
+	}
+	return ids
+}
+
+func TestAmendSizeDownKeepsPriority(t *testing.T) {
+	ob := NewOrderbook()
+
+	first := NewOrder(true, amount(10), 1)
+	second := NewOrder(true, amount(10), 2)
+	ob.PlaceLimitOrder(amount(100), first)
+	ob.PlaceLimitOrder(amount(100), second)
+
+	matches, err := ob.AmendOrder(first.Id, Amount{}, amount(4))
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 0)
+	assert.Equal(t, restingIds(ob.BestBid()), []int64{first.Id, second.Id})
+	assert.Equal(t, ob.BestBid().TotalVolumne, amount(14))
+
+	// the same price and size is a no-op that keeps priority as well
+	_, err = ob.AmendOrder(first.Id, amount(100), amount(4))
+	assert.Nil(t, err)
+	assert.Equal(t, restingIds(ob.BestBid()), []int64{first.Id, second.Id})
+}
+
+func TestAmendSizeUpLosesPriority(t *testing.T) {
+	ob := NewOrderbook()
+
+	first := NewOrder(false, amount(10), 1)
+	second := NewOrder(false, amount(10), 2)
+	ob.PlaceLimitOrder(amount(100), first)
+	ob.PlaceLimitOrder(amount(100), second)
+
+	_, err := ob.AmendOrder(first.Id, Amount{}, amount(12))
+	assert.Nil(t, err)
+	assert.Equal(t, restingIds(ob.BestAsk()), []int64{second.Id, first.Id})
+	assert.Equal(t, ob.AskTotalVolumne(), amount(22))
+
+	amended, ok := ob.Order(first.Id)
+	assert.True(t, ok)
+	assert.Equal(t, amended.Size, amount(12))
+}
+
+func TestAmendPriceCanMatch(t *testing.T) {
+	ob := NewOrderbook()
+
+	ask := NewOrder(false, amount(5), 1)
+	ob.PlaceLimitOrder(amount(101), ask)
+	bid := NewOrder(true, amount(8), 2)
+	ob.PlaceLimitOrder(amount(99), bid)
+
+	matches, err := ob.AmendOrder(bid.Id, amount(101), Amount{})
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, matches[0].SizeFilled, amount(5))
+	assert.Equal(t, ob.asks.Len(), 0)
+
+	amended, ok := ob.Order(bid.Id)
+	assert.True(t, ok)
+	assert.Equal(t, amended.Limit.Price, amount(101))
+	assert.Equal(t, amended.Size, amount(3))
+	_, ok = ob.bidLimits[amount(99).String()]
+	assert.False(t, ok)
+}
+
+func TestAmendRejectedLeavesOrder(t *testing.T) {
+	ob := NewOrderbook()
+
+	ask := NewOrder(false, amount(5), 1)
+	ob.PlaceLimitOrder(amount(101), ask)
+	bid := NewOrder(true, amount(5), 2)
+	bid.PostOnly = PostOnlyReject
+	ob.PlaceLimitOrder(amount(99), bid)
+
+	_, err := ob.AmendOrder(bid.Id, amount(101), Amount{})
+	assert.Equal(t, err, ErrPostOnlyWouldCross)
+	resting, ok := ob.Order(bid.Id)
+	assert.True(t, ok)
+	assert.Equal(t, resting.Limit.Price, amount(99))
+
+	_, err = ob.AmendOrder(bid.Id, NewAmount(99001, 3), Amount{})
+	assert.Equal(t, err, ErrPricePrecision)
+	_, err = ob.AmendOrder(bid.Id, Amount{}, amount(-1))
+	assert.Equal(t, err, ErrInvalidAmend)
+	_, err = ob.AmendOrder(12345678, amount(1), Amount{})
+	assert.Equal(t, err, ErrOrderNotFound)
+
+	stop := &StopOrder{Order: NewOrder(true, amount(1), 3), StopPrice: amount(200)}
+	ob.PlaceStopOrder(stop)
+	_, err = ob.AmendOrder(stop.Order.Id, amount(1), Amount{})
+	assert.Equal(t, err, ErrAmendStopOrder)
+}
+
+func TestAmendIceberg(t *testing.T) {
+	ob := NewOrderbook()
+
+	iceberg := NewOrder(false, amount(10), 1)
+	iceberg.DisplaySize = amount(2)
+	ob.PlaceLimitOrder(amount(100), iceberg)
+
+	// the reserve goes first
+	ob.AmendOrder(iceberg.Id, Amount{}, amount(5))
+	resting, _ := ob.Order(iceberg.Id)
+	assert.Equal(t, resting.Size, amount(2))
+	assert.Equal(t, resting.Hidden, amount(3))
+
+	ob.AmendOrder(iceberg.Id, Amount{}, amount(1))
+	resting, _ = ob.Order(iceberg.Id)
+	assert.Equal(t, resting.Size, amount(1))
+	assert.Equal(t, resting.Hidden, amount(0))
+	assert.Equal(t, ob.AskTotalVolumne(), amount(1))
+
+	// growing it splits it again behind a new peak
+	ob.AmendOrder(iceberg.Id, Amount{}, amount(7))
+	resting, _ = ob.Order(iceberg.Id)
+	assert.Equal(t, resting.Size, amount(2))
+	assert.Equal(t, resting.Hidden, amount(5))
+}
+
+func TestSequencerAmend(t *testing.T) {
+	s := NewSequencer(NewOrderbook())
+	defer s.Close()
+
+	o := NewOrder(true, amount(3), 1)
+	s.Submit(Command{Type: CommandPlaceLimit, Order: o, Price: amount(100)})
+
+	res := s.Submit(Command{Type: CommandAmend, OrderId: o.Id, Price: amount(98), Size: amount(2)})
+	assert.Nil(t, res.Err)
+	assert.Equal(t, eventTypes(res.Events), []EventType{EventAmended})
+	assert.Equal(t, s.Orderbook().BestBid().Price, amount(98))
+
+	res = s.Submit(Command{Type: CommandAmend, OrderId: -1, Size: amount(2)})
+	assert.Equal(t, res.Err, ErrOrderNotFound)
+	assert.Equal(t, eventTypes(res.Events), []EventType{EventRejected})
+}
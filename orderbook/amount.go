@@ -0,0 +1,317 @@
+package orderbook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// MaxScale is the largest number of decimals an Amount can hold, enough to
+// express one wei in ETH.
+const MaxScale = 18
+
+var (
+	ErrInvalidAmount = errors.New("invalid amount")
+	ErrAmountScale   = fmt.Errorf("amount has more than %d decimals", MaxScale)
+)
+
+// Amount is an exact fixed-point decimal: units scaled down by 10^scale.
+// Units are arbitrary-precision, so no sum or product overflows. Amounts are
+// kept normalized, without trailing zeros in units, and are compared with
+// Cmp; they are not comparable with ==, key maps by String instead. The
+// zero value is zero.
+type Amount struct {
+	_ [0]func() // not comparable, == would compare the units pointers
+	// units is nil for zero and never changed once set, so amounts can be
+	// copied freely
+	units *big.Int
+	scale uint8
+}
+
+var (
+	bigZero = new(big.Int)
+	bigTen  = big.NewInt(10)
+
+	pow10 = func() [2*MaxScale + 1]*big.Int {
+		var p [2*MaxScale + 1]*big.Int
+		p[0] = big.NewInt(1)
+		for i := 1; i < len(p); i++ {
+			p[i] = new(big.Int).Mul(p[i-1], bigTen)
+		}
+		return p
+	}()
+)
+
+// NewAmount returns units scaled down by 10^scale, so NewAmount(125, 2) is 1.25.
+func NewAmount(units int64, scale uint8) Amount {
+	return newAmount(big.NewInt(units), scale)
+}
+
+// NewAmountFromBig is like NewAmount for units of any size.
+func NewAmountFromBig(units *big.Int, scale uint8) Amount {
+	return newAmount(new(big.Int).Set(units), scale)
+}
+
+// newAmount takes ownership of units.
+func newAmount(units *big.Int, scale uint8) Amount {
+	if scale > MaxScale {
+		panic(ErrAmountScale)
+	}
+	return Amount{units: units, scale: scale}.normalize()
+}
+
+// AmountFromInt returns the whole number i as an Amount.
+func AmountFromInt(i int64) Amount {
+	return NewAmount(i, 0)
+}
+
+// ParseAmount parses a plain decimal such as "-12.345" exactly.
+func ParseAmount(s string) (Amount, error) {
+	str := s
+	neg := strings.HasPrefix(str, "-")
+	if neg || strings.HasPrefix(str, "+") {
+		str = str[1:]
+	}
+
+	whole, frac, _ := strings.Cut(str, ".")
+	if whole == "" && frac == "" {
+		return Amount{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	if len(frac) > MaxScale {
+		frac = strings.TrimRight(frac, "0")
+		if len(frac) > MaxScale {
+			return Amount{}, fmt.Errorf("%w: %q", ErrAmountScale, s)
+		}
+	}
+	for _, r := range whole + frac {
+		if r < '0' || r > '9' {
+			return Amount{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+		}
+	}
+
+	units, ok := new(big.Int).SetString("0"+whole+frac, 10)
+	if !ok {
+		return Amount{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	if neg {
+		units.Neg(units)
+	}
+	return newAmount(units, uint8(len(frac))), nil
+}
+
+// MustParseAmount is like ParseAmount but panics on malformed input. It is
+// meant for constants and tests.
+func MustParseAmount(s string) Amount {
+	a, err := ParseAmount(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// Scale returns the number of decimals needed to represent a exactly.
+func (a Amount) Scale() uint8 { return a.scale }
+
+func (a Amount) IsZero() bool { return a.Sign() == 0 }
+
+// Sign returns -1, 0 or 1 depending on the sign of a.
+func (a Amount) Sign() int { return a.int().Sign() }
+
+// Cmp returns -1, 0 or 1 when a is less than, equal to or greater than b.
+func (a Amount) Cmp(b Amount) int {
+	x, y, _ := align(a, b)
+	return x.Cmp(y)
+}
+
+// Equal tells if a and b are the same value.
+func (a Amount) Equal(b Amount) bool { return a.Cmp(b) == 0 }
+
+func (a Amount) LessThan(b Amount) bool    { return a.Cmp(b) < 0 }
+func (a Amount) GreaterThan(b Amount) bool { return a.Cmp(b) > 0 }
+
+func (a Amount) Add(b Amount) Amount {
+	x, y, scale := align(a, b)
+	return newAmount(new(big.Int).Add(x, y), scale)
+}
+
+func (a Amount) Sub(b Amount) Amount {
+	return a.Add(b.Neg())
+}
+
+func (a Amount) Neg() Amount {
+	if a.IsZero() {
+		return Amount{}
+	}
+	return Amount{units: new(big.Int).Neg(a.units), scale: a.scale}
+}
+
+// Mul returns the exact product of a and b, e.g. the notional of a price
+// and a size. It panics when the product has more than MaxScale decimals.
+func (a Amount) Mul(b Amount) Amount {
+	units := new(big.Int).Mul(a.int(), b.int())
+	scale := a.scale + b.scale
+	if scale > MaxScale {
+		rem := new(big.Int)
+		units.QuoRem(units, pow10[scale-MaxScale], rem)
+		if rem.Sign() != 0 {
+			panic(ErrAmountScale)
+		}
+		scale = MaxScale
+	}
+	return newAmount(units, scale)
+}
+
+// Truncate drops the decimals of a beyond scale, rounding towards zero.
+func (a Amount) Truncate(scale uint8) Amount {
+	if a.scale <= scale {
+		return a
+	}
+	return newAmount(new(big.Int).Quo(a.units, pow10[a.scale-scale]), scale)
+}
+
+// Div returns a divided by b truncated to scale decimals.
+func (a Amount) Div(b Amount, scale uint8) Amount {
+	if b.IsZero() {
+		panic("orderbook: division by zero amount")
+	}
+	// a/b = (a.units * 10^(scale + b.scale - a.scale)) / b.units
+	num := new(big.Int).Set(a.int())
+	exp := int(scale) + int(b.scale) - int(a.scale)
+	if exp >= 0 {
+		num.Mul(num, pow10[exp])
+	} else {
+		num.Quo(num, pow10[-exp])
+	}
+	return newAmount(num.Quo(num, b.units), scale)
+}
+
+// Float64 returns the nearest float64. It is only meant for display.
+func (a Amount) Float64() float64 {
+	f, _ := strconv.ParseFloat(a.String(), 64)
+	return f
+}
+
+// ScaledInt returns a as an integer number of 10^-scale units, e.g. the wei
+// in an ETH amount for scale 18. Decimals beyond scale are truncated.
+func (a Amount) ScaledInt(scale uint8) *big.Int {
+	i := new(big.Int).Set(a.int())
+	if a.scale > scale {
+		return i.Quo(i, new(big.Int).Exp(bigTen, big.NewInt(int64(a.scale-scale)), nil))
+	}
+	return i.Mul(i, new(big.Int).Exp(bigTen, big.NewInt(int64(scale-a.scale)), nil))
+}
+
+// String formats a as a plain decimal. Equal amounts format the same.
+func (a Amount) String() string {
+	s := a.int().String()
+	if a.scale == 0 {
+		return s
+	}
+
+	neg := a.Sign() < 0
+	if neg {
+		s = s[1:]
+	}
+	if len(s) <= int(a.scale) {
+		s = strings.Repeat("0", int(a.scale)-len(s)+1) + s
+	}
+	s = s[:len(s)-int(a.scale)] + "." + s[len(s)-int(a.scale):]
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+// MarshalJSON encodes the amount as a decimal string so clients never lose
+// precision to float parsing.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// UnmarshalJSON accepts both a decimal string and a bare JSON number.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	s := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	} else if strings.ContainsAny(s, "eE") {
+		return fmt.Errorf("%w: exponents are not supported: %s", ErrInvalidAmount, s)
+	}
+
+	parsed, err := ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// MarshalText lets amounts be used as JSON object keys.
+func (a Amount) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Amount) UnmarshalText(text []byte) error {
+	parsed, err := ParseAmount(string(text))
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// MinAmount returns the smaller of a and b.
+func MinAmount(a, b Amount) Amount {
+	if a.Cmp(b) <= 0 {
+		return a
+	}
+	return b
+}
+
+// int returns the units of a, which must not be changed.
+func (a Amount) int() *big.Int {
+	if a.units == nil {
+		return bigZero
+	}
+	return a.units
+}
+
+func (a Amount) normalize() Amount {
+	if a.units == nil || a.units.Sign() == 0 {
+		return Amount{}
+	}
+	if a.scale == 0 {
+		return a
+	}
+	q, rem := new(big.Int), new(big.Int)
+	for a.scale > 0 {
+		q.QuoRem(a.units, bigTen, rem)
+		if rem.Sign() != 0 {
+			break
+		}
+		a.units, q = q, a.units
+		a.scale--
+	}
+	return a
+}
+
+// align returns the units of a and b at their common scale. They must not
+// be changed.
+func align(a, b Amount) (*big.Int, *big.Int, uint8) {
+	switch {
+	case a.scale < b.scale:
+		return new(big.Int).Mul(a.int(), pow10[b.scale-a.scale]), b.int(), b.scale
+	case a.scale > b.scale:
+		return a.int(), new(big.Int).Mul(b.int(), pow10[a.scale-b.scale]), a.scale
+	}
+	return a.int(), b.int(), a.scale
+}
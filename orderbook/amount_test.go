@@ -0,0 +1,74 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAmountIsExact(t *testing.T) {
+	sum := MustParseAmount("0.1").Add(MustParseAmount("0.2"))
+
+	assert.Equal(t, sum, MustParseAmount("0.3"))
+	assert.Equal(t, sum.String(), "0.3")
+	assert.True(t, sum.Sub(MustParseAmount("0.30")).IsZero())
+}
+
+func TestAmountIsNormalized(t *testing.T) {
+	limits := map[string]bool{}
+	limits[MustParseAmount("100").String()] = true
+	limits[MustParseAmount("100.00").String()] = true
+	limits[NewAmount(10000, 2).String()] = true
+
+	assert.Equal(t, len(limits), 1)
+	assert.Equal(t, MustParseAmount("100.00"), AmountFromInt(100))
+	assert.Equal(t, MustParseAmount("1.50").Scale(), uint8(1))
+}
+
+func TestAmountArithmetic(t *testing.T) {
+	price := MustParseAmount("3012.25")
+	size := MustParseAmount("0.004")
+
+	assert.Equal(t, price.Mul(size).String(), "12.049")
+	assert.Equal(t, MustParseAmount("10").Div(MustParseAmount("3"), 4).String(), "3.3333")
+	assert.Equal(t, MustParseAmount("-1.239").Truncate(2).String(), "-1.23")
+	assert.Equal(t, MustParseAmount("0.05").Neg().String(), "-0.05")
+	assert.Equal(t, MustParseAmount("1.5").ScaledInt(18).String(), "1500000000000000000")
+	assert.Equal(t, MustParseAmount("2").Cmp(MustParseAmount("1.99")), 1)
+}
+
+func TestAmountDoesNotOverflow(t *testing.T) {
+	// more than an int64 holds at 18 decimals
+	wei := MustParseAmount("0.000000000000000001")
+	balance := AmountFromInt(100).Add(MustParseAmount("1.000000000000000001"))
+	assert.Equal(t, balance.String(), "101.000000000000000001")
+	assert.Equal(t, balance.Sub(wei), AmountFromInt(101))
+
+	big := MustParseAmount("123456789012345678901234567890.5")
+	assert.Equal(t, big.Mul(big).String(), "15241578753238836750495351562659655576514250878776253619990.25")
+	assert.Equal(t, big.Add(wei).Cmp(big), 1)
+	assert.Equal(t, NewAmountFromBig(balance.ScaledInt(18), 18), balance)
+}
+
+func TestParseAmountRejectsMalformedInput(t *testing.T) {
+	for _, s := range []string{"", ".", "1.2.3", "abc", "1e5", "0.0000000000000000001"} {
+		_, err := ParseAmount(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	var v struct {
+		Price Amount
+		Size  Amount
+	}
+	err := json.Unmarshal([]byte(`{"Price":"0.30","Size":12.5}`), &v)
+	assert.Nil(t, err)
+	assert.Equal(t, v.Price, MustParseAmount("0.3"))
+	assert.Equal(t, v.Size, MustParseAmount("12.5"))
+
+	b, err := json.Marshal(v)
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), `{"Price":"0.3","Size":"12.5"}`)
+}
@@ -0,0 +1,95 @@
+package orderbook
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the time in unix nanoseconds. The orderbook reads it for order
+// and trade timestamps and to expire GTD orders, so a simulation or replay
+// with its own clock is fully deterministic.
+type Clock interface {
+	Now() int64
+}
+
+// SystemClock is the wall clock.
+type SystemClock struct{}
+
+func (SystemClock) Now() int64 {
+	return time.Now().UnixNano()
+}
+
+// ManualClock only moves when it is told to. It is safe for concurrent use.
+type ManualClock struct {
+	mu  sync.Mutex
+	now int64
+}
+
+// NewManualClock returns a clock stopped at now.
+func NewManualClock(now int64) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Set moves the clock to now.
+func (c *ManualClock) Set(now int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = now
+}
+
+// Advance moves the clock forward by d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now += int64(d)
+}
+
+// IDGenerator hands out order ids.
+type IDGenerator interface {
+	// NextID returns an id that was not handed out or observed before.
+	NextID() int64
+	// Observe tells the generator id is taken, e.g. by an order recovered
+	// from a journal, so it is never handed out.
+	Observe(id int64)
+}
+
+// SequenceIDGenerator hands out 1, 2, 3 and so on. Ids are unique and
+// increase in the order they are handed out, so they also break ties
+// between orders stamped in the same nanosecond. It is safe for concurrent
+// use.
+type SequenceIDGenerator struct {
+	last atomic.Int64
+}
+
+func NewSequenceIDGenerator() *SequenceIDGenerator {
+	return &SequenceIDGenerator{}
+}
+
+func (g *SequenceIDGenerator) NextID() int64 {
+	return g.last.Add(1)
+}
+
+func (g *SequenceIDGenerator) Observe(id int64) {
+	for {
+		last := g.last.Load()
+		if id <= last || g.last.CompareAndSwap(last, id) {
+			return
+		}
+	}
+}
+
+var (
+	// defaultClock and defaultIDs are used by the package level NewOrder
+	defaultClock Clock       = SystemClock{}
+	defaultIDs   IDGenerator = NewSequenceIDGenerator()
+)
@@ -0,0 +1,100 @@
+package orderbook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newDeterministicOrderbook() (*Orderbook, *ManualClock) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	ob := NewOrderbook()
+	ob.Clock = clock
+	return ob, clock
+}
+
+func TestSequenceIDGenerator(t *testing.T) {
+	ids := NewSequenceIDGenerator()
+	assert.Equal(t, ids.NextID(), int64(1))
+	assert.Equal(t, ids.NextID(), int64(2))
+
+	ids.Observe(10)
+	ids.Observe(5)
+	assert.Equal(t, ids.NextID(), int64(11))
+}
+
+func TestDeterministicReplay(t *testing.T) {
+	run := func() ([]*Trade, []*Limit) {
+		ob, clock := newDeterministicOrderbook()
+		for i := int64(0); i < 20; i++ {
+			o := ob.NewOrder(i%2 == 0, amount(1+i%3), i%4)
+			if i%5 == 0 {
+				o.TimeInForce = GTD
+				o.ExpiresAt = clock.Now() + int64(3*time.Millisecond)
+			}
+			ob.PlaceLimitOrder(amount(100+i%4-2), o)
+			clock.Advance(time.Millisecond)
+		}
+		ob.ExpireOrders(clock.Now())
+		return ob.Trades(), ob.Bids()
+	}
+
+	trades, bids := run()
+	assert.NotEmpty(t, trades)
+	againTrades, againBids := run()
+	assert.Equal(t, againTrades, trades)
+	assert.Equal(t, againBids, bids)
+}
+
+func TestSameNanosecondGoesById(t *testing.T) {
+	ob, clock := newDeterministicOrderbook()
+
+	// both stops are stamped in the same nanosecond, the one made first
+	// triggers first
+	first := &StopOrder{Order: ob.NewOrder(true, amount(1), 1), StopPrice: amount(100)}
+	second := &StopOrder{Order: ob.NewOrder(true, amount(1), 2), StopPrice: amount(100)}
+	ob.PlaceStopOrder(second)
+	ob.PlaceStopOrder(first)
+	assert.Equal(t, first.Order.TimeStamp, second.Order.TimeStamp)
+	assert.Equal(t, ob.Stops()[0].Order.Id, first.Order.Id)
+
+	// and GTD orders expiring together are returned in the same order
+	a := ob.NewOrder(false, amount(1), 1)
+	b := ob.NewOrder(false, amount(1), 1)
+	for _, o := range []*Order{b, a} {
+		o.TimeInForce = GTD
+		o.ExpiresAt = clock.Now() + 1
+		ob.PlaceLimitOrder(amount(200), o)
+	}
+	clock.Advance(time.Nanosecond)
+	expired := ob.ExpireOrders(clock.Now())
+	assert.Equal(t, len(expired), 2)
+	assert.Equal(t, expired[0].Id, a.Id)
+}
+
+func TestRecoveredBookKeepsIdsUnique(t *testing.T) {
+	dir := t.TempDir()
+
+	ob, _ := newDeterministicOrderbook()
+	st := openTestStore(t, dir, 2)
+	s, err := RecoverSequencer(ob, st)
+	assert.Nil(t, err)
+	last := int64(0)
+	for i := 0; i < 5; i++ {
+		o := ob.NewOrder(true, amount(1), 1)
+		s.Submit(Command{Type: CommandPlaceLimit, Order: o, Price: amount(100)})
+		taker := ob.NewOrder(false, amount(1), 2)
+		s.Submit(Command{Type: CommandPlaceMarket, Order: taker})
+		last = taker.Id
+	}
+	s.Close()
+
+	// every order was filled, only the snapshot remembers the ids
+	recoveredBook, _ := newDeterministicOrderbook()
+	recovered, err := RecoverSequencer(recoveredBook, openTestStore(t, dir, 2))
+	assert.Nil(t, err)
+	defer recovered.Close()
+	assert.Equal(t, recoveredBook.OrderCount(), 0)
+	assert.Equal(t, recoveredBook.NewOrder(true, amount(1), 1).Id, last+1)
+}
@@ -0,0 +1,356 @@
+package orderbook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	journalFile  = "journal"
+	snapshotFile = "snapshot"
+
+	// DefaultSnapshotEvery is how many commands a store journals between
+	// two snapshots.
+	DefaultSnapshotEvery = 1000
+	// DefaultSnapshotTrades is how many of the latest trades a snapshot
+	// keeps.
+	DefaultSnapshotTrades = 1000
+
+	// recordHeaderSize is the length and the checksum in front of every
+	// record
+	recordHeaderSize = 8
+	maxRecordSize    = 1 << 30
+)
+
+var (
+	// ErrJournalCorrupt is returned when a record other than the last one
+	// of the journal fails its checksum, or records are out of sequence.
+	ErrJournalCorrupt = errors.New("journal is corrupt")
+
+	errChecksum       = errors.New("record checksum mismatch")
+	errRecordTooLarge = errors.New("record length out of range")
+	crcTable          = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// JournalEntry is one journaled command and its sequence number.
+type JournalEntry struct {
+	Seq     uint64
+	Command Command
+}
+
+// Journal is an append-only file of checksummed records. A record is on
+// disk once Append returns.
+type Journal struct {
+	f *os.File
+}
+
+// OpenJournal opens the journal at path, creating it when needed.
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{f: f}, nil
+}
+
+// Records reads every record of the journal. A torn record at the end, left
+// by a crash during a write, is cut off.
+func (j *Journal) Records() ([][]byte, error) {
+	info, err := j.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(j.f)
+	records := [][]byte{}
+	offset := int64(0)
+	for {
+		payload, n, err := readRecord(r)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err == io.ErrUnexpectedEOF || (err == errChecksum && offset+n == info.Size()) {
+			return records, j.f.Truncate(offset)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: record at offset %d: %s", ErrJournalCorrupt, offset, err)
+		}
+		records = append(records, payload)
+		offset += n
+	}
+}
+
+// Append writes payload as the next record and syncs it to disk. A record
+// that fails to be written is cut off again, so it does not end up in the
+// middle of the journal.
+func (j *Journal) Append(payload []byte) error {
+	info, err := j.f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(frameRecord(payload)); err != nil {
+		j.f.Truncate(info.Size())
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		j.f.Truncate(info.Size())
+		return err
+	}
+	return nil
+}
+
+// Reset empties the journal.
+func (j *Journal) Reset() error {
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *Journal) Close() error {
+	return j.f.Close()
+}
+
+// Store keeps the write-ahead journal and the latest snapshot of one
+// orderbook in a directory. Every command is appended to the journal and
+// synced before it is applied. Every SnapshotEvery commands the whole book
+// is written to the snapshot, with its SnapshotTrades latest trades, and
+// the journal is emptied, so recovery loads the snapshot and replays only
+// the journal tail.
+type Store struct {
+	SnapshotEvery  uint64
+	SnapshotTrades int
+
+	dir     string
+	journal *Journal
+	// seq is the sequence number of the last journaled command
+	seq uint64
+	// snapshotSeq is the sequence number the latest snapshot includes
+	snapshotSeq uint64
+	// err is the last error writing a snapshot, which is retried after
+	// the next command. The sequencer sets it, mu guards it for readers.
+	mu  sync.Mutex
+	err error
+}
+
+// OpenStore opens the store kept in dir, creating dir when needed. A torn
+// record at the end of the journal, left by a crash during a write, is cut
+// off.
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	journal, err := OpenJournal(filepath.Join(dir, journalFile))
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		SnapshotEvery:  DefaultSnapshotEvery,
+		SnapshotTrades: DefaultSnapshotTrades,
+		dir:            dir,
+		journal:        journal,
+	}, nil
+}
+
+// Err returns the last error writing a snapshot, if the store has not
+// managed to write one since.
+func (st *Store) Err() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.err
+}
+
+func (st *Store) setErr(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.err = err
+}
+
+func (st *Store) Close() error {
+	return st.journal.Close()
+}
+
+// load returns the latest snapshot, nil when there is none yet, and the
+// journaled commands that came after it.
+func (st *Store) load() (*Snapshot, []JournalEntry, error) {
+	var snap *Snapshot
+	payload, err := ReadRecordFile(filepath.Join(st.dir, snapshotFile))
+	switch {
+	case err == nil:
+		snap = &Snapshot{}
+		if err := json.Unmarshal(payload, snap); err != nil {
+			return nil, nil, fmt.Errorf("decoding snapshot: %w", err)
+		}
+		st.snapshotSeq = snap.Seq
+	case !os.IsNotExist(err):
+		return nil, nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	entries, err := st.readJournal()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	st.seq = st.snapshotSeq
+	tail := []JournalEntry{}
+	for _, entry := range entries {
+		// entries up to the snapshot are left when a crash came between
+		// writing the snapshot and emptying the journal
+		if entry.Seq <= st.snapshotSeq {
+			continue
+		}
+		if entry.Seq != st.seq+1 {
+			return nil, nil, fmt.Errorf("%w: command %d follows %d", ErrJournalCorrupt, entry.Seq, st.seq)
+		}
+		st.seq = entry.Seq
+		tail = append(tail, entry)
+	}
+	return snap, tail, nil
+}
+
+// readJournal reads every entry of the journal and cuts off a torn last
+// record.
+func (st *Store) readJournal() ([]JournalEntry, error) {
+	records, err := st.journal.Records()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]JournalEntry, len(records))
+	for i, payload := range records {
+		if err := json.Unmarshal(payload, &entries[i]); err != nil {
+			return nil, fmt.Errorf("%w: record %d: %s", ErrJournalCorrupt, i, err)
+		}
+	}
+	return entries, nil
+}
+
+// append journals cmd under the next sequence number and syncs it to disk.
+func (st *Store) append(cmd Command) error {
+	payload, err := json.Marshal(JournalEntry{Seq: st.seq + 1, Command: cmd})
+	if err != nil {
+		return err
+	}
+	if err := st.journal.Append(payload); err != nil {
+		return err
+	}
+	st.seq++
+	return nil
+}
+
+func (st *Store) snapshotDue() bool {
+	return st.SnapshotEvery > 0 && st.seq-st.snapshotSeq >= st.SnapshotEvery
+}
+
+// writeSnapshot replaces the snapshot with snap and empties the journal.
+func (st *Store) writeSnapshot(snap *Snapshot) error {
+	snap.Seq = st.seq
+	payload, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := WriteRecordFile(filepath.Join(st.dir, snapshotFile), payload); err != nil {
+		return err
+	}
+	st.snapshotSeq = snap.Seq
+
+	return st.journal.Reset()
+}
+
+// WriteRecordFile replaces the file at path with payload as one checksummed
+// record. The new file is renamed into place only once it is on disk, so a
+// crash leaves either the old or the new one.
+func WriteRecordFile(path string, payload []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(frameRecord(payload)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// ReadRecordFile returns the payload of a file written by WriteRecordFile.
+// A missing file is reported like os.ReadFile does.
+func ReadRecordFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	payload, _, err := readRecord(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// frameRecord puts the length and the CRC-32C checksum of payload in front
+// of it.
+func frameRecord(payload []byte) []byte {
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[recordHeaderSize:], payload)
+	return record
+}
+
+// readRecord reads one framed record and returns its payload and the number
+// of bytes it took. It returns io.EOF at a clean end and
+// io.ErrUnexpectedEOF for a record cut short.
+func readRecord(r *bufio.Reader) ([]byte, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return nil, 0, errRecordTooLarge
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	n := int64(recordHeaderSize + len(payload))
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, n, errChecksum
+	}
+	return payload, n, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,214 @@
+package orderbook
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runWorkload submits n commands of every kind to s and returns the
+// sequence number of the last event.
+func runWorkload(t *testing.T, s *Sequencer, n int) uint64 {
+	r := rand.New(rand.NewSource(1))
+	placed := []int64{}
+	lastSeq := uint64(0)
+
+	for i := 0; i < n; i++ {
+		bid := r.Intn(2) == 0
+		o := NewOrder(bid, amount(int64(1+r.Intn(5))), int64(1+r.Intn(3)))
+		price := amount(int64(95 + r.Intn(11)))
+		o.SelfTradePrevention = SelfTradePrevention(r.Intn(5))
+
+		var cmd Command
+		switch k := r.Intn(10); {
+		case k < 5:
+			if r.Intn(4) == 0 {
+				o.DisplaySize = amount(1)
+			}
+			if r.Intn(4) == 0 {
+				o.TimeInForce = GTD
+				o.ExpiresAt = time.Now().Add(time.Duration(r.Intn(2000)) * time.Microsecond).UnixNano()
+			}
+			cmd = Command{Type: CommandPlaceLimit, Order: o, Price: price}
+		case k < 7:
+			cmd = Command{Type: CommandPlaceMarket, Order: o}
+		case k < 8:
+			stop := &StopOrder{Order: o, StopPrice: price}
+			if r.Intn(2) == 0 {
+				stop.StopLimit = true
+				stop.LimitPrice = price
+			}
+			cmd = Command{Type: CommandPlaceStop, Stop: stop}
+		default:
+			if len(placed) == 0 {
+				continue
+			}
+			cmd = Command{Type: CommandCancel, OrderId: placed[r.Intn(len(placed))]}
+			if r.Intn(2) == 0 {
+				cmd = Command{Type: CommandAmend, OrderId: cmd.OrderId, Price: price, Size: o.Size}
+			}
+		}
+		placed = append(placed, o.Id)
+
+		res := s.Submit(cmd)
+		if len(res.Events) > 0 {
+			lastSeq = res.Events[len(res.Events)-1].Seq
+		}
+		time.Sleep(10 * time.Microsecond)
+	}
+
+	assert.NotEmpty(t, s.Orderbook().Trades())
+	return lastSeq
+}
+
+func openTestStore(t *testing.T, dir string, snapshotEvery uint64) *Store {
+	st, err := OpenStore(dir)
+	assert.Nil(t, err)
+	st.SnapshotEvery = snapshotEvery
+	return st
+}
+
+func TestRecoveryRebuildsTheBook(t *testing.T) {
+	for _, snapshotEvery := range []uint64{0, 1, 7, 1000} {
+		dir := t.TempDir()
+
+		s, err := RecoverSequencer(NewOrderbook(), openTestStore(t, dir, snapshotEvery))
+		assert.Nil(t, err)
+		lastSeq := runWorkload(t, s, 300)
+		want := s.Orderbook().snapshot(DefaultSnapshotTrades)
+		// closing writes nothing more, so this is as good as a crash
+		assert.Nil(t, s.Close())
+
+		recovered, err := RecoverSequencer(NewOrderbook(), openTestStore(t, dir, snapshotEvery))
+		assert.Nil(t, err)
+		assert.Equal(t, recovered.Orderbook().snapshot(DefaultSnapshotTrades), want, "snapshot every %d", snapshotEvery)
+
+		// the event sequence carries on where it stopped
+		res := recovered.Submit(Command{Type: CommandCancel, OrderId: -1})
+		assert.Equal(t, res.Events[0].Seq, lastSeq+1)
+
+		// and the recovered sequencer journals as well
+		assert.Nil(t, recovered.Close())
+		again, err := RecoverSequencer(NewOrderbook(), openTestStore(t, dir, snapshotEvery))
+		assert.Nil(t, err)
+		assert.Equal(t, again.Orderbook().snapshot(DefaultSnapshotTrades), want)
+		again.Close()
+	}
+}
+
+func TestSnapshotKeepsTheLatestTrades(t *testing.T) {
+	dir := t.TempDir()
+	st := openTestStore(t, dir, 1)
+	st.SnapshotTrades = 3
+
+	s, err := RecoverSequencer(NewOrderbook(), st)
+	assert.Nil(t, err)
+	// the store error may be read while the sequencer writes snapshots
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				assert.Nil(t, st.Err())
+			}
+		}
+	}()
+	runWorkload(t, s, 100)
+	close(done)
+	trades := s.Orderbook().Trades()
+	assert.Nil(t, s.Close())
+
+	recovered, err := RecoverSequencer(NewOrderbook(), openTestStore(t, dir, 1))
+	assert.Nil(t, err)
+	defer recovered.Close()
+	assert.Equal(t, recovered.Orderbook().Trades(), trades[len(trades)-3:])
+}
+
+func TestRecoveryRunsAfterOnReplayedCommands(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := RecoverSequencer(NewOrderbook(), openTestStore(t, dir, 7))
+	assert.Nil(t, err)
+	// the snapshot waits for After, so whatever After sees is still in
+	// the journal
+	s.SetHooks(Hooks{After: func(cmd Command, res Result) {
+		assert.Greater(t, s.store.seq, s.store.snapshotSeq)
+	}})
+	lastSeq := runWorkload(t, s, 100)
+	tail := s.store.seq - s.store.snapshotSeq
+	s.Close()
+
+	replayed := []Event{}
+	recovered, err := RecoverSequencerWithHooks(NewOrderbook(), openTestStore(t, dir, 7), Hooks{
+		After: func(cmd Command, res Result) {
+			replayed = append(replayed, res.Events...)
+		},
+	})
+	assert.Nil(t, err)
+	defer recovered.Close()
+	assert.Greater(t, tail, uint64(0))
+	assert.NotEmpty(t, replayed)
+	assert.Equal(t, replayed[len(replayed)-1].Seq, lastSeq)
+
+	// the hooks apply to new commands as well
+	recovered.Submit(Command{Type: CommandCancel, OrderId: -1})
+	assert.Equal(t, replayed[len(replayed)-1].Seq, lastSeq+1)
+}
+
+func TestRecoveryCutsOffTornRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := RecoverSequencer(NewOrderbook(), openTestStore(t, dir, 0))
+	assert.Nil(t, err)
+	runWorkload(t, s, 50)
+	want := s.Orderbook().snapshot(DefaultSnapshotTrades)
+	s.Close()
+
+	// a crash in the middle of appending a record
+	journal := filepath.Join(dir, journalFile)
+	record := frameRecord([]byte(`{"Seq":51}`))
+	f, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0)
+	assert.Nil(t, err)
+	f.Write(record[:len(record)-3])
+	f.Close()
+
+	recovered, err := RecoverSequencer(NewOrderbook(), openTestStore(t, dir, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, recovered.Orderbook().snapshot(DefaultSnapshotTrades), want)
+
+	// new records go right after the last good one
+	o := NewOrder(true, amount(1), 1)
+	recovered.Submit(Command{Type: CommandPlaceLimit, Order: o, Price: amount(1)})
+	want = recovered.Orderbook().snapshot(DefaultSnapshotTrades)
+	recovered.Close()
+
+	again, err := RecoverSequencer(NewOrderbook(), openTestStore(t, dir, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, again.Orderbook().snapshot(DefaultSnapshotTrades), want)
+	again.Close()
+}
+
+func TestRecoveryRejectsCorruptJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := RecoverSequencer(NewOrderbook(), openTestStore(t, dir, 0))
+	assert.Nil(t, err)
+	runWorkload(t, s, 20)
+	s.Close()
+
+	journal := filepath.Join(dir, journalFile)
+	data, err := os.ReadFile(journal)
+	assert.Nil(t, err)
+	data[recordHeaderSize+2] ^= 0xff
+	assert.Nil(t, os.WriteFile(journal, data, 0o644))
+
+	_, err = RecoverSequencer(NewOrderbook(), openTestStore(t, dir, 0))
+	assert.True(t, errors.Is(err, ErrJournalCorrupt))
+}
@@ -0,0 +1,130 @@
+package orderbook
+
+const (
+	maxLevelHeight = 24
+	// levelBranching makes one node in four reach the next level up
+	levelBranching = 4
+)
+
+// priceLevels keeps the limits of one side of the book ordered best price
+// first in a skip list, so the best limit is found in O(1) and limits are
+// added and removed in O(log n) without re-sorting the side.
+type priceLevels struct {
+	head   levelNode
+	height int
+	len    int
+	// better reports whether price a comes before price b on this side
+	better func(a, b Amount) bool
+	seed   uint64
+}
+
+type levelNode struct {
+	limit *Limit
+	next  []*levelNode
+}
+
+func newPriceLevels(better func(a, b Amount) bool) *priceLevels {
+	return &priceLevels{
+		head:   levelNode{next: make([]*levelNode, maxLevelHeight)},
+		height: 1,
+		better: better,
+		seed:   0x9e3779b97f4a7c15,
+	}
+}
+
+// newAskLevels orders limits lowest price first.
+func newAskLevels() *priceLevels {
+	return newPriceLevels(func(a, b Amount) bool { return a.LessThan(b) })
+}
+
+// newBidLevels orders limits highest price first.
+func newBidLevels() *priceLevels {
+	return newPriceLevels(func(a, b Amount) bool { return a.GreaterThan(b) })
+}
+
+func (pl *priceLevels) Len() int { return pl.len }
+
+// best returns the limit with the best price, or nil for an empty side.
+func (pl *priceLevels) best() *Limit {
+	if first := pl.head.next[0]; first != nil {
+		return first.limit
+	}
+	return nil
+}
+
+// insert adds a limit whose price is not in the side yet.
+func (pl *priceLevels) insert(l *Limit) {
+	var update [maxLevelHeight]*levelNode
+	node := &pl.head
+	for i := pl.height - 1; i >= 0; i-- {
+		for node.next[i] != nil && pl.better(node.next[i].limit.Price, l.Price) {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+
+	height := pl.randomHeight()
+	for i := pl.height; i < height; i++ {
+		update[i] = &pl.head
+	}
+	if height > pl.height {
+		pl.height = height
+	}
+
+	inserted := &levelNode{limit: l, next: make([]*levelNode, height)}
+	for i := 0; i < height; i++ {
+		inserted.next[i] = update[i].next[i]
+		update[i].next[i] = inserted
+	}
+	pl.len++
+}
+
+// remove takes the limit out of the side and reports whether it was there.
+func (pl *priceLevels) remove(l *Limit) bool {
+	var update [maxLevelHeight]*levelNode
+	node := &pl.head
+	for i := pl.height - 1; i >= 0; i-- {
+		for node.next[i] != nil && pl.better(node.next[i].limit.Price, l.Price) {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+
+	removed := node.next[0]
+	if removed == nil || removed.limit != l {
+		return false
+	}
+	for i := 0; i < len(removed.next); i++ {
+		update[i].next[i] = removed.next[i]
+	}
+	for pl.height > 1 && pl.head.next[pl.height-1] == nil {
+		pl.height--
+	}
+	pl.len--
+	return true
+}
+
+// each calls fn for every limit best price first until fn returns false.
+func (pl *priceLevels) each(fn func(*Limit) bool) {
+	for node := pl.head.next[0]; node != nil; node = node.next[0] {
+		if !fn(node.limit) {
+			return
+		}
+	}
+}
+
+// randomHeight draws a node height from a xorshift generator with a fixed
+// seed, so the shape of the list is the same on every run.
+func (pl *priceLevels) randomHeight() int {
+	height := 1
+	for height < maxLevelHeight {
+		pl.seed ^= pl.seed << 13
+		pl.seed ^= pl.seed >> 7
+		pl.seed ^= pl.seed << 17
+		if pl.seed%levelBranching != 0 {
+			break
+		}
+		height++
+	}
+	return height
+}
@@ -1,172 +1,318 @@
 package orderbook
 
 import (
-	"crypto/rand"
+	"container/list"
+	"errors"
 	"fmt"
-	"math/big"
 	"sort"
 	"sync"
-	"time"
 )
 
 type Match struct {
 	Ask        *Order
 	Bid        *Order
-	Price      float64
-	SizeFilled float64
+	Price      Amount
+	SizeFilled Amount
 }
 
+// TimeInForce decides how long an order stays active in the book.
+type TimeInForce int
+
+const (
+	// GTC (good till cancel) orders rest until they are filled or cancelled.
+	GTC TimeInForce = iota
+	// IOC (immediate or cancel) orders fill what they can right away and
+	// cancel the rest.
+	IOC
+	// FOK (fill or kill) orders are rejected unless the book can fill them
+	// completely right away.
+	FOK
+	// GTD (good till date) orders rest until their ExpiresAt time.
+	GTD
+)
+
+func (t TimeInForce) String() string {
+	switch t {
+	case GTC:
+		return "GTC"
+	case IOC:
+		return "IOC"
+	case FOK:
+		return "FOK"
+	case GTD:
+		return "GTD"
+	}
+	return fmt.Sprintf("TimeInForce(%d)", int(t))
+}
+
+// PostOnly decides what happens to a maker-only limit order that would
+// take liquidity when placed.
+type PostOnly int
+
+const (
+	// PostOnlyOff lets the order take liquidity like any other limit order.
+	PostOnlyOff PostOnly = iota
+	// PostOnlyReject rejects the order with ErrPostOnlyWouldCross.
+	PostOnlyReject
+	// PostOnlySlide reprices the order one tick away from the best opposite
+	// price so it rests as a maker.
+	PostOnlySlide
+)
+
+var (
+	// ErrOrderExpired is returned when a GTD order expires before it is placed.
+	ErrOrderExpired = errors.New("order expired before it could be placed")
+	// ErrPostOnlyWouldCross is returned when a PostOnlyReject order would
+	// cross the spread.
+	ErrPostOnlyWouldCross = errors.New("post-only order would cross the spread")
+	// ErrOrderNotFound is returned when cancelling an order that is not open.
+	ErrOrderNotFound = errors.New("order not found")
+)
+
 type Order struct {
 	Id        int64
 	UserId    int64
-	Size      float64
+	Size      Amount
 	Bid       bool
 	Limit     *Limit
 	TimeStamp int64
+	// elem is the order's place in the queue of its limit
+	elem        *list.Element
+	TimeInForce TimeInForce
+	// ExpiresAt is the unix nano time a GTD order is swept out of the book.
+	ExpiresAt int64
+	PostOnly  PostOnly
+	// DisplaySize makes a resting order an iceberg: only DisplaySize of it
+	// is shown in the book while the rest waits in Hidden, replenishing the
+	// displayed part each time it is filled.
+	DisplaySize Amount
+	Hidden      Amount
+	// SelfTradePrevention decides what happens when the order would trade
+	// with a resting order of the same user
+	SelfTradePrevention SelfTradePrevention
+	// Funds caps the notional a buy order may spend when it takes
+	// liquidity, zero for no cap. What the cap leaves unfilled is handled
+	// like any other unfilled size.
+	Funds Amount
+}
+
+// InsufficientVolumeError is returned when a FOK order can not be filled
+// completely by the volume resting in the book.
+type InsufficientVolumeError struct {
+	Size      Amount
+	Available Amount
+}
+
+func (e *InsufficientVolumeError) Error() string {
+	return fmt.Sprintf("not enough volume to fill the order: size %s, available %s", e.Size, e.Available)
 }
 
 type Orders []*Order
 
 func (o Orders) Len() int           { return len(o) }
-func (o Orders) Less(i, j int) bool { return o[i].TimeStamp < o[j].TimeStamp }
+func (o Orders) Less(i, j int) bool { return o[i].before(o[j]) }
 func (o Orders) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
 
+// Limit is a price level holding its orders in a FIFO queue.
 type Limit struct {
-	Price        float64
-	Orders       Orders
-	TotalVolumne float64
+	Price Amount
+	// TotalVolumne only counts the displayed size of icebergs
+	TotalVolumne Amount
+
+	orders *list.List
 }
 
 type Trade struct {
-	Price     float64
-	Size      float64
+	Price     Amount
+	Size      Amount
 	Bid       bool
 	TimeStamp int64
 }
 
+// Orderbook is safe for concurrent use. Orders handed to it belong to the
+// book from then on: read them back through Order, Asks, Bids and the
+// other accessors, which return snapshots taken under the book's lock. The
+// orders in a Match are the live ones, only their Id, UserId and Bid may be
+// read while the book is in use.
 type Orderbook struct {
-	asks   []*Limit
-	bids   []*Limit
+	// TickSize is the price step post-only orders slide by.
+	TickSize Amount
+	// PriceDecimals and SizeDecimals are the most decimals the market
+	// accepts in prices and sizes.
+	PriceDecimals uint8
+	SizeDecimals  uint8
+	// Clock stamps orders and trades and decides when GTD orders expire,
+	// IDs numbers the orders made with the NewOrder method of the book.
+	Clock Clock
+	IDs   IDGenerator
+
+	// lastId is the highest order id the book has seen
+	lastId int64
+	asks   *priceLevels
+	bids   *priceLevels
 	mu     sync.RWMutex
-	Trades []*Trade
-
-	AskLimits map[float64]*Limit
-	BidLimits map[float64]*Limit
-	Orders    map[int64]*Order
+	trades []*Trade
+
+	// askLimits and bidLimits are the limits by the String of their price
+	askLimits map[string]*Limit
+	bidLimits map[string]*Limit
+	// orders holds the resting orders and the pending stop orders by id
+	orders map[int64]*Order
+
+	// expiries holds the resting GTD orders
+	expiries map[int64]*Order
+
+	// stops holds the pending stop orders, buyStops and sellStops keep them
+	// in the order they trigger in.
+	stops     map[int64]*StopOrder
+	buyStops  []*StopOrder
+	sellStops []*StopOrder
+
+	// selfTrades holds the self trades prevented by the last order placed
+	// or amended
+	selfTrades []SelfTrade
 }
 
-type Limits []*Limit
-type ByBestAsk struct {
-	Limits
-}
+const (
+	DefaultPriceDecimals = 2
+	DefaultSizeDecimals  = 8
+)
 
-func (a ByBestAsk) Len() int           { return len(a.Limits) }
-func (a ByBestAsk) Less(i, j int) bool { return a.Limits[i].Price < a.Limits[j].Price }
-func (a ByBestAsk) Swap(i, j int)      { a.Limits[i], a.Limits[j] = a.Limits[j], a.Limits[i] }
+var (
+	// DefaultTickSize is the tick size of a new orderbook.
+	DefaultTickSize = NewAmount(1, DefaultPriceDecimals)
 
-type ByBestBid struct {
-	Limits
-}
-
-func (b ByBestBid) Len() int           { return len(b.Limits) }
-func (b ByBestBid) Less(i, j int) bool { return b.Limits[i].Price > b.Limits[j].Price }
-func (b ByBestBid) Swap(i, j int)      { b.Limits[i], b.Limits[j] = b.Limits[j], b.Limits[i] }
+	ErrPricePrecision = errors.New("price has more decimals than the market allows")
+	ErrSizePrecision  = errors.New("size has more decimals than the market allows")
+)
 
 // NewOrderbook creates a new orderbook
 func NewOrderbook() *Orderbook {
 	return &Orderbook{
-		asks:      []*Limit{},
-		bids:      []*Limit{},
-		Trades:    []*Trade{},
-		AskLimits: make(map[float64]*Limit),
-		BidLimits: make(map[float64]*Limit),
-		Orders:    make(map[int64]*Order),
+		TickSize:      DefaultTickSize,
+		PriceDecimals: DefaultPriceDecimals,
+		SizeDecimals:  DefaultSizeDecimals,
+		Clock:         SystemClock{},
+		IDs:           NewSequenceIDGenerator(),
+		asks:          newAskLevels(),
+		bids:          newBidLevels(),
+		trades:        []*Trade{},
+		askLimits:     make(map[string]*Limit),
+		bidLimits:     make(map[string]*Limit),
+		orders:        make(map[int64]*Order),
+		expiries:      make(map[int64]*Order),
+		stops:         make(map[int64]*StopOrder),
 	}
 }
 
+// ClearLimit removes an empty limit from its side of the book
 func (ob *Orderbook) ClearLimit(bid bool, l *Limit) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.clearLimit(bid, l)
+}
 
+func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
 	if bid {
-		delete(ob.BidLimits, l.Price)
-		for i := 0; i < len(ob.bids); i++ {
-			if ob.bids[i] == l {
-				ob.bids[i] = ob.bids[len(ob.bids)-1]
-				ob.bids = ob.bids[:len(ob.bids)-1]
-			}
-		}
+		delete(ob.bidLimits, l.Price.String())
+		ob.bids.remove(l)
 	} else {
-		delete(ob.AskLimits, l.Price)
-		for i := 0; i < len(ob.asks); i++ {
-			if ob.asks[i] == l {
-				ob.asks[i] = ob.asks[len(ob.asks)-1]
-				ob.asks = ob.asks[:len(ob.asks)-1]
-			}
-		}
+		delete(ob.askLimits, l.Price.String())
+		ob.asks.remove(l)
 	}
-
-	fmt.Println("Clearing limit %v", l.Price)
-
 }
 
-// NewLimitOrder creates a new limit order
-func NewLimit(price float64) *Limit {
+// NewLimit creates a new, empty price level
+func NewLimit(price Amount) *Limit {
 	return &Limit{
 		Price:  price,
-		Orders: []*Order{},
+		orders: list.New(),
 	}
 }
 
-// NewOrder creates a new order
-func NewOrder(bid bool, size float64, userid int64) *Order {
-	id, _ := rand.Int(rand.Reader, big.NewInt(1000000000000000000))
+// NewOrder creates a new order numbered by a sequence shared by the whole
+// package and stamped with the wall clock
+func NewOrder(bid bool, size Amount, userid int64) *Order {
+	return newOrder(defaultIDs, defaultClock, bid, size, userid)
+}
+
+// NewOrder creates a new order numbered by the IDs of the book and stamped
+// by its Clock
+func (ob *Orderbook) NewOrder(bid bool, size Amount, userid int64) *Order {
+	return newOrder(ob.IDs, ob.Clock, bid, size, userid)
+}
+
+func newOrder(ids IDGenerator, clock Clock, bid bool, size Amount, userid int64) *Order {
 	return &Order{
-		Id:        id.Int64(),
+		Id:        ids.NextID(),
 		UserId:    userid,
 		Size:      size,
 		Bid:       bid,
-		TimeStamp: time.Now().UnixNano(),
+		TimeStamp: clock.Now(),
+	}
+}
+
+// before reports whether o comes before other in time priority. Orders
+// stamped in the same nanosecond go by id.
+func (o *Order) before(other *Order) bool {
+	if o.TimeStamp == other.TimeStamp {
+		return o.Id < other.Id
 	}
+	return o.TimeStamp < other.TimeStamp
 }
 
-// AddOrder adds an order to the limit
+// AddOrder adds an order to the back of the limit's queue
 func (l *Limit) AddOrder(o *Order) {
-	o.Limit = l                    // set the limit of the order
-	l.Orders = append(l.Orders, o) // adding the order to the limit slice
-	l.TotalVolumne += o.Size       // adding the order size to the total volume
+	o.Limit = l                                 // set the limit of the order
+	o.elem = l.orders.PushBack(o)               // queue the order behind the ones already resting
+	l.TotalVolumne = l.TotalVolumne.Add(o.Size) // adding the order size to the total volume
 }
 
+// DeleteOrder removes an order from the limit's queue in O(1)
 func (l *Limit) DeleteOrder(o *Order) {
-	l.TotalVolumne -= o.Size // subtracting the order size from the total volume
-	// Here We are looping throuugh the order slice and the pushing out that order from the slice of Order in Limit
-	for i, order := range l.Orders {
-		if order == o {
-			l.Orders = append(l.Orders[:i], l.Orders[i+1:]...)
-			break
-		}
-	}
+	l.TotalVolumne = l.TotalVolumne.Sub(o.Size) // subtracting the order size from the total volume
+	l.orders.Remove(o.elem)
+	o.elem = nil
 	o.Limit = nil // set the limit of the order to nil
+}
+
+// Orders returns the orders of the limit in time priority
+func (l *Limit) Orders() Orders {
+	orders := make(Orders, 0, l.orders.Len())
+	for e := l.orders.Front(); e != nil; e = e.Next() {
+		orders = append(orders, e.Value.(*Order))
+	}
+	return orders
+}
 
-	/// Sorting the orders in the limit
-	sort.Sort(l.Orders)
+// Len returns the number of orders resting at the limit
+func (l *Limit) Len() int {
+	return l.orders.Len()
 }
 
 func (o *Order) String() string {
-	return fmt.Sprintf("[size] : %2.f", o.Size)
+	return fmt.Sprintf("[size] : %s", o.Size)
 }
 
 func (l *Limit) String() string {
-	return fmt.Sprintf("[price] : %2.f and [total volume] : %2.f", l.Price, l.TotalVolumne)
+	return fmt.Sprintf("[price] : %s and [total volume] : %s", l.Price, l.TotalVolumne)
 }
 
 func (o *Order) IsFilled() bool {
-	return o.Size == 0
+	return o.Size.IsZero() && o.Hidden.IsZero()
+}
+
+// IsIceberg reports whether the order hides part of its size.
+func (o *Order) IsIceberg() bool {
+	return o.DisplaySize.Sign() > 0
 }
 
 func (l *Limit) FillOrder(a, b *Order) Match {
 	var (
 		bid        *Order
 		ask        *Order
-		sizefilled float64
+		sizefilled Amount
 	)
 	if a.Bid {
 		bid = a
@@ -175,14 +321,14 @@ func (l *Limit) FillOrder(a, b *Order) Match {
 		bid = b
 		ask = a
 	}
-	if a.Size > b.Size {
-		a.Size -= b.Size
+	if a.Size.GreaterThan(b.Size) {
+		a.Size = a.Size.Sub(b.Size)
 		sizefilled = b.Size
-		b.Size = 0
+		b.Size = Amount{}
 	} else {
-		b.Size -= a.Size
+		b.Size = b.Size.Sub(a.Size)
 		sizefilled = a.Size
-		a.Size = 0
+		a.Size = Amount{}
 	}
 	return Match{
 		Bid:        bid,
@@ -192,137 +338,565 @@ func (l *Limit) FillOrder(a, b *Order) Match {
 	}
 }
 
+// Fill matches o against the orders of the limit in time priority. An
+// iceberg whose displayed size is used up is replenished from its hidden
+// reserve and goes to the back of the queue, so o can keep filling against
+// it once the orders ahead of the refreshed slice are done. Resting orders
+// of the same user are handled by the SelfTradePrevention mode of o.
 func (l *Limit) Fill(o *Order) []Match {
+	matches, _ := l.fill(o, defaultClock.Now())
+	return matches
+}
+
+// fill is Fill at the unix nano time now, which stamps refreshed icebergs.
+// It also returns the self trades it prevented.
+func (l *Limit) fill(o *Order, now int64) ([]Match, []SelfTrade) {
 	matches := []Match{}
-	var ordersToDelete []*Order
+	selfTrades := []SelfTrade{}
 
-	for _, order := range l.Orders {
-		if o.IsFilled() {
-			break
+	for l.orders.Len() > 0 && !o.IsFilled() {
+		order := l.orders.Front().Value.(*Order)
+		if isSelfTrade(o, order) {
+			selfTrades = append(selfTrades, l.preventSelfTrade(o, order, now)...)
+			continue
 		}
 		match := l.FillOrder(order, o)
 		matches = append(matches, match)
-		l.TotalVolumne -= match.SizeFilled
+		l.TotalVolumne = l.TotalVolumne.Sub(match.SizeFilled)
 
-		if order.IsFilled() {
-			ordersToDelete = append(ordersToDelete, order)
+		if order.Size.Sign() > 0 {
+			continue
+		}
+		if order.Hidden.Sign() > 0 {
+			l.replenish(order, now)
+		} else {
+			l.DeleteOrder(order)
 		}
 	}
 
-	for _, order := range ordersToDelete {
-		l.DeleteOrder(order)
+	return matches, selfTrades
+}
+
+// replenish moves the next slice of an iceberg's hidden reserve into its
+// displayed size. The refreshed slice loses time priority.
+func (l *Limit) replenish(o *Order, now int64) {
+	l.DeleteOrder(o)
+	o.Size = MinAmount(o.DisplaySize, o.Hidden)
+	o.Hidden = o.Hidden.Sub(o.Size)
+	o.TimeStamp = now
+	l.AddOrder(o)
+}
+
+// HiddenVolume returns the size the icebergs of the limit keep out of the book.
+func (l *Limit) HiddenVolume() Amount {
+	hidden := Amount{}
+	for e := l.orders.Front(); e != nil; e = e.Next() {
+		hidden = hidden.Add(e.Value.(*Order).Hidden)
 	}
+	return hidden
+}
 
-	return matches
+// snapshot copies the limit and its orders so they can be read without
+// holding the lock of the book. It returns nil for a nil limit.
+func (l *Limit) snapshot() *Limit {
+	if l == nil {
+		return nil
+	}
+	copied := NewLimit(l.Price)
+	copied.TotalVolumne = l.TotalVolumne
+	for e := l.orders.Front(); e != nil; e = e.Next() {
+		o := *e.Value.(*Order)
+		o.Limit = copied
+		o.elem = copied.orders.PushBack(&o)
+	}
+	return copied
+}
+
+// CancelOrder cancels the resting or pending stop order with the id of o.
+// It returns ErrOrderNotFound when the order is no longer open.
+func (ob *Orderbook) CancelOrder(o *Order) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
 
+	return ob.cancelOrder(o.Id)
 }
 
-// CancelOrder cancels an order
-func (ob *Orderbook) CancelOrder(o *Order) {
+func (ob *Orderbook) cancelOrder(id int64) error {
+	if stop, ok := ob.stops[id]; ok {
+		ob.removeStop(stop)
+		return nil
+	}
+
+	o, ok := ob.orders[id]
+	if !ok {
+		return ErrOrderNotFound
+	}
 	limit := o.Limit
 	limit.DeleteOrder(o)
-	delete(ob.Orders, o.Id)
+	ob.forget(o)
 
-	if len(limit.Orders) == 0 {
-		ob.ClearLimit(o.Bid, limit)
+	if limit.Len() == 0 {
+		ob.clearLimit(o.Bid, limit)
 	}
+	return nil
 }
 
-func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
-	matches := []Match{}
+// observeId keeps the IDs of the book from handing out an id already used
+// by an order placed in the book.
+func (ob *Orderbook) observeId(id int64) {
+	if id > ob.lastId {
+		ob.lastId = id
+	}
+	ob.IDs.Observe(id)
+}
 
-	if o.Bid {
-		if ob.AskTotalVolumne() < o.Size {
-			panic("not enough volume to fill the order")
-		}
-		for _, limit := range ob.Asks() {
-			limitmatches := limit.Fill(o)
-			matches = append(matches, limitmatches...)
+// forget drops an order that left the book from the order indexes.
+func (ob *Orderbook) forget(o *Order) {
+	delete(ob.orders, o.Id)
+	delete(ob.expiries, o.Id)
+}
 
-			if len(limit.Orders) == 0 {
-				ob.ClearLimit(false, limit)
-			}
-		}
-	} else {
-		if ob.BidTotalVolumne() < o.Size {
-			panic("not enough volume to fill the order")
+// ExpireOrders cancels every GTD order that expired at or before now and
+// returns them oldest first. Pass ob.Clock.Now() to expire what is due.
+func (ob *Orderbook) ExpireOrders(now int64) []*Order {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	return ob.expireOrders(now)
+}
+
+// ExpiryDue reports whether a GTD order expired at or before now.
+func (ob *Orderbook) ExpiryDue(now int64) bool {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	for _, o := range ob.expiries {
+		if o.ExpiresAt <= now {
+			return true
 		}
-		for _, limit := range ob.Bids() {
-			limitmatches := limit.Fill(o)
-			matches = append(matches, limitmatches...)
+	}
+	return false
+}
 
-			if len(limit.Orders) == 0 {
-				ob.ClearLimit(true, limit)
-			}
+func (ob *Orderbook) expireOrders(now int64) []*Order {
+	expired := Orders{}
+	for _, o := range ob.expiries {
+		if o.ExpiresAt <= now {
+			expired = append(expired, o)
 		}
 	}
+	sort.Sort(expired)
 
-	for _, match := range matches {
-		ob.Trades = append(ob.Trades, &Trade{
-			Price:     match.Price,
-			Size:      match.SizeFilled,
-			Bid:       match.Bid.Bid,
-			TimeStamp: time.Now().UnixNano(),
-		})
+	for _, o := range expired {
+		ob.cancelOrder(o.Id)
 	}
+	return expired
+}
 
-	return matches
+// PlaceMarketOrder fills the order against the best prices on the opposite
+// side. A FOK order the book can not fill completely is rejected with an
+// *InsufficientVolumeError, any other order takes the available volume and
+// whatever is left unfilled stays in o.Size. An order cancelled by
+// self-trade prevention is left with a zero o.Size. The returned matches include
+// the fills of any stop orders the new trades triggered.
+func (ob *Orderbook) PlaceMarketOrder(o *Order) ([]Match, error) {
+	return ob.placeMarketOrderAt(ob.Clock.Now(), o)
+}
 
+// placeMarketOrderAt is PlaceMarketOrder at the unix nano time now, so a
+// replayed command acts exactly like the original did.
+func (ob *Orderbook) placeMarketOrderAt(now int64, o *Order) ([]Match, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.observeId(o.Id)
+	ob.selfTrades = nil
+	matches, err := ob.placeMarketOrder(now, o)
+	if err != nil {
+		return nil, err
+	}
+	return append(matches, ob.triggerStops(now)...), nil
 }
 
-func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
-	var limit *Limit
+func (ob *Orderbook) placeMarketOrder(now int64, o *Order) ([]Match, error) {
+	if err := ob.checkPrecision(o); err != nil {
+		return nil, err
+	}
+	ob.expireOrders(now)
+
+	crosses := func(*Limit) bool { return true }
+	if err := ob.checkFillOrKill(o, crosses); err != nil {
+		return nil, err
+	}
+
+	matches := ob.match(now, o, crosses)
+	ob.recordTrades(now, matches)
 
+	return matches, nil
+}
+
+// PlaceLimitOrder matches the order against the opposite side of the book
+// for as long as the prices cross. What is left rests at price for GTC and
+// GTD orders and is cancelled for IOC and FOK orders. Post-only orders never
+// match: they are rejected or slid away from the spread instead. The
+// returned matches include the fills of any stop orders the new trades
+// triggered.
+func (ob *Orderbook) PlaceLimitOrder(price Amount, o *Order) ([]Match, error) {
+	return ob.placeLimitOrderAt(ob.Clock.Now(), price, o)
+}
+
+// placeLimitOrderAt is PlaceLimitOrder at the unix nano time now.
+func (ob *Orderbook) placeLimitOrderAt(now int64, price Amount, o *Order) ([]Match, error) {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
+	ob.observeId(o.Id)
+	ob.selfTrades = nil
+	matches, err := ob.placeLimitOrder(now, price, o)
+	if err != nil {
+		return nil, err
+	}
+	return append(matches, ob.triggerStops(now)...), nil
+}
+
+func (ob *Orderbook) placeLimitOrder(now int64, price Amount, o *Order) ([]Match, error) {
+	if err := ob.checkPrecision(o, price); err != nil {
+		return nil, err
+	}
+	if o.TimeInForce == GTD && o.ExpiresAt <= now {
+		return nil, ErrOrderExpired
+	}
+	ob.expireOrders(now)
+
+	if o.PostOnly != PostOnlyOff {
+		makerPrice, err := ob.postOnlyPrice(price, o)
+		if err != nil {
+			return nil, err
+		}
+		price = makerPrice
+	}
+
+	crosses := crossing(price, o.Bid)
+	if err := ob.checkFillOrKill(o, crosses); err != nil {
+		return nil, err
+	}
+
+	matches := ob.match(now, o, crosses)
+	ob.recordTrades(now, matches)
+
+	if o.IsFilled() || o.TimeInForce == IOC || o.TimeInForce == FOK {
+		return matches, nil
+	}
+
+	var limit *Limit
 	if o.Bid {
-		limit = ob.BidLimits[price]
+		limit = ob.bidLimits[price.String()]
 	} else {
-		limit = ob.AskLimits[price]
+		limit = ob.askLimits[price.String()]
 	}
 
 	if limit == nil {
 		limit = NewLimit(price)
 		if o.Bid {
-			ob.bids = append(ob.bids, limit)
-			ob.BidLimits[price] = limit
+			ob.bids.insert(limit)
+			ob.bidLimits[price.String()] = limit
 		} else {
-			ob.asks = append(ob.asks, limit)
-			ob.AskLimits[price] = limit
+			ob.asks.insert(limit)
+			ob.askLimits[price.String()] = limit
 		}
 	}
+	if o.IsIceberg() && o.Size.GreaterThan(o.DisplaySize) {
+		o.Hidden = o.Size.Sub(o.DisplaySize)
+		o.Size = o.DisplaySize
+	}
 	limit.AddOrder(o)
-	ob.Orders[o.Id] = o
+	ob.orders[o.Id] = o
+	if o.TimeInForce == GTD {
+		ob.expiries[o.Id] = o
+	}
+
+	return matches, nil
 }
 
-// Asks returns the asks in the orderbook
-func (ob *Orderbook) Asks() []*Limit {
+// checkPrecision rejects an order whose size or prices have more decimals
+// than the market allows.
+func (ob *Orderbook) checkPrecision(o *Order, prices ...Amount) error {
+	if o.Size.Scale() > ob.SizeDecimals || o.DisplaySize.Scale() > ob.SizeDecimals {
+		return ErrSizePrecision
+	}
+	for _, price := range prices {
+		if price.Scale() > ob.PriceDecimals {
+			return ErrPricePrecision
+		}
+	}
+	return nil
+}
+
+// postOnlyPrice returns the price a post-only order can rest at without
+// taking liquidity.
+func (ob *Orderbook) postOnlyPrice(price Amount, o *Order) (Amount, error) {
+	if o.Bid {
+		bestAsk := ob.asks.best()
+		if bestAsk == nil || price.LessThan(bestAsk.Price) {
+			return price, nil
+		}
+		if o.PostOnly == PostOnlyReject {
+			return Amount{}, ErrPostOnlyWouldCross
+		}
+		// there is no price below a one tick ask to slide to
+		if bestAsk.Price.Cmp(ob.TickSize) <= 0 {
+			return Amount{}, ErrPostOnlyWouldCross
+		}
+		return bestAsk.Price.Sub(ob.TickSize), nil
+	}
 
-	sort.Sort(ByBestAsk{ob.asks})
-	return ob.asks
+	bestBid := ob.bids.best()
+	if bestBid == nil || price.GreaterThan(bestBid.Price) {
+		return price, nil
+	}
+	if o.PostOnly == PostOnlyReject {
+		return Amount{}, ErrPostOnlyWouldCross
+	}
+	return bestBid.Price.Add(ob.TickSize), nil
 }
 
-// Bids returns the bids in the orderbook
-func (ob *Orderbook) Bids() []*Limit {
-	sort.Sort(ByBestBid{ob.bids})
-	return ob.bids
+// crossing reports the opposite limits an order at price is allowed to
+// trade with.
+func crossing(price Amount, bid bool) func(*Limit) bool {
+	if bid {
+		return func(l *Limit) bool { return l.Price.Cmp(price) <= 0 }
+	}
+	return func(l *Limit) bool { return l.Price.Cmp(price) >= 0 }
 }
 
-// BidTotalVolumne returns the total volume of the bids in the orderbook
-func (ob *Orderbook) BidTotalVolumne() float64 {
-	total := 0.0
-	for _, limit := range ob.bids {
-		total += limit.TotalVolumne
+// checkFillOrKill rejects a FOK order when the opposite limits it crosses do
+// not hold enough volume to fill it completely.
+func (ob *Orderbook) checkFillOrKill(o *Order, crosses func(*Limit) bool) error {
+	if o.TimeInForce != FOK {
+		return nil
+	}
+
+	side := ob.asks
+	if !o.Bid {
+		side = ob.bids
+	}
+
+	available := Amount{}
+	side.each(func(limit *Limit) bool {
+		if !crosses(limit) || available.Cmp(o.Size) >= 0 {
+			return false
+		}
+		if o.SelfTradePrevention == SelfTradeAllow {
+			available = available.Add(limit.TotalVolumne).Add(limit.HiddenVolume())
+			return true
+		}
+		// orders of the same user do not count, and most modes stop
+		// matching at the first of them
+		volume, stopped := limit.selfTradeVolume(o)
+		available = available.Add(volume)
+		return !stopped
+	})
+
+	if available.LessThan(o.Size) {
+		return &InsufficientVolumeError{
+			Size:      o.Size,
+			Available: available,
+		}
+	}
+	return nil
+}
+
+// match fills o against the opposite side of the book, best price first,
+// until o is filled or crosses reports a limit that should not be touched.
+func (ob *Orderbook) match(now int64, o *Order, crosses func(*Limit) bool) []Match {
+	matches := []Match{}
+
+	side := ob.asks
+	if !o.Bid {
+		side = ob.bids
+	}
+
+	spent := Amount{}
+	for !o.IsFilled() {
+		limit := side.best()
+		if limit == nil || !crosses(limit) {
+			break
+		}
+
+		// a buy with funds only gets to fill what it can still pay for
+		// at this price
+		unaffordable := Amount{}
+		if o.Bid && o.Funds.Sign() > 0 {
+			affordable := o.Funds.Sub(spent).Div(limit.Price, ob.SizeDecimals)
+			if affordable.IsZero() {
+				break
+			}
+			if affordable.LessThan(o.Size) {
+				unaffordable = o.Size.Sub(affordable)
+				o.Size = affordable
+			}
+		}
+
+		limitmatches, selfTrades := limit.fill(o, now)
+		matches = append(matches, limitmatches...)
+		ob.selfTrades = append(ob.selfTrades, selfTrades...)
+		for _, match := range limitmatches {
+			spent = spent.Add(match.Price.Mul(match.SizeFilled))
+		}
+		if !unaffordable.IsZero() && !cancelled(o, selfTrades) {
+			o.Size = o.Size.Add(unaffordable)
+		}
+
+		for _, selfTrade := range selfTrades {
+			if resting, ok := ob.orders[selfTrade.OrderId]; ok && resting != o && selfTrade.Cancelled {
+				ob.forget(resting)
+			}
+		}
+
+		for _, match := range limitmatches {
+			resting := match.Ask
+			if !o.Bid {
+				resting = match.Bid
+			}
+			if resting.IsFilled() {
+				ob.forget(resting)
+			}
+		}
+
+		if limit.Len() == 0 {
+			ob.clearLimit(!o.Bid, limit)
+		}
+	}
+
+	return matches
+}
+
+// cancelled reports whether self-trade prevention cancelled o.
+func cancelled(o *Order, selfTrades []SelfTrade) bool {
+	for _, selfTrade := range selfTrades {
+		if selfTrade.OrderId == o.Id && selfTrade.Cancelled {
+			return true
+		}
+	}
+	return false
+}
+
+// recordTrades appends a trade for every match to the orderbook's trade history.
+func (ob *Orderbook) recordTrades(now int64, matches []Match) {
+	for _, match := range matches {
+		ob.trades = append(ob.trades, &Trade{
+			Price:     match.Price,
+			Size:      match.SizeFilled,
+			Bid:       match.Bid.Bid,
+			TimeStamp: now,
+		})
 	}
-	return total
 }
 
-// AskTotalVolumne returns the total volume of the asks in the orderbook
-func (ob *Orderbook) AskTotalVolumne() float64 {
-	total := 0.0
-	for _, limit := range ob.asks {
-		total += limit.TotalVolumne
+// Trades returns the trade history of the orderbook, oldest first
+func (ob *Orderbook) Trades() []*Trade {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	trades := make([]*Trade, len(ob.trades))
+	copy(trades, ob.trades)
+	return trades
+}
+
+// Order returns a snapshot of the open order with the given id, resting or
+// waiting in the stop book
+func (ob *Orderbook) Order(id int64) (*Order, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	o, ok := ob.orders[id]
+	if !ok {
+		return nil, false
+	}
+	if o.Limit == nil {
+		snapshot := *o
+		return &snapshot, true
+	}
+	for _, snapshot := range o.Limit.snapshot().Orders() {
+		if snapshot.Id == id {
+			return snapshot, true
+		}
 	}
+	return nil, false
+}
+
+// OrderCount returns the number of open orders, pending stops included
+func (ob *Orderbook) OrderCount() int {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return len(ob.orders)
+}
+
+// Asks returns a snapshot of the asks in the orderbook, lowest price first
+func (ob *Orderbook) Asks() []*Limit {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return snapshotLimits(ob.asks)
+}
+
+// Bids returns a snapshot of the bids in the orderbook, highest price first
+func (ob *Orderbook) Bids() []*Limit {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return snapshotLimits(ob.bids)
+}
+
+// BestAsk returns a snapshot of the lowest ask limit, or nil when there are
+// no asks
+func (ob *Orderbook) BestAsk() *Limit {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.asks.best().snapshot()
+}
+
+// BestBid returns a snapshot of the highest bid limit, or nil when there
+// are no bids
+func (ob *Orderbook) BestBid() *Limit {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.bids.best().snapshot()
+}
+
+// BidTotalVolumne returns the displayed volume of the bids in the orderbook
+func (ob *Orderbook) BidTotalVolumne() Amount {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return totalVolume(ob.bids)
+}
+
+// AskTotalVolumne returns the displayed volume of the asks in the orderbook
+func (ob *Orderbook) AskTotalVolumne() Amount {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return totalVolume(ob.asks)
+}
+
+func totalVolume(side *priceLevels) Amount {
+	total := Amount{}
+	side.each(func(limit *Limit) bool {
+		total = total.Add(limit.TotalVolumne)
+		return true
+	})
 	return total
 }
+
+func snapshotLimits(side *priceLevels) []*Limit {
+	limits := make([]*Limit, 0, side.Len())
+	side.each(func(limit *Limit) bool {
+		limits = append(limits, limit.snapshot())
+		return true
+	})
+	return limits
+}
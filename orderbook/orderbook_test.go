@@ -2,25 +2,27 @@ package orderbook
 
 import (
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestLimit(t *testing.T) {
-	l := NewLimit(10_000)
+	l := NewLimit(amount(10_000))
 
-	ordera := NewOrder(true, 10_000, 1)
-	orderb := NewOrder(true, 10_000, 1)
+	ordera := NewOrder(true, amount(10_000), 1)
+	orderb := NewOrder(true, amount(10_000), 1)
 
 	l.AddOrder(ordera)
 	l.AddOrder(orderb)
 
-	assert.Equal(t, len(l.Orders), 2)
+	assert.Equal(t, l.Len(), 2)
 
 	l.DeleteOrder(ordera)
 
-	assert.Equal(t, len(l.Orders), 1)
+	assert.Equal(t, l.Len(), 1)
 
 }
 
@@ -28,39 +30,40 @@ func TestOrderbook(t *testing.T) {
 
 	ob := NewOrderbook()
 
-	buyorder := NewOrder(true, 10_000, 1)
-	askorder := NewOrder(false, 10_000, 1)
+	buyorder := NewOrder(true, amount(10_000), 1)
+	askorder := NewOrder(false, amount(10_000), 1)
 
-	ob.PlaceLimitOrder(10_000, buyorder)
-	ob.PlaceLimitOrder(10_000, askorder)
+	ob.PlaceLimitOrder(amount(10_000), buyorder)
+	ob.PlaceLimitOrder(amount(10_000), askorder)
 }
 
 func TestPlaceLimitOrder(t *testing.T) {
 	ob := NewOrderbook()
 
-	buyorder := NewOrder(true, 10_000, 1)
-	askorder := NewOrder(false, 10_000, 1)
+	buyorder := NewOrder(true, amount(10_000), 1)
+	askorder := NewOrder(false, amount(10_000), 1)
 
-	ob.PlaceLimitOrder(10_000, buyorder)
-	ob.PlaceLimitOrder(10_000, askorder)
+	ob.PlaceLimitOrder(amount(10_000), buyorder)
+	ob.PlaceLimitOrder(amount(11_000), askorder)
 
-	assert.Equal(t, len(ob.bids), 1)
-	assert.Equal(t, len(ob.asks), 1)
+	assert.Equal(t, ob.bids.Len(), 1)
+	assert.Equal(t, ob.asks.Len(), 1)
 
 }
 
 func TestPlaceMarketOrder(t *testing.T) {
 	ob := NewOrderbook()
 
-	sellorder := NewOrder(false, 20, 1)
-	ob.PlaceLimitOrder(10_000, sellorder)
+	sellorder := NewOrder(false, amount(20), 1)
+	ob.PlaceLimitOrder(amount(10_000), sellorder)
 
-	buyorder := NewOrder(true, 20, 1)
-	matches := ob.PlaceMarketOrder(buyorder)
+	buyorder := NewOrder(true, amount(20), 1)
+	matches, err := ob.PlaceMarketOrder(buyorder)
 
+	assert.Nil(t, err)
 	assert.Equal(t, len(matches), 1)
-	assert.Equal(t, matches[0].SizeFilled, 20.0)
-	assert.Equal(t, matches[0].Price, 10_000.0)
+	assert.Equal(t, matches[0].SizeFilled, amount(20))
+	assert.Equal(t, matches[0].Price, amount(10_000))
 
 	fmt.Println(matches)
 }
@@ -68,17 +71,17 @@ func TestPlaceMarketOrder(t *testing.T) {
 func TestPlaceMarketOrderMultiFill(t *testing.T) {
 	ob := NewOrderbook()
 
-	buyorderA := NewOrder(true, 20, 1)
-	buyorderB := NewOrder(true, 20, 1)
-	buyorderC := NewOrder(true, 20, 1)
-	buyorderD := NewOrder(true, 1, 1)
+	buyorderA := NewOrder(true, amount(20), 1)
+	buyorderB := NewOrder(true, amount(20), 1)
+	buyorderC := NewOrder(true, amount(20), 1)
+	buyorderD := NewOrder(true, amount(1), 1)
 
-	ob.PlaceLimitOrder(10_000, buyorderA)
-	ob.PlaceLimitOrder(10_000, buyorderD)
-	ob.PlaceLimitOrder(9_000, buyorderB)
-	ob.PlaceLimitOrder(5_000, buyorderC)
+	ob.PlaceLimitOrder(amount(10_000), buyorderA)
+	ob.PlaceLimitOrder(amount(10_000), buyorderD)
+	ob.PlaceLimitOrder(amount(9_000), buyorderB)
+	ob.PlaceLimitOrder(amount(5_000), buyorderC)
 
-	assert.Equal(t, ob.BidTotalVolumne(), 61.0)
+	assert.Equal(t, ob.BidTotalVolumne(), amount(61))
 
 	// sellorderA := NewOrder(false, 20)
 	// matches := ob.PlaceMarketOrder(sellorderA)
@@ -86,3 +89,528 @@ func TestPlaceMarketOrderMultiFill(t *testing.T) {
 	// assert.Equal(t, len(matches), 3)
 
 }
+
+func TestPlaceLimitOrderCrossesSpread(t *testing.T) {
+	ob := NewOrderbook()
+
+	askorder := NewOrder(false, amount(10), 1)
+	ob.PlaceLimitOrder(amount(100), askorder)
+
+	buyorder := NewOrder(true, amount(15), 2)
+	matches, err := ob.PlaceLimitOrder(amount(110), buyorder)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, matches[0].SizeFilled, amount(10))
+	assert.Equal(t, matches[0].Price, amount(100))
+	assert.Equal(t, len(ob.Trades()), 1)
+
+	// the ask level is consumed and the rest of the bid rests at 110
+	assert.Equal(t, ob.asks.Len(), 0)
+	assert.Equal(t, ob.bids.Len(), 1)
+	assert.Equal(t, ob.Bids()[0].Price, amount(110))
+	assert.Equal(t, ob.BidTotalVolumne(), amount(5))
+	_, ok := ob.Order(askorder.Id)
+	assert.False(t, ok)
+}
+
+func TestPlaceLimitOrderNoCross(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(amount(100), NewOrder(false, amount(10), 1))
+	matches, err := ob.PlaceLimitOrder(amount(90), NewOrder(true, amount(10), 2))
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 0)
+	assert.Equal(t, ob.asks.Len(), 1)
+	assert.Equal(t, ob.bids.Len(), 1)
+}
+
+func TestPlaceMarketOrderPartialFill(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(amount(10_000), NewOrder(false, amount(5), 1))
+
+	buyorder := NewOrder(true, amount(20), 2)
+	matches, err := ob.PlaceMarketOrder(buyorder)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, matches[0].SizeFilled, amount(5))
+	assert.Equal(t, buyorder.Size, amount(15))
+	assert.Equal(t, ob.asks.Len(), 0)
+	assert.Equal(t, ob.OrderCount(), 0)
+}
+
+func TestPlaceMarketOrderFunds(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(amount(100), NewOrder(false, amount(2), 1))
+	ob.PlaceLimitOrder(amount(200), NewOrder(false, amount(5), 1))
+
+	// 200 buys 2 at 100, the last 100 buys half of one at 200
+	buyorder := NewOrder(true, amount(10), 2)
+	buyorder.Funds = amount(300)
+	matches, err := ob.PlaceMarketOrder(buyorder)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 2)
+	assert.Equal(t, matches[1].SizeFilled, MustParseAmount("0.5"))
+	assert.Equal(t, buyorder.Size, MustParseAmount("7.5"))
+	assert.Equal(t, ob.AskTotalVolumne(), MustParseAmount("4.5"))
+}
+
+func TestPlaceMarketOrderFillOrKill(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellorder := NewOrder(false, amount(5), 1)
+	ob.PlaceLimitOrder(amount(10_000), sellorder)
+
+	buyorder := NewOrder(true, amount(20), 2)
+	buyorder.TimeInForce = FOK
+	matches, err := ob.PlaceMarketOrder(buyorder)
+
+	var volumeErr *InsufficientVolumeError
+	assert.ErrorAs(t, err, &volumeErr)
+	assert.Equal(t, volumeErr.Available, amount(5))
+	assert.Equal(t, len(matches), 0)
+
+	// the book is left untouched
+	assert.Equal(t, ob.AskTotalVolumne(), amount(5))
+	assert.Equal(t, sellorder.Size, amount(5))
+	assert.Equal(t, len(ob.Trades()), 0)
+}
+
+func TestPlaceLimitOrderImmediateOrCancel(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(amount(100), NewOrder(false, amount(5), 1))
+
+	buyorder := NewOrder(true, amount(8), 2)
+	buyorder.TimeInForce = IOC
+	matches, err := ob.PlaceLimitOrder(amount(100), buyorder)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, buyorder.Size, amount(3))
+
+	// the unfilled part is cancelled instead of resting
+	assert.Equal(t, ob.bids.Len(), 0)
+	_, ok := ob.Order(buyorder.Id)
+	assert.False(t, ok)
+}
+
+func TestPlaceLimitOrderFillOrKill(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(amount(100), NewOrder(false, amount(5), 1))
+	ob.PlaceLimitOrder(amount(120), NewOrder(false, amount(5), 1))
+
+	// only the level at 100 crosses, so 8 can not be filled
+	buyorder := NewOrder(true, amount(8), 2)
+	buyorder.TimeInForce = FOK
+	matches, err := ob.PlaceLimitOrder(amount(110), buyorder)
+
+	var volumeErr *InsufficientVolumeError
+	assert.ErrorAs(t, err, &volumeErr)
+	assert.Equal(t, volumeErr.Available, amount(5))
+	assert.Equal(t, len(matches), 0)
+	assert.Equal(t, ob.AskTotalVolumne(), amount(10))
+
+	buyorder = NewOrder(true, amount(8), 2)
+	buyorder.TimeInForce = FOK
+	matches, err = ob.PlaceLimitOrder(amount(120), buyorder)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 2)
+	assert.True(t, buyorder.IsFilled())
+	assert.Equal(t, ob.AskTotalVolumne(), amount(2))
+}
+
+func TestPlaceLimitOrderGoodTillDate(t *testing.T) {
+	ob := NewOrderbook()
+
+	expired := NewOrder(true, amount(5), 1)
+	expired.TimeInForce = GTD
+	expired.ExpiresAt = time.Now().Add(-time.Second).UnixNano()
+	_, err := ob.PlaceLimitOrder(amount(100), expired)
+	assert.ErrorIs(t, err, ErrOrderExpired)
+	assert.Equal(t, ob.bids.Len(), 0)
+
+	order := NewOrder(true, amount(5), 1)
+	order.TimeInForce = GTD
+	order.ExpiresAt = time.Now().Add(time.Hour).UnixNano()
+	_, err = ob.PlaceLimitOrder(amount(100), order)
+	assert.Nil(t, err)
+
+	assert.False(t, ob.ExpiryDue(time.Now().UnixNano()))
+	assert.Equal(t, len(ob.ExpireOrders(time.Now().UnixNano())), 0)
+	assert.Equal(t, ob.BidTotalVolumne(), amount(5))
+
+	assert.True(t, ob.ExpiryDue(order.ExpiresAt))
+	swept := ob.ExpireOrders(order.ExpiresAt)
+	assert.Equal(t, swept, []*Order{order})
+	assert.Nil(t, order.Limit)
+	assert.Equal(t, ob.bids.Len(), 0)
+	assert.Equal(t, ob.OrderCount(), 0)
+}
+
+func TestPlaceLimitOrderPostOnlyReject(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(amount(100), NewOrder(false, amount(5), 1))
+
+	buyorder := NewOrder(true, amount(5), 2)
+	buyorder.PostOnly = PostOnlyReject
+	matches, err := ob.PlaceLimitOrder(amount(100), buyorder)
+
+	assert.ErrorIs(t, err, ErrPostOnlyWouldCross)
+	assert.Equal(t, len(matches), 0)
+	assert.Equal(t, ob.AskTotalVolumne(), amount(5))
+	assert.Equal(t, ob.bids.Len(), 0)
+
+	// below the best ask the order rests as usual
+	buyorder = NewOrder(true, amount(5), 2)
+	buyorder.PostOnly = PostOnlyReject
+	_, err = ob.PlaceLimitOrder(amount(99), buyorder)
+	assert.Nil(t, err)
+	assert.Equal(t, buyorder.Limit.Price, amount(99))
+}
+
+func TestPlaceLimitOrderPostOnlySlide(t *testing.T) {
+	ob := NewOrderbook()
+	ob.TickSize = amount(1)
+
+	ob.PlaceLimitOrder(amount(100), NewOrder(false, amount(5), 1))
+	ob.PlaceLimitOrder(amount(90), NewOrder(true, amount(5), 1))
+
+	buyorder := NewOrder(true, amount(5), 2)
+	buyorder.PostOnly = PostOnlySlide
+	matches, err := ob.PlaceLimitOrder(amount(105), buyorder)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 0)
+	assert.Equal(t, buyorder.Limit.Price, amount(99))
+
+	sellorder := NewOrder(false, amount(5), 2)
+	sellorder.PostOnly = PostOnlySlide
+	_, err = ob.PlaceLimitOrder(amount(80), sellorder)
+
+	assert.Nil(t, err)
+	assert.Equal(t, sellorder.Limit.Price, amount(100))
+	assert.Equal(t, len(ob.Trades()), 0)
+}
+
+func TestStopMarketOrderTriggers(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(amount(100), NewOrder(false, amount(5), 1))
+	ob.PlaceLimitOrder(amount(110), NewOrder(false, amount(5), 1))
+
+	stop := &StopOrder{Order: NewOrder(true, amount(5), 2), StopPrice: amount(100)}
+	matches, err := ob.PlaceStopOrder(stop)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 0)
+	assert.Equal(t, len(ob.Stops()), 1)
+
+	// a trade at 100 reaches the stop, which then buys the level at 110
+	matches, err = ob.PlaceMarketOrder(NewOrder(true, amount(5), 3))
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 2)
+	assert.Equal(t, matches[1].Bid, stop.Order)
+	assert.Equal(t, matches[1].Price, amount(110))
+	assert.Equal(t, len(ob.Stops()), 0)
+	assert.Equal(t, ob.LastPrice(), amount(110))
+}
+
+func TestStopOrdersCascade(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(amount(100), NewOrder(true, amount(1), 1))
+	ob.PlaceLimitOrder(amount(90), NewOrder(true, amount(1), 1))
+	ob.PlaceLimitOrder(amount(80), NewOrder(true, amount(5), 1))
+
+	// the stop at 90 only triggers after the stop at 100 trades at 90
+	second := &StopOrder{Order: NewOrder(false, amount(1), 2), StopPrice: amount(90)}
+	first := &StopOrder{Order: NewOrder(false, amount(1), 2), StopPrice: amount(100)}
+	ob.PlaceStopOrder(second)
+	ob.PlaceStopOrder(first)
+	assert.Equal(t, ob.Stops(), []*StopOrder{first, second})
+
+	matches, err := ob.PlaceMarketOrder(NewOrder(false, amount(1), 3))
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 3)
+	assert.Equal(t, matches[0].Price, amount(100))
+	assert.Equal(t, matches[1].Ask, first.Order)
+	assert.Equal(t, matches[1].Price, amount(90))
+	assert.Equal(t, matches[2].Ask, second.Order)
+	assert.Equal(t, matches[2].Price, amount(80))
+}
+
+func TestStopLimitOrderRests(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(amount(100), NewOrder(false, amount(1), 1))
+	stop := &StopOrder{Order: NewOrder(true, amount(3), 2), StopPrice: amount(100), StopLimit: true, LimitPrice: amount(95)}
+	ob.PlaceStopOrder(stop)
+
+	_, ok := ob.Order(stop.Order.Id)
+	assert.True(t, ok)
+	assert.Nil(t, stop.Order.Limit)
+
+	ob.PlaceMarketOrder(NewOrder(true, amount(1), 3))
+
+	assert.Equal(t, stop.Order.Limit.Price, amount(95))
+	assert.Equal(t, ob.BidTotalVolumne(), amount(3))
+}
+
+func TestCancelStopOrder(t *testing.T) {
+	ob := NewOrderbook()
+
+	stop := &StopOrder{Order: NewOrder(false, amount(1), 2), StopPrice: amount(90)}
+	ob.PlaceStopOrder(stop)
+	ob.CancelOrder(stop.Order)
+
+	assert.Equal(t, len(ob.Stops()), 0)
+	assert.Equal(t, ob.OrderCount(), 0)
+
+	_, err := ob.PlaceStopOrder(&StopOrder{Order: NewOrder(false, amount(1), 2)})
+	assert.ErrorIs(t, err, ErrInvalidStopPrice)
+}
+
+func TestIcebergOrderDisplaysOnlyPeak(t *testing.T) {
+	ob := NewOrderbook()
+
+	iceberg := NewOrder(false, amount(10), 1)
+	iceberg.DisplaySize = amount(2)
+	ob.PlaceLimitOrder(amount(100), iceberg)
+
+	assert.Equal(t, iceberg.Size, amount(2))
+	assert.Equal(t, iceberg.Hidden, amount(8))
+	assert.Equal(t, ob.AskTotalVolumne(), amount(2))
+	assert.Equal(t, ob.Asks()[0].HiddenVolume(), amount(8))
+}
+
+func TestIcebergOrderReplenishesAndLosesPriority(t *testing.T) {
+	ob := NewOrderbook()
+
+	iceberg := NewOrder(false, amount(10), 1)
+	iceberg.DisplaySize = amount(2)
+	ob.PlaceLimitOrder(amount(100), iceberg)
+	plain := NewOrder(false, amount(3), 2)
+	ob.PlaceLimitOrder(amount(100), plain)
+
+	// the peak of the iceberg is taken and refreshed behind the plain order
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, amount(2), 3))
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, matches[0].Ask, iceberg)
+	queue := ob.Asks()[0].Orders()
+	assert.Equal(t, len(queue), 2)
+	assert.Equal(t, queue[0].Id, plain.Id)
+	assert.Equal(t, queue[1].Id, iceberg.Id)
+	assert.Equal(t, iceberg.Size, amount(2))
+	assert.Equal(t, iceberg.Hidden, amount(6))
+	assert.Equal(t, ob.AskTotalVolumne(), amount(5))
+
+	// matching uses the whole quantity, hidden part included
+	buyorder := NewOrder(true, amount(11), 3)
+	buyorder.TimeInForce = FOK
+	matches, err = ob.PlaceMarketOrder(buyorder)
+	assert.Nil(t, err)
+	assert.True(t, buyorder.IsFilled())
+	assert.Equal(t, matches[0].Ask, plain)
+	assert.True(t, iceberg.IsFilled())
+	assert.Equal(t, ob.asks.Len(), 0)
+	assert.Equal(t, ob.OrderCount(), 0)
+}
+
+func TestSnapshotsDoNotShareState(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellorder := NewOrder(false, amount(10), 1)
+	ob.PlaceLimitOrder(amount(100), sellorder)
+	before := ob.BestAsk()
+	resting, ok := ob.Order(sellorder.Id)
+	assert.True(t, ok)
+
+	ob.PlaceMarketOrder(NewOrder(true, amount(4), 2))
+
+	assert.Equal(t, before.TotalVolumne, amount(10))
+	assert.Equal(t, resting.Size, amount(10))
+	assert.Equal(t, resting.Limit.Price, amount(100))
+	resting, _ = ob.Order(sellorder.Id)
+	assert.Equal(t, resting.Size, amount(6))
+
+	assert.Nil(t, ob.CancelOrder(resting))
+	assert.Equal(t, ob.CancelOrder(resting), ErrOrderNotFound)
+	assert.Nil(t, ob.BestAsk())
+}
+
+// TestConcurrentAccess is meant to be run with -race: it places, cancels
+// and reads from many goroutines at once.
+func TestConcurrentAccess(t *testing.T) {
+	ob := NewOrderbook()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				bid := (w+i)%2 == 0
+				price := amount(int64(95 + i%10))
+				o := NewOrder(bid, amount(int64(1+i%3)), int64(w))
+				switch i % 4 {
+				case 0:
+					ob.PlaceMarketOrder(o)
+				case 1:
+					stop := &StopOrder{Order: o, StopPrice: price}
+					ob.PlaceStopOrder(stop)
+					ob.CancelOrder(o)
+				default:
+					ob.PlaceLimitOrder(price, o)
+					if i%3 == 0 {
+						ob.CancelOrder(o)
+					}
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				for _, limit := range append(ob.Asks(), ob.Bids()...) {
+					for _, o := range limit.Orders() {
+						ob.Order(o.Id)
+					}
+				}
+				ob.BestAsk()
+				ob.BestBid()
+				ob.AskTotalVolumne()
+				ob.BidTotalVolumne()
+				ob.Trades()
+				ob.LastPrice()
+				ob.Stops()
+				ob.OrderCount()
+				ob.ExpireOrders(time.Now().UnixNano())
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every open order is still reachable through its limit
+	resting := 0
+	for _, limit := range append(ob.Asks(), ob.Bids()...) {
+		resting += limit.Len()
+	}
+	assert.Equal(t, resting+len(ob.Stops()), ob.OrderCount())
+	if bestAsk, bestBid := ob.BestAsk(), ob.BestBid(); bestAsk != nil && bestBid != nil {
+		assert.True(t, bestBid.Price.LessThan(bestAsk.Price))
+	}
+}
+
+func amount(v int64) Amount {
+	return AmountFromInt(v)
+}
+
+func TestPriceLevelsStaySorted(t *testing.T) {
+	ob := NewOrderbook()
+
+	for _, price := range []int64{105, 101, 110, 99, 103} {
+		ob.PlaceLimitOrder(amount(price+100), NewOrder(false, amount(1), 1))
+		ob.PlaceLimitOrder(amount(price), NewOrder(true, amount(1), 1))
+	}
+
+	bids := []Amount{}
+	for _, limit := range ob.Bids() {
+		bids = append(bids, limit.Price)
+	}
+	assert.Equal(t, bids, []Amount{amount(110), amount(105), amount(103), amount(101), amount(99)})
+	assert.Equal(t, ob.BestAsk().Price, amount(199))
+
+	ob.CancelOrder(ob.BestBid().Orders()[0])
+	assert.Equal(t, ob.BestBid().Price, amount(105))
+	assert.Equal(t, ob.bids.Len(), 4)
+}
+
+func TestLimitCancelKeepsTimePriority(t *testing.T) {
+	l := NewLimit(amount(100))
+
+	orders := []*Order{}
+	for i := 0; i < 4; i++ {
+		o := NewOrder(true, amount(1), 1)
+		l.AddOrder(o)
+		orders = append(orders, o)
+	}
+
+	l.DeleteOrder(orders[1])
+	assert.Equal(t, l.Orders(), Orders{orders[0], orders[2], orders[3]})
+	assert.Equal(t, l.TotalVolumne, amount(3))
+}
+
+// newDeepOrderbook returns a book with levels price levels on each side.
+func newDeepOrderbook(levels int) *Orderbook {
+	ob := NewOrderbook()
+	for i := 0; i < levels; i++ {
+		ob.PlaceLimitOrder(amount(int64(levels+1+i)), NewOrder(false, amount(1), 1))
+		ob.PlaceLimitOrder(amount(int64(levels-i)), NewOrder(true, amount(1), 1))
+	}
+	return ob
+}
+
+func BenchmarkBestBidAsk10kLevels(b *testing.B) {
+	ob := newDeepOrderbook(10_000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if ob.BestBid() == nil || ob.BestAsk() == nil {
+			b.Fatal("empty book")
+		}
+	}
+}
+
+func BenchmarkPlaceCancel10kLevels(b *testing.B) {
+	ob := newDeepOrderbook(10_000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// a new level somewhere in the middle of the bids
+		o := NewOrder(true, amount(1), 2)
+		ob.PlaceLimitOrder(NewAmount(int64(5_000_00+i%1000), 2), o)
+		ob.CancelOrder(o)
+	}
+}
+
+func BenchmarkCancelInDeepQueue(b *testing.B) {
+	ob := NewOrderbook()
+	for i := 0; i < 10_000; i++ {
+		ob.PlaceLimitOrder(amount(100), NewOrder(true, amount(1), 1))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		o := NewOrder(true, amount(1), 2)
+		ob.PlaceLimitOrder(amount(100), o)
+		ob.CancelOrder(o)
+	}
+}
+
+func BenchmarkMarketOrderSweep10kLevels(b *testing.B) {
+	ob := newDeepOrderbook(10_000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ob.PlaceMarketOrder(NewOrder(true, amount(100), 2))
+
+		// put back the 100 levels the sweep took
+		b.StopTimer()
+		for p := int64(10_001); p <= 10_100; p++ {
+			ob.PlaceLimitOrder(amount(p), NewOrder(false, amount(1), 1))
+		}
+		b.StartTimer()
+	}
+}
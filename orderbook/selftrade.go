@@ -0,0 +1,149 @@
+package orderbook
+
+import "fmt"
+
+// SelfTradePrevention decides what happens when an incoming order would
+// trade with a resting order of the same user. The mode of the incoming
+// order applies.
+type SelfTradePrevention int
+
+const (
+	// SelfTradeAllow lets users trade with themselves.
+	SelfTradeAllow SelfTradePrevention = iota
+	// SelfTradeCancelNewest cancels what is left of the incoming order.
+	SelfTradeCancelNewest
+	// SelfTradeCancelOldest cancels the resting order and keeps matching.
+	SelfTradeCancelOldest
+	// SelfTradeCancelBoth cancels the resting order and what is left of the
+	// incoming one.
+	SelfTradeCancelBoth
+	// SelfTradeDecrementAndCancel takes the smaller of the two sizes off
+	// both orders without a trade. The order that drops to zero is
+	// cancelled, the other one carries on.
+	SelfTradeDecrementAndCancel
+)
+
+func (p SelfTradePrevention) String() string {
+	switch p {
+	case SelfTradeAllow:
+		return "ALLOW"
+	case SelfTradeCancelNewest:
+		return "CANCEL_NEWEST"
+	case SelfTradeCancelOldest:
+		return "CANCEL_OLDEST"
+	case SelfTradeCancelBoth:
+		return "CANCEL_BOTH"
+	case SelfTradeDecrementAndCancel:
+		return "DECREMENT_AND_CANCEL"
+	}
+	return fmt.Sprintf("SelfTradePrevention(%d)", int(p))
+}
+
+// SelfTrade is an order, or part of one, taken off the book instead of
+// trading with an order of the same user.
+type SelfTrade struct {
+	OrderId int64
+	UserId  int64
+	// Size is what was taken off the order, hidden iceberg reserve included
+	Size Amount
+	// Cancelled is set when nothing is left of the order. An incoming order
+	// that is cancelled ends up with a zero Size.
+	Cancelled bool
+}
+
+// isSelfTrade reports whether o may not trade with the resting order.
+func isSelfTrade(o, resting *Order) bool {
+	return o.SelfTradePrevention != SelfTradeAllow && o.UserId == resting.UserId
+}
+
+// preventSelfTrade applies the self-trade prevention mode of o to the
+// resting order of the same user at the front of the limit. Resting orders
+// come first in the returned list.
+func (l *Limit) preventSelfTrade(o, resting *Order, now int64) []SelfTrade {
+	switch o.SelfTradePrevention {
+	case SelfTradeCancelOldest:
+		return []SelfTrade{l.cancelResting(resting)}
+	case SelfTradeCancelBoth:
+		return []SelfTrade{l.cancelResting(resting), cancelIncoming(o)}
+	case SelfTradeDecrementAndCancel:
+		return l.decrement(o, resting, now)
+	}
+	return []SelfTrade{cancelIncoming(o)}
+}
+
+func (l *Limit) cancelResting(resting *Order) SelfTrade {
+	size := resting.Size.Add(resting.Hidden)
+	l.DeleteOrder(resting)
+	return SelfTrade{
+		OrderId:   resting.Id,
+		UserId:    resting.UserId,
+		Size:      size,
+		Cancelled: true,
+	}
+}
+
+func cancelIncoming(o *Order) SelfTrade {
+	size := o.Size.Add(o.Hidden)
+	o.Size = Amount{}
+	o.Hidden = Amount{}
+	return SelfTrade{
+		OrderId:   o.Id,
+		UserId:    o.UserId,
+		Size:      size,
+		Cancelled: true,
+	}
+}
+
+// decrement takes the smaller size off both orders. The resting order loses
+// displayed size first, an iceberg whose displayed size is used up is
+// replenished like after a fill.
+func (l *Limit) decrement(o, resting *Order, now int64) []SelfTrade {
+	size := MinAmount(o.Size, resting.Size.Add(resting.Hidden))
+	o.Size = o.Size.Sub(size)
+
+	shown := MinAmount(size, resting.Size)
+	resting.Size = resting.Size.Sub(shown)
+	resting.Hidden = resting.Hidden.Sub(size.Sub(shown))
+	l.TotalVolumne = l.TotalVolumne.Sub(shown)
+
+	restingCancelled := resting.IsFilled()
+	if restingCancelled {
+		l.DeleteOrder(resting)
+	} else if resting.Size.IsZero() {
+		l.replenish(resting, now)
+	}
+
+	return []SelfTrade{
+		{OrderId: resting.Id, UserId: resting.UserId, Size: size, Cancelled: restingCancelled},
+		{OrderId: o.Id, UserId: o.UserId, Size: size, Cancelled: o.IsFilled()},
+	}
+}
+
+// selfTradeVolume returns the volume of the limit an order with self-trade
+// prevention can fill against, and whether matching would stop at the limit
+// because of a resting order of the same user.
+func (l *Limit) selfTradeVolume(o *Order) (Amount, bool) {
+	available := Amount{}
+	for e := l.orders.Front(); e != nil; e = e.Next() {
+		resting := e.Value.(*Order)
+		if !isSelfTrade(o, resting) {
+			available = available.Add(resting.Size).Add(resting.Hidden)
+			continue
+		}
+		if o.SelfTradePrevention != SelfTradeCancelOldest {
+			return available, true
+		}
+	}
+	return available, false
+}
+
+// takeSelfTrades returns the self trades prevented by the last order placed
+// or amended.
+func (ob *Orderbook) takeSelfTrades() []SelfTrade {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	selfTrades := ob.selfTrades
+	ob.selfTrades = nil
+	return selfTrades
+}
@@ -0,0 +1,154 @@
+package orderbook
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// selfTradeBook rests an ask of user 1 at 100 in front of an ask of user 2.
+func selfTradeBook() (*Orderbook, *Order, *Order) {
+	ob := NewOrderbook()
+	own := NewOrder(false, amount(5), 1)
+	other := NewOrder(false, amount(5), 2)
+	ob.PlaceLimitOrder(amount(100), own)
+	ob.PlaceLimitOrder(amount(100), other)
+	return ob, own, other
+}
+
+func TestSelfTradeAllow(t *testing.T) {
+	ob, own, _ := selfTradeBook()
+
+	bid := NewOrder(true, amount(3), 1)
+	matches, err := ob.PlaceMarketOrder(bid)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, matches[0].Ask.Id, own.Id)
+}
+
+func TestSelfTradeCancelNewest(t *testing.T) {
+	ob, own, _ := selfTradeBook()
+
+	bid := NewOrder(true, amount(3), 1)
+	bid.SelfTradePrevention = SelfTradeCancelNewest
+	matches, err := ob.PlaceLimitOrder(amount(100), bid)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 0)
+	assert.True(t, bid.IsFilled())
+	assert.Equal(t, ob.takeSelfTrades(), []SelfTrade{
+		{OrderId: bid.Id, UserId: 1, Size: amount(3), Cancelled: true},
+	})
+
+	// the resting order is untouched and nothing rests on the bid side
+	_, ok := ob.Order(own.Id)
+	assert.True(t, ok)
+	assert.Equal(t, ob.AskTotalVolumne(), amount(10))
+	assert.Equal(t, len(ob.Bids()), 0)
+}
+
+func TestSelfTradeCancelOldest(t *testing.T) {
+	ob, own, other := selfTradeBook()
+
+	bid := NewOrder(true, amount(3), 1)
+	bid.SelfTradePrevention = SelfTradeCancelOldest
+	matches, err := ob.PlaceMarketOrder(bid)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, matches[0].Ask.Id, other.Id)
+	assert.Equal(t, matches[0].SizeFilled, amount(3))
+	assert.Equal(t, ob.takeSelfTrades(), []SelfTrade{
+		{OrderId: own.Id, UserId: 1, Size: amount(5), Cancelled: true},
+	})
+
+	_, ok := ob.Order(own.Id)
+	assert.False(t, ok)
+	assert.Equal(t, ob.AskTotalVolumne(), amount(2))
+}
+
+func TestSelfTradeCancelBoth(t *testing.T) {
+	ob, own, other := selfTradeBook()
+
+	bid := NewOrder(true, amount(3), 1)
+	bid.SelfTradePrevention = SelfTradeCancelBoth
+	matches, err := ob.PlaceLimitOrder(amount(100), bid)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 0)
+	assert.Equal(t, ob.takeSelfTrades(), []SelfTrade{
+		{OrderId: own.Id, UserId: 1, Size: amount(5), Cancelled: true},
+		{OrderId: bid.Id, UserId: 1, Size: amount(3), Cancelled: true},
+	})
+
+	assert.Equal(t, restingIds(ob.BestAsk()), []int64{other.Id})
+	assert.Equal(t, len(ob.Bids()), 0)
+}
+
+func TestSelfTradeDecrementAndCancel(t *testing.T) {
+	ob, own, other := selfTradeBook()
+
+	// the incoming order is the smaller one and is cancelled
+	bid := NewOrder(true, amount(3), 1)
+	bid.SelfTradePrevention = SelfTradeDecrementAndCancel
+	matches, err := ob.PlaceLimitOrder(amount(100), bid)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 0)
+	assert.Equal(t, ob.takeSelfTrades(), []SelfTrade{
+		{OrderId: own.Id, UserId: 1, Size: amount(3), Cancelled: false},
+		{OrderId: bid.Id, UserId: 1, Size: amount(3), Cancelled: true},
+	})
+	resting, ok := ob.Order(own.Id)
+	assert.True(t, ok)
+	assert.Equal(t, resting.Size, amount(2))
+	assert.Equal(t, ob.AskTotalVolumne(), amount(7))
+
+	// the resting order is the smaller one and the rest trades with user 2
+	bid = NewOrder(true, amount(4), 1)
+	bid.SelfTradePrevention = SelfTradeDecrementAndCancel
+	matches, err = ob.PlaceMarketOrder(bid)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, matches[0].Ask.Id, other.Id)
+	assert.Equal(t, matches[0].SizeFilled, amount(2))
+	assert.Equal(t, ob.takeSelfTrades(), []SelfTrade{
+		{OrderId: own.Id, UserId: 1, Size: amount(2), Cancelled: true},
+		{OrderId: bid.Id, UserId: 1, Size: amount(2), Cancelled: false},
+	})
+	_, ok = ob.Order(own.Id)
+	assert.False(t, ok)
+	assert.Equal(t, ob.AskTotalVolumne(), amount(3))
+}
+
+func TestSelfTradeFillOrKillSkipsOwnVolume(t *testing.T) {
+	ob, _, _ := selfTradeBook()
+
+	bid := NewOrder(true, amount(8), 1)
+	bid.TimeInForce = FOK
+	bid.SelfTradePrevention = SelfTradeCancelOldest
+	_, err := ob.PlaceMarketOrder(bid)
+	assert.Equal(t, err, &InsufficientVolumeError{Size: amount(8), Available: amount(5)})
+
+	// the rest of the modes stop at the first order of the same user
+	bid = NewOrder(true, amount(1), 1)
+	bid.TimeInForce = FOK
+	bid.SelfTradePrevention = SelfTradeCancelNewest
+	_, err = ob.PlaceMarketOrder(bid)
+	assert.Equal(t, err, &InsufficientVolumeError{Size: amount(1), Available: Amount{}})
+	assert.Equal(t, ob.AskTotalVolumne(), amount(10))
+}
+
+func TestSequencerReportsSelfTrades(t *testing.T) {
+	s := NewSequencer(NewOrderbook())
+	defer s.Close()
+
+	own := NewOrder(false, amount(5), 1)
+	s.Submit(Command{Type: CommandPlaceLimit, Order: own, Price: amount(100)})
+
+	bid := NewOrder(true, amount(3), 1)
+	bid.SelfTradePrevention = SelfTradeCancelBoth
+	res := s.Submit(Command{Type: CommandPlaceLimit, Order: bid, Price: amount(100)})
+	assert.Nil(t, res.Err)
+	assert.Equal(t, len(res.Matches), 0)
+	assert.Equal(t, eventTypes(res.Events), []EventType{EventAccepted, EventSelfTradePrevented, EventSelfTradePrevented})
+	assert.Equal(t, res.Events[1].OrderId, own.Id)
+	assert.Equal(t, res.Events[2].SelfTrade, SelfTrade{OrderId: bid.Id, UserId: 1, Size: amount(3), Cancelled: true})
+	assert.Equal(t, s.Orderbook().OrderCount(), 0)
+}
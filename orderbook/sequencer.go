@@ -0,0 +1,442 @@
+package orderbook
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrSequencerClosed is returned for commands submitted after Close.
+var ErrSequencerClosed = errors.New("sequencer is closed")
+
+// CommandType is the kind of change a Command makes to the book.
+type CommandType int
+
+const (
+	CommandPlaceLimit CommandType = iota
+	CommandPlaceMarket
+	CommandPlaceStop
+	CommandCancel
+	CommandExpire
+	CommandAmend
+)
+
+func (t CommandType) String() string {
+	switch t {
+	case CommandPlaceLimit:
+		return "PLACE_LIMIT"
+	case CommandPlaceMarket:
+		return "PLACE_MARKET"
+	case CommandPlaceStop:
+		return "PLACE_STOP"
+	case CommandCancel:
+		return "CANCEL"
+	case CommandExpire:
+		return "EXPIRE"
+	case CommandAmend:
+		return "AMEND"
+	}
+	return fmt.Sprintf("CommandType(%d)", int(t))
+}
+
+// Command is a request to change the book, applied by the Sequencer one at
+// a time in the order they are submitted.
+type Command struct {
+	Type CommandType
+	// Order is the order of the place limit and place market commands
+	Order *Order
+	// Price is the limit price of a place limit command and the new price
+	// of an amend command
+	Price Amount
+	// Size is the new size of an amend command
+	Size Amount
+	// Stop is the stop order of a place stop command
+	Stop *StopOrder
+	// OrderId is the order a cancel or an amend command is for
+	OrderId int64
+	// Time is the unix nano time the command is applied at, stamped by the
+	// sequencer from the Clock of the book when left zero. An expire command expires the GTD orders
+	// due by Time.
+	Time int64
+}
+
+// EventType is what happened to an order.
+type EventType int
+
+const (
+	// EventAccepted is emitted when an order is taken by the book.
+	EventAccepted EventType = iota
+	// EventMatched is emitted for every fill, including the fills of
+	// triggered stop orders.
+	EventMatched
+	// EventCancelled is emitted when an open order leaves the book without
+	// being filled: cancelled, expired, or the rest of an IOC, FOK or
+	// market order.
+	EventCancelled
+	// EventRejected is emitted when the book refuses a command.
+	EventRejected
+	// EventAmended is emitted when the price or size of an order changes.
+	EventAmended
+	// EventSelfTradePrevented is emitted for every order that was cancelled
+	// or cut down instead of trading with an order of the same user. It
+	// takes the place of EventCancelled for those orders.
+	EventSelfTradePrevented
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAccepted:
+		return "ACCEPTED"
+	case EventMatched:
+		return "MATCHED"
+	case EventCancelled:
+		return "CANCELLED"
+	case EventRejected:
+		return "REJECTED"
+	case EventAmended:
+		return "AMENDED"
+	case EventSelfTradePrevented:
+		return "SELF_TRADE_PREVENTED"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is one step in the history of a book. Seq increases by one with
+// every event the Sequencer emits, so events can be totally ordered and gaps
+// detected.
+type Event struct {
+	Seq  uint64
+	Type EventType
+	// OrderId is the order the event is about. For EventMatched it is the
+	// order of the command, the orders that traded are in Match.
+	OrderId int64
+	// Match is set for EventMatched
+	Match Match
+	// SelfTrade is set for EventSelfTradePrevented
+	SelfTrade SelfTrade
+	// Err is the reason of an EventRejected
+	Err error
+}
+
+// Result is the outcome of a command.
+type Result struct {
+	Matches []Match
+	Events  []Event
+	Err     error
+}
+
+// Hooks let the owner of a sequencer act on commands in sequence order.
+// They run in the sequencer goroutine, so the book does not change while
+// they run and they may read it, but they must not submit commands.
+type Hooks struct {
+	// Before is called before a command is journaled and applied, it may
+	// change the order of the command. An error rejects the command without
+	// an event.
+	Before func(cmd *Command) error
+	// After is called with the result of every command applied.
+	After func(cmd Command, res Result)
+}
+
+type request struct {
+	cmd   Command
+	reply chan Result
+}
+
+// Sequencer drives an orderbook from a single goroutine. Commands are
+// applied strictly one after another and every change is reported as an
+// Event with the next sequence number, which makes the order of events
+// deterministic for a given order of commands.
+type Sequencer struct {
+	ob *Orderbook
+	// store journals the commands when the sequencer is durable
+	store    *Store
+	seq      uint64
+	requests chan request
+	// subscribe registers a channel that receives every event
+	subscribe   chan chan Event
+	subscribers []chan Event
+	setHooks    chan Hooks
+	hooks       Hooks
+	quit        chan struct{}
+	done        chan struct{}
+}
+
+// NewSequencer starts a sequencer driving ob. The book should only be
+// changed through the sequencer from now on, reads can still go to the book
+// directly.
+func NewSequencer(ob *Orderbook) *Sequencer {
+	s := newSequencer(ob)
+	go s.run()
+	return s
+}
+
+// RecoverSequencer rebuilds the empty book ob from the latest snapshot in
+// st and the commands journaled after it, then starts a sequencer that
+// journals every command to st before applying it. The sequencer owns st
+// and closes it on Close.
+func RecoverSequencer(ob *Orderbook, st *Store) (*Sequencer, error) {
+	return RecoverSequencerWithHooks(ob, st, Hooks{})
+}
+
+// RecoverSequencerWithHooks is RecoverSequencer for a sequencer running
+// hooks. The After hook also sees every command replayed from the journal,
+// right after it is replayed, so an owner whose state may trail the journal
+// can catch up: a crash can come between journaling a command and running
+// After. Before is not run again, what it did happened before the command
+// was journaled. The snapshot is only written once After has run, so the
+// commands After may have missed are always in the journal.
+func RecoverSequencerWithHooks(ob *Orderbook, st *Store, hooks Hooks) (*Sequencer, error) {
+	snap, tail, err := st.load()
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSequencer(ob)
+	if snap != nil {
+		if err := ob.restore(snap); err != nil {
+			return nil, err
+		}
+		s.seq = snap.EventSeq
+	}
+	for _, entry := range tail {
+		res := s.execute(entry.Command)
+		if hooks.After != nil {
+			hooks.After(entry.Command, res)
+		}
+	}
+
+	s.store = st
+	s.hooks = hooks
+	go s.run()
+	return s, nil
+}
+
+func newSequencer(ob *Orderbook) *Sequencer {
+	return &Sequencer{
+		ob:        ob,
+		requests:  make(chan request),
+		subscribe: make(chan chan Event),
+		setHooks:  make(chan Hooks),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Orderbook returns the book driven by the sequencer.
+func (s *Sequencer) Orderbook() *Orderbook {
+	return s.ob
+}
+
+// Submit applies cmd to the book and waits for its result.
+func (s *Sequencer) Submit(cmd Command) Result {
+	req := request{
+		cmd:   cmd,
+		reply: make(chan Result, 1),
+	}
+	select {
+	case s.requests <- req:
+	case <-s.quit:
+		return Result{Err: ErrSequencerClosed}
+	}
+	return <-req.reply
+}
+
+// Subscribe returns a channel receiving every event emitted from now on, in
+// sequence order. The sequencer waits for subscribers once buffer is full,
+// so they have to keep up. The channel is closed by Close.
+func (s *Sequencer) Subscribe(buffer int) <-chan Event {
+	events := make(chan Event, buffer)
+	select {
+	case s.subscribe <- events:
+	case <-s.quit:
+		close(events)
+	}
+	return events
+}
+
+// SetHooks replaces the hooks of the sequencer, they apply from the next
+// command on. Commands replayed by RecoverSequencer do not run hooks, use
+// RecoverSequencerWithHooks for that.
+func (s *Sequencer) SetHooks(hooks Hooks) {
+	select {
+	case s.setHooks <- hooks:
+	case <-s.quit:
+	}
+}
+
+// Close stops the sequencer once the command in progress is done and
+// closes its store.
+func (s *Sequencer) Close() error {
+	select {
+	case <-s.quit:
+		<-s.done
+		return nil
+	default:
+		close(s.quit)
+	}
+	<-s.done
+
+	if s.store != nil {
+		return s.store.Close()
+	}
+	return nil
+}
+
+func (s *Sequencer) run() {
+	defer close(s.done)
+	defer func() {
+		for _, events := range s.subscribers {
+			close(events)
+		}
+	}()
+
+	for {
+		select {
+		case req := <-s.requests:
+			req.reply <- s.apply(req.cmd)
+		case events := <-s.subscribe:
+			s.subscribers = append(s.subscribers, events)
+		case hooks := <-s.setHooks:
+			s.hooks = hooks
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// apply stamps cmd, journals it when the sequencer is durable and executes
+// it. A command that can not be journaled is not applied, neither is one
+// the Before hook rejects. Neither of them emits an event, so replaying the
+// journal gives the same sequence numbers.
+func (s *Sequencer) apply(cmd Command) Result {
+	if cmd.Time == 0 {
+		cmd.Time = s.ob.Clock.Now()
+	}
+	if s.hooks.Before != nil {
+		if err := s.hooks.Before(&cmd); err != nil {
+			return Result{Err: err}
+		}
+	}
+
+	if s.store != nil {
+		if err := s.store.append(cmd); err != nil {
+			return Result{Err: fmt.Errorf("journaling command: %w", err)}
+		}
+	}
+	res := s.execute(cmd)
+	if s.hooks.After != nil {
+		s.hooks.After(cmd, res)
+	}
+
+	// the snapshot drops the journal, so it waits for After to be done
+	// with the command
+	if s.store != nil && s.store.snapshotDue() {
+		snap := s.ob.snapshot(s.store.SnapshotTrades)
+		snap.EventSeq = s.seq
+		s.store.setErr(s.store.writeSnapshot(snap))
+	}
+	return res
+}
+
+// execute applies cmd to the book. Replaying the same commands on the same
+// book gives the same book and the same events.
+func (s *Sequencer) execute(cmd Command) Result {
+	res := Result{}
+
+	switch cmd.Type {
+	case CommandPlaceLimit, CommandPlaceMarket, CommandPlaceStop:
+		// report what expired before the order gets to see the book
+		s.expire(&res, cmd.Time)
+		s.place(&res, cmd)
+
+	case CommandCancel:
+		if err := s.ob.CancelOrder(&Order{Id: cmd.OrderId}); err != nil {
+			res.Err = err
+			s.emit(&res, Event{Type: EventRejected, OrderId: cmd.OrderId, Err: err})
+			break
+		}
+		s.emit(&res, Event{Type: EventCancelled, OrderId: cmd.OrderId})
+
+	case CommandExpire:
+		s.expire(&res, cmd.Time)
+
+	case CommandAmend:
+		s.expire(&res, cmd.Time)
+		matches, err := s.ob.amendOrderAt(cmd.Time, cmd.OrderId, cmd.Price, cmd.Size)
+		if err != nil {
+			res.Err = err
+			s.emit(&res, Event{Type: EventRejected, OrderId: cmd.OrderId, Err: err})
+			break
+		}
+		s.emit(&res, Event{Type: EventAmended, OrderId: cmd.OrderId})
+		for _, match := range matches {
+			s.emit(&res, Event{Type: EventMatched, OrderId: cmd.OrderId, Match: match})
+		}
+		s.selfTrades(&res)
+		res.Matches = matches
+
+	default:
+		res.Err = fmt.Errorf("unknown command %s", cmd.Type)
+	}
+
+	return res
+}
+
+func (s *Sequencer) place(res *Result, cmd Command) {
+	o := cmd.Order
+	if cmd.Type == CommandPlaceStop {
+		o = cmd.Stop.Order
+	}
+
+	var (
+		matches []Match
+		err     error
+	)
+	switch cmd.Type {
+	case CommandPlaceLimit:
+		matches, err = s.ob.placeLimitOrderAt(cmd.Time, cmd.Price, o)
+	case CommandPlaceMarket:
+		matches, err = s.ob.placeMarketOrderAt(cmd.Time, o)
+	case CommandPlaceStop:
+		matches, err = s.ob.placeStopOrderAt(cmd.Time, cmd.Stop)
+	}
+	if err != nil {
+		res.Err = err
+		s.emit(res, Event{Type: EventRejected, OrderId: o.Id, Err: err})
+		return
+	}
+
+	s.emit(res, Event{Type: EventAccepted, OrderId: o.Id})
+	for _, match := range matches {
+		s.emit(res, Event{Type: EventMatched, OrderId: o.Id, Match: match})
+	}
+	s.selfTrades(res)
+	res.Matches = matches
+
+	if _, open := s.ob.Order(o.Id); !open && !o.IsFilled() {
+		s.emit(res, Event{Type: EventCancelled, OrderId: o.Id})
+	}
+}
+
+// selfTrades reports the self trades the command prevented.
+func (s *Sequencer) selfTrades(res *Result) {
+	for _, selfTrade := range s.ob.takeSelfTrades() {
+		s.emit(res, Event{Type: EventSelfTradePrevented, OrderId: selfTrade.OrderId, SelfTrade: selfTrade})
+	}
+}
+
+func (s *Sequencer) expire(res *Result, now int64) {
+	for _, o := range s.ob.ExpireOrders(now) {
+		s.emit(res, Event{Type: EventCancelled, OrderId: o.Id})
+	}
+}
+
+// emit gives e the next sequence number and hands it to the result and the
+// subscribers.
+func (s *Sequencer) emit(res *Result, e Event) {
+	s.seq++
+	e.Seq = s.seq
+	res.Events = append(res.Events, e)
+	for _, events := range s.subscribers {
+		events <- e
+	}
+}
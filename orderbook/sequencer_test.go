@@ -0,0 +1,145 @@
+package orderbook
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func eventTypes(events []Event) []EventType {
+	types := []EventType{}
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestSequencerEvents(t *testing.T) {
+	s := NewSequencer(NewOrderbook())
+	defer s.Close()
+
+	sellorder := NewOrder(false, amount(10), 1)
+	res := s.Submit(Command{Type: CommandPlaceLimit, Order: sellorder, Price: amount(100)})
+	assert.Nil(t, res.Err)
+	assert.Equal(t, eventTypes(res.Events), []EventType{EventAccepted})
+	assert.Equal(t, res.Events[0].Seq, uint64(1))
+
+	// an IOC bid takes what there is and the rest is cancelled
+	buyorder := NewOrder(true, amount(15), 2)
+	buyorder.TimeInForce = IOC
+	res = s.Submit(Command{Type: CommandPlaceLimit, Order: buyorder, Price: amount(100)})
+	assert.Nil(t, res.Err)
+	assert.Equal(t, eventTypes(res.Events), []EventType{EventAccepted, EventMatched, EventCancelled})
+	assert.Equal(t, res.Events[1].Match.Ask, sellorder)
+	assert.Equal(t, res.Events[1].Match.SizeFilled, amount(10))
+	assert.Equal(t, res.Events[2].Seq, uint64(4))
+	assert.Equal(t, len(res.Matches), 1)
+
+	// the book is empty, so a FOK market order is rejected
+	fok := NewOrder(true, amount(1), 2)
+	fok.TimeInForce = FOK
+	res = s.Submit(Command{Type: CommandPlaceMarket, Order: fok})
+	assert.NotNil(t, res.Err)
+	assert.Equal(t, eventTypes(res.Events), []EventType{EventRejected})
+
+	resting := NewOrder(true, amount(1), 2)
+	s.Submit(Command{Type: CommandPlaceLimit, Order: resting, Price: amount(90)})
+	res = s.Submit(Command{Type: CommandCancel, OrderId: resting.Id})
+	assert.Nil(t, res.Err)
+	assert.Equal(t, res.Events[0].Type, EventCancelled)
+	assert.Equal(t, res.Events[0].OrderId, resting.Id)
+
+	res = s.Submit(Command{Type: CommandCancel, OrderId: resting.Id})
+	assert.Equal(t, res.Err, ErrOrderNotFound)
+	assert.Equal(t, res.Events[0].Seq, uint64(8))
+}
+
+func TestSequencerHooks(t *testing.T) {
+	s := NewSequencer(NewOrderbook())
+	defer s.Close()
+
+	errTooBig := errors.New("too big")
+	applied := []CommandType{}
+	s.SetHooks(Hooks{
+		Before: func(cmd *Command) error {
+			if cmd.Order != nil && cmd.Order.Size.GreaterThan(amount(10)) {
+				return errTooBig
+			}
+			if cmd.Order != nil {
+				cmd.Order.DisplaySize = amount(1)
+			}
+			return nil
+		},
+		After: func(cmd Command, res Result) {
+			applied = append(applied, cmd.Type)
+		},
+	})
+
+	res := s.Submit(Command{Type: CommandPlaceLimit, Order: NewOrder(true, amount(11), 1), Price: amount(100)})
+	assert.Equal(t, res.Err, errTooBig)
+	assert.Equal(t, len(res.Events), 0)
+
+	o := NewOrder(true, amount(5), 1)
+	res = s.Submit(Command{Type: CommandPlaceLimit, Order: o, Price: amount(100)})
+	assert.Nil(t, res.Err)
+	assert.Equal(t, res.Events[0].Seq, uint64(1))
+	resting, _ := s.Orderbook().Order(o.Id)
+	assert.Equal(t, resting.Size, amount(1))
+
+	s.Submit(Command{Type: CommandCancel, OrderId: o.Id})
+	assert.Equal(t, applied, []CommandType{CommandPlaceLimit, CommandCancel})
+}
+
+func TestSequencerExpire(t *testing.T) {
+	s := NewSequencer(NewOrderbook())
+	defer s.Close()
+
+	o := NewOrder(true, amount(1), 1)
+	o.TimeInForce = GTD
+	o.ExpiresAt = o.TimeStamp + 1_000_000_000
+	s.Submit(Command{Type: CommandPlaceLimit, Order: o, Price: amount(90)})
+
+	res := s.Submit(Command{Type: CommandExpire, Time: o.ExpiresAt})
+	assert.Equal(t, eventTypes(res.Events), []EventType{EventCancelled})
+	assert.Equal(t, s.Orderbook().OrderCount(), 0)
+}
+
+func TestSequencerOrdersConcurrentCommands(t *testing.T) {
+	s := NewSequencer(NewOrderbook())
+	events := s.Subscribe(10_000)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []Event
+	)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				o := NewOrder((w+i)%2 == 0, amount(1), int64(w))
+				res := s.Submit(Command{Type: CommandPlaceLimit, Order: o, Price: amount(int64(99 + i%3))})
+				mu.Lock()
+				results = append(results, res.Events...)
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	s.Close()
+
+	// subscribers see every event once, without gaps, in sequence order
+	seq := uint64(0)
+	for e := range events {
+		seq++
+		assert.Equal(t, e.Seq, seq)
+	}
+	assert.Equal(t, int(seq), len(results))
+
+	// a closed sequencer refuses commands
+	res := s.Submit(Command{Type: CommandCancel, OrderId: 1})
+	assert.Equal(t, res.Err, ErrSequencerClosed)
+}
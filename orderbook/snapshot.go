@@ -0,0 +1,131 @@
+package orderbook
+
+import "errors"
+
+// ErrBookNotEmpty is returned when restoring a snapshot into a book that
+// already holds orders or trades.
+var ErrBookNotEmpty = errors.New("can only restore a snapshot into an empty orderbook")
+
+// Snapshot is the state of an orderbook at one point of its command
+// history, enough to rebuild the book exactly.
+type Snapshot struct {
+	// Seq is the number of journaled commands the snapshot includes
+	Seq uint64
+	// EventSeq is the sequence number of the last event emitted
+	EventSeq uint64
+	// LastId is the highest order id the book has seen, filled orders
+	// included, so recovered books never hand it out again
+	LastId int64
+	// Asks and Bids hold the limits of each side best price first
+	Asks []*LimitSnapshot
+	Bids []*LimitSnapshot
+	// Stops holds the buy stops then the sell stops, each in the order
+	// they trigger in
+	Stops []*StopOrder
+	// Trades holds the latest trades only, the stops need no more than
+	// the last price
+	Trades []*Trade
+}
+
+// LimitSnapshot is a price level and its orders in time priority.
+type LimitSnapshot struct {
+	Price  Amount
+	Orders []*Order
+}
+
+// snapshot copies the state of the book with its last trades trades.
+func (ob *Orderbook) snapshot(trades int) *Snapshot {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	tail := ob.trades[max(len(ob.trades)-trades, 0):]
+	snap := &Snapshot{
+		LastId: ob.lastId,
+		Asks:   snapshotSide(ob.asks),
+		Bids:   snapshotSide(ob.bids),
+		Stops:  make([]*StopOrder, 0, len(ob.stops)),
+		Trades: make([]*Trade, len(tail)),
+	}
+	for _, side := range [][]*StopOrder{ob.buyStops, ob.sellStops} {
+		for _, stop := range side {
+			copied := *stop
+			copied.Order = copyOrder(stop.Order)
+			snap.Stops = append(snap.Stops, &copied)
+		}
+	}
+	copy(snap.Trades, tail)
+	return snap
+}
+
+func snapshotSide(side *priceLevels) []*LimitSnapshot {
+	limits := make([]*LimitSnapshot, 0, side.Len())
+	side.each(func(l *Limit) bool {
+		limit := &LimitSnapshot{Price: l.Price}
+		for e := l.orders.Front(); e != nil; e = e.Next() {
+			limit.Orders = append(limit.Orders, copyOrder(e.Value.(*Order)))
+		}
+		limits = append(limits, limit)
+		return true
+	})
+	return limits
+}
+
+// copyOrder returns a copy of o detached from its limit.
+func copyOrder(o *Order) *Order {
+	copied := *o
+	copied.Limit = nil
+	copied.elem = nil
+	return &copied
+}
+
+// restore rebuilds an empty book from snap.
+func (ob *Orderbook) restore(snap *Snapshot) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if len(ob.orders) > 0 || len(ob.trades) > 0 {
+		return ErrBookNotEmpty
+	}
+
+	for _, limit := range snap.Asks {
+		ob.restoreLimit(false, limit)
+	}
+	for _, limit := range snap.Bids {
+		ob.restoreLimit(true, limit)
+	}
+	for _, stop := range snap.Stops {
+		o := copyOrder(stop.Order)
+		copied := *stop
+		copied.Order = o
+		ob.stops[o.Id] = &copied
+		ob.orders[o.Id] = o
+		if o.Bid {
+			ob.buyStops = append(ob.buyStops, &copied)
+		} else {
+			ob.sellStops = append(ob.sellStops, &copied)
+		}
+	}
+	ob.trades = append(ob.trades, snap.Trades...)
+	ob.observeId(snap.LastId)
+	return nil
+}
+
+func (ob *Orderbook) restoreLimit(bid bool, snap *LimitSnapshot) {
+	limit := NewLimit(snap.Price)
+	if bid {
+		ob.bids.insert(limit)
+		ob.bidLimits[limit.Price.String()] = limit
+	} else {
+		ob.asks.insert(limit)
+		ob.askLimits[limit.Price.String()] = limit
+	}
+
+	for _, o := range snap.Orders {
+		o = copyOrder(o)
+		limit.AddOrder(o)
+		ob.orders[o.Id] = o
+		if o.TimeInForce == GTD {
+			ob.expiries[o.Id] = o
+		}
+	}
+}
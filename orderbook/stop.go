@@ -0,0 +1,176 @@
+package orderbook
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrInvalidStopPrice is returned for a stop order without a positive
+// stop price.
+var ErrInvalidStopPrice = errors.New("stop orders need a positive stop price")
+
+// StopOrder is a conditional order that waits in the stop book until the
+// last traded price reaches StopPrice: at or above it for a buy stop, at or
+// below it for a sell stop. A triggered stop-market order is placed as a
+// market order, a triggered stop-limit order as a limit order at LimitPrice.
+type StopOrder struct {
+	Order      *Order
+	StopPrice  Amount
+	StopLimit  bool
+	LimitPrice Amount
+}
+
+// LastPrice returns the price of the most recent trade, or zero when the
+// book has not traded yet.
+func (ob *Orderbook) LastPrice() Amount {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.lastPrice()
+}
+
+func (ob *Orderbook) lastPrice() Amount {
+	if len(ob.trades) == 0 {
+		return Amount{}
+	}
+	return ob.trades[len(ob.trades)-1].Price
+}
+
+// PlaceStopOrder adds a stop order to the stop book. A stop that is already
+// triggered by the last traded price is placed right away and its matches,
+// together with those of any stops it triggers in turn, are returned.
+func (ob *Orderbook) PlaceStopOrder(stop *StopOrder) ([]Match, error) {
+	return ob.placeStopOrderAt(ob.Clock.Now(), stop)
+}
+
+// placeStopOrderAt is PlaceStopOrder at the unix nano time now.
+func (ob *Orderbook) placeStopOrderAt(now int64, stop *StopOrder) ([]Match, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.observeId(stop.Order.Id)
+	ob.selfTrades = nil
+	if stop.StopPrice.Sign() <= 0 {
+		return nil, ErrInvalidStopPrice
+	}
+	if err := ob.checkPrecision(stop.Order, stop.StopPrice, stop.LimitPrice); err != nil {
+		return nil, err
+	}
+
+	o := stop.Order
+	ob.stops[o.Id] = stop
+	ob.orders[o.Id] = o
+
+	if o.Bid {
+		ob.buyStops = append(ob.buyStops, stop)
+		sort.SliceStable(ob.buyStops, func(i, j int) bool {
+			return ob.buyStops[i].triggersBefore(ob.buyStops[j])
+		})
+	} else {
+		ob.sellStops = append(ob.sellStops, stop)
+		sort.SliceStable(ob.sellStops, func(i, j int) bool {
+			return ob.sellStops[i].triggersBefore(ob.sellStops[j])
+		})
+	}
+
+	return ob.triggerStops(now), nil
+}
+
+// Stops returns a snapshot of the pending stop orders, buy stops first,
+// each side in the order they trigger in.
+func (ob *Orderbook) Stops() []*StopOrder {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	stops := make([]*StopOrder, 0, len(ob.stops))
+	for _, side := range [][]*StopOrder{ob.buyStops, ob.sellStops} {
+		for _, stop := range side {
+			copied := *stop
+			o := *stop.Order
+			copied.Order = &o
+			stops = append(stops, &copied)
+		}
+	}
+	return stops
+}
+
+// triggersBefore reports whether s is reached before other on the same side:
+// buy stops trigger lowest stop price first, sell stops highest first, and
+// equal stop prices in time priority.
+func (s *StopOrder) triggersBefore(other *StopOrder) bool {
+	if !s.StopPrice.Equal(other.StopPrice) {
+		if s.Order.Bid {
+			return s.StopPrice.LessThan(other.StopPrice)
+		}
+		return s.StopPrice.GreaterThan(other.StopPrice)
+	}
+	return s.Order.before(other.Order)
+}
+
+func (s *StopOrder) triggered(lastPrice Amount) bool {
+	if s.Order.Bid {
+		return lastPrice.Cmp(s.StopPrice) >= 0
+	}
+	return lastPrice.Cmp(s.StopPrice) <= 0
+}
+
+// triggerStops places every stop order reached by the last traded price, one
+// at a time, so the trades of one triggered stop can trigger the next within
+// the same call. When a buy and a sell stop are both triggered the older one
+// goes first. Triggered orders the book rejects (an expired GTD stop-limit or
+// an unfillable FOK) are dropped.
+func (ob *Orderbook) triggerStops(now int64) []Match {
+	matches := []Match{}
+
+	for len(ob.trades) > 0 {
+		lastPrice := ob.lastPrice()
+
+		var next *StopOrder
+		if len(ob.buyStops) > 0 && ob.buyStops[0].triggered(lastPrice) {
+			next = ob.buyStops[0]
+		}
+		if len(ob.sellStops) > 0 && ob.sellStops[0].triggered(lastPrice) {
+			if next == nil || ob.sellStops[0].Order.before(next.Order) {
+				next = ob.sellStops[0]
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		ob.removeStop(next)
+
+		var (
+			stopMatches []Match
+			err         error
+		)
+		if next.StopLimit {
+			stopMatches, err = ob.placeLimitOrder(now, next.LimitPrice, next.Order)
+		} else {
+			stopMatches, err = ob.placeMarketOrder(now, next.Order)
+		}
+		if err != nil {
+			continue
+		}
+		matches = append(matches, stopMatches...)
+	}
+
+	return matches
+}
+
+// removeStop takes a stop order out of the stop book.
+func (ob *Orderbook) removeStop(stop *StopOrder) {
+	delete(ob.stops, stop.Order.Id)
+	delete(ob.orders, stop.Order.Id)
+
+	side := &ob.sellStops
+	if stop.Order.Bid {
+		side = &ob.buyStops
+	}
+	for i, s := range *side {
+		if s == stop {
+			*side = append((*side)[:i], (*side)[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+// MarketState decides which orders a market accepts.
+type MarketState string
+
+const (
+	MarketOpen MarketState = "OPEN"
+	// nothing is placed, amended or cancelled, orders may still expire
+	MarketHalted MarketState = "HALTED"
+	// resting orders can be cancelled, nothing new is placed or amended
+	MarketCancelOnly MarketState = "CANCEL_ONLY"
+	// only post-only limit orders are placed, so nothing trades
+	MarketPostOnly MarketState = "POST_ONLY"
+	// the market is cancelling its orders on the way out
+	MarketDelisted MarketState = "DELISTED"
+)
+
+// ErrMarketExists is returned when creating a market that is already listed.
+var ErrMarketExists = errors.New("market already exists")
+
+type (
+	// MarketResponse is a market's spec and the state it is in.
+	MarketResponse struct {
+		*MarketSpec
+		State MarketState
+	}
+
+	SetMarketStateRequest struct {
+		State MarketState
+	}
+
+	DelistMarketResponse struct {
+		Market    Market
+		Cancelled int
+	}
+)
+
+// CreateMarket lists a new market trading under spec. Unlike AddMarket it
+// never replaces a market that is already listed. The market is kept in
+// memory only, it is gone after a restart and the holds of its orders are
+// released then.
+func (ex *Exchange) CreateMarket(spec *MarketSpec) error {
+	if err := spec.Check(); err != nil {
+		return err
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if _, ok := ex.markets[spec.Market]; ok {
+		return fmt.Errorf("%w: %s", ErrMarketExists, spec.Market)
+	}
+	ex.addMarket(spec)
+	return nil
+}
+
+// state returns the state market is in. Markets are open unless told
+// otherwise.
+func (ex *Exchange) state(market Market) MarketState {
+	ex.statesMu.RLock()
+	defer ex.statesMu.RUnlock()
+
+	if state, ok := ex.states[market]; ok {
+		return state
+	}
+	return MarketOpen
+}
+
+// SetMarketState puts market into state. Setting MarketOpen resumes a
+// halted market.
+func (ex *Exchange) SetMarketState(market Market, state MarketState) error {
+	switch state {
+	case MarketOpen, MarketHalted, MarketCancelOnly, MarketPostOnly:
+	default:
+		return fmt.Errorf("unknown market state %q", state)
+	}
+	if _, ok := ex.market(market); !ok {
+		return newOrderError(ErrCodeUnknownMarket, "market %q not found", market)
+	}
+
+	ex.statesMu.Lock()
+	defer ex.statesMu.Unlock()
+
+	if ex.states[market] == MarketDelisted {
+		return newOrderError(ErrCodeMarketDelisted, "market %s is being delisted", market)
+	}
+	ex.states[market] = state
+	return nil
+}
+
+// haltMarket halts market after its book and the ledger went apart, e.g. a
+// fill could not be settled. It runs in the sequencer of the market. The
+// market stays halted until an admin resumes it.
+func (ex *Exchange) haltMarket(market Market, reason error) {
+	fmt.Printf("halting market %s: %s\n", market, reason)
+
+	ex.statesMu.Lock()
+	defer ex.statesMu.Unlock()
+
+	if ex.states[market] != MarketDelisted {
+		ex.states[market] = MarketHalted
+	}
+}
+
+// checkState rejects the commands the state of market does not allow. It
+// runs in the sequencer of the market, so once a state is set every later
+// command honours it.
+func (ex *Exchange) checkState(market Market, cmd *orderbook.Command) error {
+	state := ex.state(market)
+
+	switch cmd.Type {
+	case orderbook.CommandExpire:
+		return nil
+	case orderbook.CommandCancel:
+		if state == MarketHalted {
+			return newOrderError(ErrCodeMarketHalted, "market %s is halted", market)
+		}
+		return nil
+	}
+
+	switch state {
+	case MarketHalted:
+		return newOrderError(ErrCodeMarketHalted, "market %s is halted", market)
+	case MarketCancelOnly:
+		return newOrderError(ErrCodeMarketCancelOnly, "market %s only accepts cancels", market)
+	case MarketDelisted:
+		return newOrderError(ErrCodeMarketDelisted, "market %s is being delisted", market)
+	case MarketPostOnly:
+		// amends that keep the price can not cross
+		postOnly := cmd.Type == orderbook.CommandPlaceLimit && cmd.Order.PostOnly != orderbook.PostOnlyOff ||
+			cmd.Type == orderbook.CommandAmend && cmd.Price.IsZero()
+		if !postOnly {
+			return newOrderError(ErrCodeMarketPostOnly, "market %s only accepts post-only limit orders", market)
+		}
+	}
+	return nil
+}
+
+// DelistMarket stops trading in market for good. It cancels every resting
+// and stop order, which releases their holds, closes the sequencer of the
+// market and returns how many orders were cancelled. Markets listed or
+// delisted at runtime are not remembered across restarts.
+func (ex *Exchange) DelistMarket(market Market) (int, error) {
+	ob, ok := ex.orderbook(market)
+	if !ok {
+		return 0, newOrderError(ErrCodeUnknownMarket, "market %q not found", market)
+	}
+	ex.statesMu.Lock()
+	ex.states[market] = MarketDelisted
+	ex.statesMu.Unlock()
+
+	// commands admitted before the state changed are applied before this
+	// one, after it the book only shrinks
+	if res := ex.submit(market, orderbook.Command{Type: orderbook.CommandExpire}); res.Err != nil {
+		return 0, res.Err
+	}
+
+	ids := []int64{}
+	for _, limit := range append(ob.Asks(), ob.Bids()...) {
+		for _, order := range limit.Orders() {
+			ids = append(ids, order.Id)
+		}
+	}
+	for _, stop := range ob.Stops() {
+		ids = append(ids, stop.Order.Id)
+	}
+	cancelled := 0
+	for _, id := range ids {
+		res := ex.submit(market, orderbook.Command{Type: orderbook.CommandCancel, OrderId: id})
+		if errors.Is(res.Err, orderbook.ErrOrderNotFound) {
+			// expired in the meantime
+			continue
+		}
+		if res.Err != nil {
+			return cancelled, fmt.Errorf("cancelling order %d: %w", id, res.Err)
+		}
+		cancelled++
+	}
+
+	ex.mu.Lock()
+	seq, ok := ex.sequencers[market]
+	if !ok {
+		// delisted by someone else
+		ex.mu.Unlock()
+		return cancelled, nil
+	}
+	delete(ex.sequencers, market)
+	delete(ex.orderbooks, market)
+	delete(ex.markets, market)
+	ex.mu.Unlock()
+
+	ex.statesMu.Lock()
+	delete(ex.states, market)
+	ex.statesMu.Unlock()
+
+	ex.pruneClosedOrders()
+	if err := seq.Close(); err != nil {
+		return cancelled, err
+	}
+	// the market may be listed again, its events numbered from the start
+	return cancelled, ex.ledger.CloseMarket(market)
+}
+
+// requireAdmin lets only requests bearing the admin token through. The
+// admin API is off when the exchange has no token.
+func (ex *Exchange) requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if ex.AdminToken == "" {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "admin API is disabled"})
+		}
+		token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(ex.AdminToken)) != 1 {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid admin token"})
+		}
+		return next(c)
+	}
+}
+
+func (ex *Exchange) handleCreateMarket(c echo.Context) error {
+	spec := &MarketSpec{}
+	if err := json.NewDecoder(c.Request().Body).Decode(spec); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	if err := ex.CreateMarket(spec); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrMarketExists) {
+			status = http.StatusConflict
+		}
+		return c.JSON(status, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, &MarketResponse{MarketSpec: spec, State: ex.state(spec.Market)})
+}
+
+func (ex *Exchange) handleSetMarketState(c echo.Context) error {
+	market := Market(c.Param("market"))
+	var req SetMarketStateRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	if err := ex.SetMarketState(market, req.State); err != nil {
+		status := http.StatusBadRequest
+		if errorCode(err) == ErrCodeUnknownMarket {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{"error": err.Error()})
+	}
+	spec, _ := ex.market(market)
+	return c.JSON(http.StatusOK, &MarketResponse{MarketSpec: spec, State: ex.state(market)})
+}
+
+func (ex *Exchange) handleDelistMarket(c echo.Context) error {
+	market := Market(c.Param("market"))
+	cancelled, err := ex.DelistMarket(market)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errorCode(err) == ErrCodeUnknownMarket {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, &DelistMarketResponse{Market: market, Cancelled: cancelled})
+}
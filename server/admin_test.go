@@ -0,0 +1,130 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarketStates(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1)
+	ob, _ := ex.orderbook(MarketETHUSDC)
+	price := orderbook.AmountFromInt(100)
+
+	resting := ob.NewOrder(false, orderbook.AmountFromInt(1), 1)
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, price, resting)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ex.SetMarketState(MarketETHUSDC, MarketHalted))
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, price, ob.NewOrder(false, orderbook.AmountFromInt(1), 1))
+	assert.Equal(t, errorCode(err), ErrCodeMarketHalted)
+	res := ex.submit(MarketETHUSDC, orderbook.Command{Type: orderbook.CommandCancel, OrderId: resting.Id})
+	assert.Equal(t, errorCode(res.Err), ErrCodeMarketHalted)
+
+	assert.Nil(t, ex.SetMarketState(MarketETHUSDC, MarketPostOnly))
+	_, _, err = ex.handlePlaceMarketOrder(MarketETHUSDC, ob.NewOrder(true, orderbook.AmountFromInt(1), 1))
+	assert.Equal(t, errorCode(err), ErrCodeMarketPostOnly)
+	bid := ob.NewOrder(true, orderbook.AmountFromInt(1), 1)
+	bid.PostOnly = orderbook.PostOnlyReject
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(90), bid)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ex.SetMarketState(MarketETHUSDC, MarketCancelOnly))
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, price, ob.NewOrder(false, orderbook.AmountFromInt(1), 1))
+	assert.Equal(t, errorCode(err), ErrCodeMarketCancelOnly)
+	res = ex.submit(MarketETHUSDC, orderbook.Command{Type: orderbook.CommandCancel, OrderId: bid.Id})
+	assert.Nil(t, res.Err)
+
+	// other markets are not affected
+	assert.Equal(t, ex.state(MarketWBTCETH), MarketOpen)
+
+	assert.Nil(t, ex.SetMarketState(MarketETHUSDC, MarketOpen))
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, price, ob.NewOrder(false, orderbook.AmountFromInt(1), 1))
+	assert.Nil(t, err)
+
+	assert.NotNil(t, ex.SetMarketState(MarketETHUSDC, "CLOSED"))
+	assert.Equal(t, errorCode(ex.SetMarketState("DOGE-USDC", MarketHalted)), ErrCodeUnknownMarket)
+}
+
+func TestDelistMarketReleasesHolds(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1, 2)
+	ob, _ := ex.orderbook(MarketETHUSDC)
+
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(false, orderbook.AmountFromInt(2), 1))
+	assert.Nil(t, err)
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(90), ob.NewOrder(true, orderbook.AmountFromInt(3), 2))
+	assert.Nil(t, err)
+	_, err = ex.handlePlaceStopOrder(MarketETHUSDC, &orderbook.StopOrder{
+		Order:     ob.NewOrder(true, orderbook.AmountFromInt(1), 2),
+		StopPrice: orderbook.AmountFromInt(120),
+	})
+	assert.Nil(t, err)
+
+	cancelled, err := ex.DelistMarket(MarketETHUSDC)
+	assert.Nil(t, err)
+	assert.Equal(t, cancelled, 3)
+	assert.Equal(t, ob.OrderCount(), 0)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("10", "0"))
+	assertBalance(t, ex.ledger, 2, AssetUSDC, balance("10000", "0"))
+	assertBalanced(t, ex.ledger)
+	assert.Equal(t, len(ex.Orders[1])+len(ex.Orders[2]), 0)
+
+	_, ok := ex.market(MarketETHUSDC)
+	assert.False(t, ok)
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), orderbook.NewOrder(false, orderbook.AmountFromInt(1), 1))
+	assert.Equal(t, errorCode(err), ErrCodeUnknownMarket)
+}
+
+func TestAdminAPI(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+
+	e := echo.New()
+	admin := e.Group("/admin", ex.requireAdmin)
+	admin.POST("/markets", ex.handleCreateMarket)
+	admin.PUT("/markets/:market/state", ex.handleSetMarketState)
+	admin.DELETE("/markets/:market", ex.handleDelistMarket)
+
+	request := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	spec := `{"Market": "WBTC-USDC", "Base": {"Asset": "WBTC", "Decimals": 8}, "Quote": {"Asset": "USDC", "Decimals": 6}, "TickSize": "1", "LotSize": "0.0001"}`
+
+	// without a token the admin API is off
+	assert.Equal(t, request(http.MethodPost, "/admin/markets", "", spec).Code, http.StatusForbidden)
+
+	ex.AdminToken = "secret"
+	assert.Equal(t, request(http.MethodPost, "/admin/markets", "", spec).Code, http.StatusUnauthorized)
+	assert.Equal(t, request(http.MethodPost, "/admin/markets", "guess", spec).Code, http.StatusUnauthorized)
+
+	assert.Equal(t, request(http.MethodPost, "/admin/markets", "secret", spec).Code, http.StatusOK)
+	_, ok := ex.orderbook("WBTC-USDC")
+	assert.True(t, ok)
+	assert.Equal(t, request(http.MethodPost, "/admin/markets", "secret", spec).Code, http.StatusConflict)
+
+	rec := request(http.MethodPut, "/admin/markets/WBTC-USDC/state", "secret", `{"State": "HALTED"}`)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Contains(t, rec.Body.String(), `"State":"HALTED"`)
+	assert.Equal(t, request(http.MethodPut, "/admin/markets/DOGE-USDC/state", "secret", `{"State": "HALTED"}`).Code, http.StatusNotFound)
+
+	rec = request(http.MethodDelete, "/admin/markets/WBTC-USDC", "secret", "")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Contains(t, rec.Body.String(), `"Cancelled":0`)
+	_, ok = ex.orderbook("WBTC-USDC")
+	assert.False(t, ok)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func amendOrder(t *testing.T, ex *Exchange, id int64, body string) *httptest.ResponseRecorder {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("orderID")
+	c.SetParamValues(strconv.FormatInt(id, 10))
+	assert.Nil(t, ex.handleAmendOrder(c))
+	return rec
+}
+
+func TestHandleAmendOrder(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1, 2)
+	ob, _ := ex.orderbook(MarketETHUSDC)
+
+	first := ob.NewOrder(true, orderbook.AmountFromInt(2), 1)
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), first)
+	assert.Nil(t, err)
+	second := ob.NewOrder(true, orderbook.AmountFromInt(2), 2)
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), second)
+	assert.Nil(t, err)
+
+	// a smaller size keeps the place in the queue
+	rec := amendOrder(t, ex, first.Id, `{"Size": "1.5"}`)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	resp := &AmendOrderResponse{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), resp))
+	assert.True(t, resp.Open)
+	assert.Equal(t, resp.Size, orderbook.MustParseAmount("1.5"))
+	assert.Equal(t, resp.Price, orderbook.AmountFromInt(100))
+	assert.Equal(t, ob.BestBid().Orders()[0].Id, first.Id)
+
+	// a new price moves it
+	rec = amendOrder(t, ex, first.Id, `{"Price": "99.5"}`)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, len(ob.Bids()), 2)
+	assert.Equal(t, len(ex.Orders[1]), 1)
+
+	// prices are checked against the market
+	rec = amendOrder(t, ex, first.Id, `{"Price": "99.555"}`)
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+	rejected := &OrderRejectedResponse{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), rejected))
+	assert.Equal(t, rejected.Code, ErrCodeInvalidTickSize)
+
+	rec = amendOrder(t, ex, 424242, `{"Size": "1"}`)
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), rejected))
+	assert.Equal(t, rejected.Code, ErrCodeOrderNotFound)
+}
+
+func TestRejectedAmendReleasesTheHoldItGrew(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1, 2)
+	ob, _ := ex.orderbook(MarketETHUSDC)
+
+	ask := ob.NewOrder(false, orderbook.AmountFromInt(1), 2)
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(101), ask)
+	assert.Nil(t, err)
+	bid := ob.NewOrder(true, orderbook.AmountFromInt(1), 1)
+	bid.PostOnly = orderbook.PostOnlyReject
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), bid)
+	assert.Nil(t, err)
+	assertBalance(t, ex.ledger, 1, AssetUSDC, balance("9900", "100"))
+
+	// the hold grows before the book sees the amend would cross the ask
+	rec := amendOrder(t, ex, bid.Id, `{"Price": "101", "Size": "2"}`)
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+	assert.Equal(t, ex.ledger.Held(bid.Id), orderbook.AmountFromInt(100))
+	assertBalance(t, ex.ledger, 1, AssetUSDC, balance("9900", "100"))
+	assertBalanced(t, ex.ledger)
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+)
+
+// ChainBackend is what the exchange needs of an ethereum node to send
+// transfers, read balances and follow receipts. *ethclient.Client and
+// SimulatedChain implement it. An exchange without one, a nil
+// ChainBackend, keeps balances in its ledger only.
+type ChainBackend interface {
+	bind.ContractBackend
+	ethereum.ChainReader
+	ethereum.ChainStateReader
+	ethereum.TransactionReader
+	ethereum.ChainIDReader
+}
+
+// ChainMode selects the ChainBackend of the exchange.
+type ChainMode string
+
+const (
+	// ChainRPC talks to a node over RPC, the default
+	ChainRPC ChainMode = "rpc"
+	// ChainSimulated runs an in-memory chain in the process
+	ChainSimulated ChainMode = "simulated"
+	// ChainNone settles nothing on chain, balances only live in the ledger
+	ChainNone ChainMode = "none"
+
+	defaultRPCURL = "http://localhost:8545"
+	// rpcDialTimeout is how long the node has to answer when dialed
+	rpcDialTimeout = 5 * time.Second
+)
+
+type ChainConfig struct {
+	Mode ChainMode // ChainRPC when empty
+	// URL is the node of ChainRPC, defaultRPCURL when empty
+	URL string
+	// Alloc are the genesis accounts of ChainSimulated
+	Alloc types.GenesisAlloc
+}
+
+// NewChainBackend opens the chain of cfg. It returns nil for ChainNone.
+func NewChainBackend(cfg ChainConfig) (ChainBackend, error) {
+	switch cfg.Mode {
+	case ChainRPC, "":
+		url := cfg.URL
+		if url == "" {
+			url = defaultRPCURL
+		}
+		client, err := ethclient.Dial(url)
+		if err != nil {
+			return nil, err
+		}
+		// dialing HTTP connects lazily, asking for the chain ID fails now
+		// when no node is listening
+		ctx, cancel := context.WithTimeout(context.Background(), rpcDialTimeout)
+		defer cancel()
+		if _, err := client.ChainID(ctx); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("connecting to the node at %s: %w", url, err)
+		}
+		return client, nil
+
+	case ChainSimulated:
+		return NewSimulatedChain(cfg.Alloc), nil
+
+	case ChainNone:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown chain mode %q", cfg.Mode)
+}
+
+// SimulatedChain is an in-memory chain on go-ethereum's simulated backend.
+// Transactions are mined when Commit is called, Run commits on a timer.
+type SimulatedChain struct {
+	simulated.Client
+	backend *simulated.Backend
+}
+
+func NewSimulatedChain(alloc types.GenesisAlloc) *SimulatedChain {
+	backend := simulated.NewBackend(alloc)
+	return &SimulatedChain{Client: backend.Client(), backend: backend}
+}
+
+// Commit mines a block of the pending transactions and returns its hash.
+func (c *SimulatedChain) Commit() common.Hash {
+	return c.backend.Commit()
+}
+
+// Run mines a block on each tick of interval.
+func (c *SimulatedChain) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		<-ticker.C
+
+		c.Commit()
+	}
+}
+
+func (c *SimulatedChain) Close() error {
+	return c.backend.Close()
+}
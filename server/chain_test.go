@@ -0,0 +1,71 @@
+package server
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewChainBackend(t *testing.T) {
+	client, err := NewChainBackend(ChainConfig{Mode: ChainNone})
+	assert.Nil(t, err)
+	assert.Nil(t, client)
+
+	_, err = NewChainBackend(ChainConfig{Mode: "mainnet"})
+	assert.NotNil(t, err)
+
+	// nothing listens there
+	_, err = NewChainBackend(ChainConfig{Mode: ChainRPC, URL: "http://127.0.0.1:1"})
+	assert.NotNil(t, err)
+}
+
+func TestExchangeOnSimulatedChain(t *testing.T) {
+	senderKey, sender := newKey(t)
+	client, err := NewChainBackend(ChainConfig{
+		Mode:  ChainSimulated,
+		Alloc: types.GenesisAlloc{sender: {Balance: big.NewInt(1e18)}},
+	})
+	assert.Nil(t, err)
+	chain := client.(*SimulatedChain)
+	defer chain.Close()
+
+	ex := NewExchange("", chain)
+	defer ex.Close()
+	ex.AddUser(&User{Id: 1})
+	deposits := NewDepositWatcher(ex, 1)
+
+	assert.Nil(t, TransferETH(ex.nonces, senderKey, ex.DepositAddress(1).Hex(), orderbook.MustParseAmount("0.5")))
+	chain.Commit()
+	assert.Nil(t, deposits.Poll())
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("0.5", "0"))
+
+	chainID, err := ex.nonces.ChainID()
+	assert.Nil(t, err)
+	assert.Equal(t, chainID.Int64(), int64(1337))
+}
+
+func TestExchangeWithoutChain(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1, 2)
+
+	// trading works on the ledger alone, moving funds on chain does not
+	ob, _ := ex.orderbook(MarketETHUSDC)
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(false, orderbook.AmountFromInt(1), 1))
+	assert.Nil(t, err)
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(true, orderbook.AmountFromInt(1), 2))
+	assert.Nil(t, err)
+	assertBalance(t, ex.ledger, 2, AssetETH, balance("11", "0"))
+
+	_, err = NewWithdrawalQueue(ex, 1).Request(&WithdrawalRequest{UserId: 1, Asset: AssetETH, Amount: orderbook.AmountFromInt(1)})
+	assert.ErrorIs(t, err, ErrNoChain)
+	_, err = NewReconciler(ex, NewDepositWatcher(ex, 1), NewWithdrawalQueue(ex, 1)).Reconcile()
+	assert.ErrorIs(t, err, ErrNoChain)
+	_, err = ex.nonces.Send(ex.PrivateKey, common.HexToAddress(exchangeAddress), big.NewInt(1), nil, 21000)
+	assert.ErrorIs(t, err, ErrNoChain)
+	assert.ErrorIs(t, ex.RegisterToken(USDC, testTokenAddress), ErrNoChain)
+}
@@ -0,0 +1,475 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// reorgWindow is how many blocks beyond the confirmation depth the
+	// deposit watcher remembers, a reorg deeper than that can not be
+	// followed.
+	reorgWindow = 128
+
+	depositsStateFile = "deposits"
+)
+
+type DepositStatus string
+
+const (
+	// DepositPending deposits are seen on chain but not yet confirmed, a
+	// reorg may still drop them
+	DepositPending  DepositStatus = "PENDING"
+	DepositCredited DepositStatus = "CREDITED"
+	// DepositUnprocessable deposits have an amount the ledger can not
+	// represent, they are never credited and need an admin to refund them
+	DepositUnprocessable DepositStatus = "UNPROCESSABLE"
+)
+
+type (
+	// Deposit is a transfer to the deposit address of a user.
+	Deposit struct {
+		UserId    int64
+		Asset     Asset
+		Amount    orderbook.Amount
+		TxHash    common.Hash
+		LogIndex  int // -1 for ETH sent by the transaction itself
+		Block     uint64
+		BlockHash common.Hash
+		Status    DepositStatus
+		// Reason is why an unprocessable deposit can not be credited
+		Reason string `json:",omitempty"`
+	}
+
+	DepositsResponse struct {
+		UserId   int64
+		Address  common.Address
+		Deposits []Deposit
+	}
+
+	depositKey struct {
+		txHash   common.Hash
+		logIndex int
+	}
+
+	// depositState is what a deposit watcher saves after every poll.
+	depositState struct {
+		Next     uint64
+		Hashes   map[uint64]common.Hash
+		Deposits []*Deposit
+	}
+)
+
+// depositKey derives the key of the deposit address of a user from the key
+// of the exchange, so the exchange controls every deposit address and can
+// derive them again after a restart.
+func (ex *Exchange) depositKey(userId int64) *ecdsa.PrivateKey {
+	seed := common.LeftPadBytes(ex.PrivateKey.D.Bytes(), 32)
+	key, err := crypto.ToECDSA(crypto.Keccak256(seed, binary.BigEndian.AppendUint64(nil, uint64(userId))))
+	if err != nil {
+		// only when the hash is not below the curve order, about 2^-128
+		panic(fmt.Sprintf("deriving the deposit key of user %d: %s", userId, err))
+	}
+	return key
+}
+
+// DepositAddress returns the address a user deposits to.
+func (ex *Exchange) DepositAddress(userId int64) common.Address {
+	return crypto.PubkeyToAddress(ex.depositKey(userId).PublicKey)
+}
+
+// depositUser returns the user an address is the deposit address of.
+func (ex *Exchange) depositUser(address common.Address) (int64, bool) {
+	ex.usersMu.RLock()
+	defer ex.usersMu.RUnlock()
+
+	userId, ok := ex.depositAddresses[address]
+	return userId, ok
+}
+
+// allDepositAddresses returns the deposit addresses of every user.
+func (ex *Exchange) allDepositAddresses() []common.Address {
+	ex.usersMu.RLock()
+	defer ex.usersMu.RUnlock()
+
+	addresses := make([]common.Address, 0, len(ex.depositAddresses))
+	for address := range ex.depositAddresses {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+// DepositWatcher credits users for the ETH and tokens sent to their deposit
+// addresses. It scans every block, holds what it finds as pending until the
+// block has Confirmations confirmations and drops pending deposits of
+// blocks a reorg removed. ETH sent by contracts, not transactions, is not
+// seen. A watcher opened with OpenDepositWatcher saves what it saw after
+// every poll and carries on from there after a restart, otherwise it scans
+// from FromBlock again.
+type DepositWatcher struct {
+	ex     *Exchange
+	client ChainBackend
+	// Confirmations is how many blocks, the one of the deposit included,
+	// have to be on chain before a deposit is credited
+	Confirmations uint64
+	// FromBlock is the first block scanned
+	FromBlock uint64
+
+	mu       sync.Mutex
+	next     uint64
+	started  bool
+	hashes   map[uint64]common.Hash
+	deposits map[depositKey]*Deposit
+	// dir keeps the saved state, it is empty for a watcher kept in memory
+	// only
+	dir string
+}
+
+func NewDepositWatcher(ex *Exchange, confirmations uint64) *DepositWatcher {
+	return &DepositWatcher{
+		ex:            ex,
+		client:        ex.client,
+		Confirmations: confirmations,
+		hashes:        make(map[uint64]common.Hash),
+		deposits:      make(map[depositKey]*Deposit),
+	}
+}
+
+// OpenDepositWatcher opens the watcher saved in dir, creating dir when
+// needed. A watcher saved before scans on from the block after the last one
+// it scanned, FromBlock only applies to a new one.
+func OpenDepositWatcher(ex *Exchange, confirmations uint64, dir string) (*DepositWatcher, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	w := NewDepositWatcher(ex, confirmations)
+	w.dir = dir
+
+	payload, err := orderbook.ReadRecordFile(filepath.Join(dir, depositsStateFile))
+	if os.IsNotExist(err) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading the deposits: %w", err)
+	}
+	state := &depositState{}
+	if err := json.Unmarshal(payload, state); err != nil {
+		return nil, fmt.Errorf("decoding the deposits: %w", err)
+	}
+	w.next, w.started = state.Next, true
+	for number, hash := range state.Hashes {
+		w.hashes[number] = hash
+	}
+	for _, deposit := range state.Deposits {
+		w.deposits[depositKey{txHash: deposit.TxHash, logIndex: deposit.LogIndex}] = deposit
+	}
+	return w, nil
+}
+
+// save writes what the watcher saw to its dir.
+func (w *DepositWatcher) save() error {
+	if w.dir == "" {
+		return nil
+	}
+	state := &depositState{Next: w.next, Hashes: w.hashes, Deposits: make([]*Deposit, 0, len(w.deposits))}
+	for _, deposit := range w.deposits {
+		state.Deposits = append(state.Deposits, deposit)
+	}
+	sort.Slice(state.Deposits, func(i, j int) bool {
+		if state.Deposits[i].Block != state.Deposits[j].Block {
+			return state.Deposits[i].Block < state.Deposits[j].Block
+		}
+		return state.Deposits[i].LogIndex < state.Deposits[j].LogIndex
+	})
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := orderbook.WriteRecordFile(filepath.Join(w.dir, depositsStateFile), payload); err != nil {
+		return fmt.Errorf("saving the deposits: %w", err)
+	}
+	return nil
+}
+
+// depositRef is what the ledger books a deposit under.
+func depositRef(key depositKey) string {
+	return fmt.Sprintf("deposit %s/%d", key.txHash.Hex(), key.logIndex)
+}
+
+// Run polls the chain on each tick of interval.
+func (w *DepositWatcher) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		<-ticker.C
+
+		if err := w.Poll(); err != nil {
+			fmt.Printf("watching deposits failed: %s\n", err)
+		}
+	}
+}
+
+// Poll scans the blocks added since the last poll, following reorgs, and
+// credits the deposits that are confirmed now. What changed is saved, even
+// when the poll fails half way.
+func (w *DepositWatcher) Poll() (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.started {
+		w.next, w.started = w.FromBlock, true
+	}
+	next, credited := w.next, false
+	defer func() {
+		if w.next == next && !credited {
+			return
+		}
+		if saveErr := w.save(); err == nil {
+			err = saveErr
+		}
+	}()
+
+	head, err := w.client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	// the blocks scanned last may have been replaced without the chain
+	// growing
+	if err := w.rewind(); err != nil {
+		return err
+	}
+
+	for w.next <= head.Number.Uint64() {
+		block, err := w.client.BlockByNumber(context.Background(), new(big.Int).SetUint64(w.next))
+		if err != nil {
+			return err
+		}
+		if parent, ok := w.hashes[w.next-1]; ok && w.next > 0 && parent != block.ParentHash() {
+			if err := w.rewind(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.scan(block); err != nil {
+			return err
+		}
+		w.hashes[w.next] = block.Hash()
+		w.next++
+	}
+
+	credited = w.confirm(head.Number.Uint64())
+	for number := range w.hashes {
+		if number+w.Confirmations+reorgWindow < w.next {
+			delete(w.hashes, number)
+		}
+	}
+	return nil
+}
+
+// rewind walks back from the last block scanned to the first one still on
+// the canonical chain, dropping the pending deposits of every block off it.
+func (w *DepositWatcher) rewind() error {
+	for w.next > 0 {
+		number := w.next - 1
+		hash, ok := w.hashes[number]
+		if !ok {
+			if number < w.FromBlock || len(w.hashes) == 0 {
+				return nil
+			}
+			return fmt.Errorf("block %d was reorged out, deeper than the %d blocks watched", number, w.Confirmations+reorgWindow)
+		}
+		header, err := w.client.HeaderByNumber(context.Background(), new(big.Int).SetUint64(number))
+		if err != nil && !errors.Is(err, ethereum.NotFound) {
+			return err
+		}
+		if err == nil && header.Hash() == hash {
+			return nil
+		}
+
+		for key, deposit := range w.deposits {
+			if deposit.BlockHash != hash {
+				continue
+			}
+			if deposit.Status == DepositCredited {
+				fmt.Printf("credited deposit %s of user %d was reorged out of block %d\n", deposit.TxHash, deposit.UserId, number)
+				continue
+			}
+			delete(w.deposits, key)
+		}
+		delete(w.hashes, number)
+		w.next = number
+	}
+	return nil
+}
+
+// scan records the deposits of block as pending.
+func (w *DepositWatcher) scan(block *types.Block) error {
+	for _, tx := range block.Transactions() {
+		if tx.To() == nil || tx.Value().Sign() <= 0 {
+			continue
+		}
+		userId, ok := w.ex.depositUser(*tx.To())
+		if !ok {
+			continue
+		}
+		receipt, err := w.client.TransactionReceipt(context.Background(), tx.Hash())
+		if err != nil {
+			return err
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			continue
+		}
+		amount, err := FromBaseUnits(tx.Value(), ETH.Decimals)
+		w.add(block, &Deposit{UserId: userId, Asset: AssetETH, Amount: amount, TxHash: tx.Hash(), LogIndex: -1}, err)
+	}
+
+	tokens := w.ex.tokensByAddress()
+	if len(tokens) == 0 {
+		return nil
+	}
+	hash := block.Hash()
+	addresses := make([]common.Address, 0, len(tokens))
+	for address := range tokens {
+		addresses = append(addresses, address)
+	}
+	logs, err := w.client.FilterLogs(context.Background(), ethereum.FilterQuery{
+		BlockHash: &hash,
+		Addresses: addresses,
+		Topics:    [][]common.Hash{{erc20.Events["Transfer"].ID}},
+	})
+	if err != nil {
+		return err
+	}
+	for _, log := range logs {
+		if log.Removed || len(log.Topics) != 3 {
+			continue
+		}
+		userId, ok := w.ex.depositUser(common.BytesToAddress(log.Topics[2].Bytes()))
+		if !ok {
+			continue
+		}
+		token := tokens[log.Address]
+		amount, err := FromBaseUnits(new(big.Int).SetBytes(log.Data), token.Asset.Decimals)
+		w.add(block, &Deposit{UserId: userId, Asset: token.Asset.Asset, Amount: amount, TxHash: log.TxHash, LogIndex: int(log.Index)}, err)
+	}
+	return nil
+}
+
+// add records deposit as pending, or as unprocessable when its amount
+// failed to convert with err. An unprocessable deposit is skipped rather
+// than failing the scan, so it does not hold up the deposits after it.
+func (w *DepositWatcher) add(block *types.Block, deposit *Deposit, err error) {
+	key := depositKey{txHash: deposit.TxHash, logIndex: deposit.LogIndex}
+	if seen, ok := w.deposits[key]; ok && seen.Status == DepositCredited {
+		// the transaction made it into another block after a reorg
+		return
+	}
+	deposit.Block = block.NumberU64()
+	deposit.BlockHash = block.Hash()
+	deposit.Status = DepositPending
+	if err != nil {
+		fmt.Printf("deposit %s of user %d can not be credited: %s\n", deposit.TxHash, deposit.UserId, err)
+		deposit.Status = DepositUnprocessable
+		deposit.Reason = err.Error()
+	}
+	w.deposits[key] = deposit
+}
+
+// confirm credits the pending deposits that have enough confirmations at
+// head and reports whether it credited any. A deposit the ledger booked
+// already, before a restart the watcher did not save, is not credited
+// again.
+func (w *DepositWatcher) confirm(head uint64) bool {
+	confirmations := max(w.Confirmations, 1)
+	credited := false
+	for key, deposit := range w.deposits {
+		if deposit.Status != DepositPending || head+1 < deposit.Block+confirmations {
+			continue
+		}
+		err := w.ex.ledger.Credit(depositRef(key), deposit.UserId, deposit.Asset, deposit.Amount)
+		if err != nil && !errors.Is(err, ErrBooked) {
+			fmt.Printf("crediting deposit %s of user %d failed: %s\n", deposit.TxHash, deposit.UserId, err)
+			continue
+		}
+		deposit.Status = DepositCredited
+		credited = true
+	}
+	return credited
+}
+
+// Deposits returns the deposits seen for a user, oldest first.
+func (w *DepositWatcher) Deposits(userId int64) []Deposit {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	deposits := []Deposit{}
+	for _, deposit := range w.deposits {
+		if deposit.UserId == userId {
+			deposits = append(deposits, *deposit)
+		}
+	}
+	sort.Slice(deposits, func(i, j int) bool {
+		if deposits[i].Block != deposits[j].Block {
+			return deposits[i].Block < deposits[j].Block
+		}
+		return deposits[i].LogIndex < deposits[j].LogIndex
+	})
+	return deposits
+}
+
+// all returns every deposit seen.
+func (w *DepositWatcher) all() []Deposit {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	deposits := make([]Deposit, 0, len(w.deposits))
+	for _, deposit := range w.deposits {
+		deposits = append(deposits, *deposit)
+	}
+	return deposits
+}
+
+// tokensByAddress returns the registered tokens by contract address.
+func (ex *Exchange) tokensByAddress() map[common.Address]*Token {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	tokens := make(map[common.Address]*Token, len(ex.tokens))
+	for _, token := range ex.tokens {
+		tokens[token.Address] = token
+	}
+	return tokens
+}
+
+func (w *DepositWatcher) handleGetDeposits(c echo.Context) error {
+	userId, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid user ID"})
+	}
+	if _, ok := w.ex.user(userId); !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "user not found"})
+	}
+	return c.JSON(http.StatusOK, &DepositsResponse{
+		UserId:   userId,
+		Address:  w.ex.DepositAddress(userId),
+		Deposits: w.Deposits(userId),
+	})
+}
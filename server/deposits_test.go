@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDepositWatcherCreditsConfirmedDeposits(t *testing.T) {
+	senderKey, sender := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		sender:           {Balance: new(big.Int).Mul(big.NewInt(10), big.NewInt(1e18))},
+		testTokenAddress: testToken(6, map[common.Address]*big.Int{sender: big.NewInt(1_000_000_000)}),
+	})
+	defer backend.Close()
+	client := backend.Client()
+
+	ex := NewExchange("", client)
+	defer ex.Close()
+	ex.AddUser(&User{Id: 1})
+	ex.AddUser(&User{Id: 2})
+	assert.Nil(t, ex.RegisterToken(USDC, testTokenAddress))
+	assert.NotEqual(t, ex.DepositAddress(1), ex.DepositAddress(2))
+	token, _ := ex.token(AssetUSDC)
+	w := NewDepositWatcher(ex, 2)
+
+	assert.Nil(t, TransferETH(ex.nonces, senderKey, ex.DepositAddress(1).Hex(), orderbook.MustParseAmount("1.5")))
+	_, err := token.Transfer(ex.nonces, senderKey, ex.DepositAddress(2), orderbook.AmountFromInt(250))
+	assert.Nil(t, err)
+	// not a deposit address
+	_, stranger := newKey(t)
+	assert.Nil(t, TransferETH(ex.nonces, senderKey, stranger.Hex(), orderbook.AmountFromInt(1)))
+	backend.Commit()
+
+	assert.Nil(t, w.Poll())
+	deposits := w.Deposits(1)
+	assert.Equal(t, len(deposits), 1)
+	assert.Equal(t, deposits[0].Status, DepositPending)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("0", "0"))
+
+	backend.Commit()
+	assert.Nil(t, w.Poll())
+	assert.Nil(t, w.Poll())
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("1.5", "0"))
+	assertBalance(t, ex.ledger, 2, AssetUSDC, balance("250", "0"))
+	deposits = w.Deposits(2)
+	assert.Equal(t, len(deposits), 1)
+	assert.Equal(t, deposits[0].Asset, AssetUSDC)
+	assert.Equal(t, deposits[0].Status, DepositCredited)
+	assertBalanced(t, ex.ledger)
+}
+
+func TestDepositWatcherFollowsReorgs(t *testing.T) {
+	senderKey, sender := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		sender: {Balance: new(big.Int).Mul(big.NewInt(10), big.NewInt(1e18))},
+	})
+	defer backend.Close()
+	client := backend.Client()
+
+	ex := NewExchange("", client)
+	defer ex.Close()
+	ex.AddUser(&User{Id: 1})
+	w := NewDepositWatcher(ex, 3)
+
+	backend.Commit()
+	assert.Nil(t, TransferETH(ex.nonces, senderKey, ex.DepositAddress(1).Hex(), orderbook.AmountFromInt(1)))
+	deposited := backend.Commit()
+	assert.Nil(t, w.Poll())
+	assert.Equal(t, len(w.Deposits(1)), 1)
+
+	// a longer chain replaces the deposit block and takes the transaction
+	// in again
+	header, err := client.HeaderByHash(context.Background(), deposited)
+	assert.Nil(t, err)
+	assert.Nil(t, backend.Fork(header.ParentHash))
+	backend.Commit()
+	backend.Commit()
+	assert.Nil(t, w.Poll())
+
+	deposits := w.Deposits(1)
+	assert.Equal(t, len(deposits), 1)
+	assert.NotEqual(t, deposits[0].BlockHash, deposited)
+	assert.Equal(t, deposits[0].Status, DepositPending)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("0", "0"))
+
+	backend.Commit()
+	backend.Commit()
+	assert.Nil(t, w.Poll())
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("1", "0"))
+	assert.Equal(t, w.Deposits(1)[0].Status, DepositCredited)
+}
+
+func TestDepositWatcherSkipsUnprocessableDeposits(t *testing.T) {
+	senderKey, sender := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		sender:           {Balance: new(big.Int).Mul(big.NewInt(10), big.NewInt(1e18))},
+		testTokenAddress: testToken(24, map[common.Address]*big.Int{sender: big.NewInt(1_000_000)}),
+	})
+	defer backend.Close()
+	client := backend.Client()
+
+	ex := NewExchange("", client)
+	defer ex.Close()
+	ex.AddUser(&User{Id: 1})
+	dust := AssetSpec{Asset: "DUST", Decimals: 24}
+	assert.Nil(t, ex.RegisterToken(dust, testTokenAddress))
+	w := NewDepositWatcher(ex, 1)
+
+	// one base unit of a token with 24 decimals is finer than an amount
+	data, err := erc20.Pack("transfer", ex.DepositAddress(1), big.NewInt(1))
+	assert.Nil(t, err)
+	_, err = ex.nonces.Send(senderKey, testTokenAddress, new(big.Int), data, 0)
+	assert.Nil(t, err)
+	backend.Commit()
+	// a wei on top of a large balance
+	assert.Nil(t, ex.ledger.Deposit(1, AssetETH, orderbook.AmountFromInt(100)))
+	assert.Nil(t, TransferETH(ex.nonces, senderKey, ex.DepositAddress(1).Hex(), orderbook.MustParseAmount("1.000000000000000001")))
+	backend.Commit()
+
+	assert.Nil(t, w.Poll())
+	deposits := w.Deposits(1)
+	assert.Equal(t, len(deposits), 2)
+	assert.Equal(t, deposits[0].Asset, dust.Asset)
+	assert.Equal(t, deposits[0].Status, DepositUnprocessable)
+	assert.NotEmpty(t, deposits[0].Reason)
+	assert.Equal(t, deposits[1].Status, DepositCredited)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("101.000000000000000001", "0"))
+	assertBalance(t, ex.ledger, 1, dust.Asset, balance("0", "0"))
+	assertBalanced(t, ex.ledger)
+
+	// the unprocessable deposit is not retried
+	backend.Commit()
+	assert.Nil(t, w.Poll())
+	assert.Equal(t, w.Deposits(1)[0].Status, DepositUnprocessable)
+	assertBalance(t, ex.ledger, 1, dust.Asset, balance("0", "0"))
+}
+
+func TestDepositWatcherResumesAfterRestart(t *testing.T) {
+	senderKey, sender := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		sender: {Balance: new(big.Int).Mul(big.NewInt(10), big.NewInt(1e18))},
+	})
+	defer backend.Close()
+	client := backend.Client()
+
+	dir := t.TempDir()
+	open := func() (*Exchange, *DepositWatcher) {
+		ex := NewExchange("", client)
+		ex.AddUser(&User{Id: 1})
+		assert.Nil(t, ex.RecoverLedger(filepath.Join(dir, ledgerDir)))
+		w, err := OpenDepositWatcher(ex, 2, filepath.Join(dir, depositsDir))
+		assert.Nil(t, err)
+		// like StartServer, which only a new watcher heeds
+		head, err := client.HeaderByNumber(context.Background(), nil)
+		assert.Nil(t, err)
+		w.FromBlock = head.Number.Uint64() + 1
+		return ex, w
+	}
+
+	ex, w := open()
+	assert.Nil(t, TransferETH(ex.nonces, senderKey, ex.DepositAddress(1).Hex(), orderbook.AmountFromInt(1)))
+	backend.Commit()
+	assert.Nil(t, w.Poll())
+	assert.Equal(t, w.Deposits(1)[0].Status, DepositPending)
+	assert.Nil(t, ex.Close())
+
+	// sent while the exchange is down
+	assert.Nil(t, TransferETH(ex.nonces, senderKey, ex.DepositAddress(1).Hex(), orderbook.AmountFromInt(2)))
+	backend.Commit()
+	backend.Commit()
+
+	ex, w = open()
+	saved, err := os.ReadFile(filepath.Join(dir, depositsDir, depositsStateFile))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Poll())
+	deposits := w.Deposits(1)
+	assert.Equal(t, len(deposits), 2)
+	assert.Equal(t, deposits[0].Status, DepositCredited)
+	assert.Equal(t, deposits[1].Status, DepositCredited)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("3", "0"))
+	assert.Nil(t, ex.Close())
+
+	// a crash before the watcher saved what it credited does not credit
+	// it twice
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, depositsDir, depositsStateFile), saved, 0o644))
+	ex, w = open()
+	defer ex.Close()
+	assert.Equal(t, w.Deposits(1)[0].Status, DepositPending)
+	assert.Nil(t, w.Poll())
+	assert.Equal(t, w.Deposits(1)[0].Status, DepositCredited)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("3", "0"))
+	assertBalanced(t, ex.ledger)
+}
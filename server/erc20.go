@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// erc20ABI is the part of the ERC-20 interface the exchange uses.
+const erc20ABI = `[
+	{"type":"function","name":"decimals","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint8"}]},
+	{"type":"function","name":"balanceOf","stateMutability":"view","inputs":[{"name":"owner","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"allowance","stateMutability":"view","inputs":[{"name":"owner","type":"address"},{"name":"spender","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"approve","stateMutability":"nonpayable","inputs":[{"name":"spender","type":"address"},{"name":"value","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+	{"type":"function","name":"transfer","stateMutability":"nonpayable","inputs":[{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+	{"type":"function","name":"transferFrom","stateMutability":"nonpayable","inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+	{"type":"event","name":"Transfer","anonymous":false,"inputs":[{"name":"from","type":"address","indexed":true},{"name":"to","type":"address","indexed":true},{"name":"value","type":"uint256","indexed":false}]}
+]`
+
+var erc20 = func() abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(erc20ABI))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}()
+
+// ErrPrecision is returned for amounts with more decimals than the asset
+// has on chain.
+var ErrPrecision = errors.New("amount has more decimals than the asset")
+
+// ToBaseUnits returns amount in the smallest unit of an asset with the
+// given decimals, e.g. wei for ETH.
+func ToBaseUnits(amount orderbook.Amount, decimals uint8) (*big.Int, error) {
+	if amount.Sign() < 0 {
+		return nil, ErrInvalidAmount
+	}
+	if amount.Scale() > decimals {
+		return nil, fmt.Errorf("%w: %s has %d decimals, at most %d allowed", ErrPrecision, amount, amount.Scale(), decimals)
+	}
+	return amount.ScaledInt(decimals), nil
+}
+
+// FromBaseUnits is the inverse of ToBaseUnits. Assets with more decimals
+// than an Amount has convert as long as the extra decimals are zeros.
+func FromBaseUnits(units *big.Int, decimals uint8) (orderbook.Amount, error) {
+	if units.Sign() < 0 {
+		return orderbook.Amount{}, ErrInvalidAmount
+	}
+	exact, scale := new(big.Int).Set(units), decimals
+	for rem := new(big.Int); scale > orderbook.MaxScale; scale-- {
+		if exact.QuoRem(exact, big.NewInt(10), rem); rem.Sign() != 0 {
+			return orderbook.Amount{}, fmt.Errorf("%w: %s base units of an asset with %d decimals", orderbook.ErrAmountScale, units, decimals)
+		}
+	}
+	return orderbook.NewAmountFromBig(exact, scale), nil
+}
+
+// Token is the ERC-20 contract an asset is settled with on chain.
+type Token struct {
+	Asset   AssetSpec
+	Address common.Address
+}
+
+// NewToken returns the token of asset at address after checking that the
+// contract has the decimals the exchange expects.
+func NewToken(client ChainBackend, asset AssetSpec, address common.Address) (*Token, error) {
+	t := &Token{Asset: asset, Address: address}
+	out, err := t.call(client, "decimals")
+	if err != nil {
+		return nil, fmt.Errorf("reading the decimals of %s at %s: %w", asset.Asset, address, err)
+	}
+	if decimals := out[0].(uint8); decimals != asset.Decimals {
+		return nil, fmt.Errorf("%s at %s has %d decimals, expected %d", asset.Asset, address, decimals, asset.Decimals)
+	}
+	return t, nil
+}
+
+// BalanceOf returns what owner has of the token.
+func (t *Token) BalanceOf(client ChainBackend, owner common.Address) (orderbook.Amount, error) {
+	out, err := t.call(client, "balanceOf", owner)
+	if err != nil {
+		return orderbook.Amount{}, err
+	}
+	return FromBaseUnits(out[0].(*big.Int), t.Asset.Decimals)
+}
+
+// Allowance returns how much spender may still transfer from owner.
+func (t *Token) Allowance(client ChainBackend, owner, spender common.Address) (orderbook.Amount, error) {
+	out, err := t.call(client, "allowance", owner, spender)
+	if err != nil {
+		return orderbook.Amount{}, err
+	}
+	return FromBaseUnits(out[0].(*big.Int), t.Asset.Decimals)
+}
+
+// Approve lets spender transfer up to amount of the token from the owner of
+// key.
+func (t *Token) Approve(nonces *NonceManager, key *ecdsa.PrivateKey, spender common.Address, amount orderbook.Amount) (*types.Transaction, error) {
+	return t.transact(nonces, key, "approve", amount, spender)
+}
+
+// Transfer sends amount of the token from the owner of key to to.
+func (t *Token) Transfer(nonces *NonceManager, key *ecdsa.PrivateKey, to common.Address, amount orderbook.Amount) (*types.Transaction, error) {
+	return t.transact(nonces, key, "transfer", amount, to)
+}
+
+// TransferFrom sends amount of the token from from to to, spending the
+// allowance from gave the owner of key.
+func (t *Token) TransferFrom(nonces *NonceManager, key *ecdsa.PrivateKey, from, to common.Address, amount orderbook.Amount) (*types.Transaction, error) {
+	return t.transact(nonces, key, "transferFrom", amount, from, to)
+}
+
+// transact calls method with args and amount, in base units, as its last
+// argument.
+func (t *Token) transact(nonces *NonceManager, key *ecdsa.PrivateKey, method string, amount orderbook.Amount, args ...any) (*types.Transaction, error) {
+	value, err := ToBaseUnits(amount, t.Asset.Decimals)
+	if err != nil {
+		return nil, err
+	}
+	data, err := erc20.Pack(method, append(args, value)...)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := nonces.Send(key, t.Address, new(big.Int), data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", t.Asset.Asset, method, err)
+	}
+	return tx, nil
+}
+
+func (t *Token) call(client ChainBackend, method string, args ...any) ([]any, error) {
+	data, err := erc20.Pack(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.CallContract(context.Background(), ethereum.CallMsg{To: &t.Address, Data: data}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return erc20.Unpack(method, out)
+}
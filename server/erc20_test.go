@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/stretchr/testify/assert"
+)
+
+// testTokenCode is the runtime code of a minimal ERC-20: decimals,
+// balanceOf, allowance, approve, transfer and transferFrom, with Transfer
+// events. Decimals are kept in slot 0, the balance of an address in
+// keccak256(address) and allowances in keccak256(owner, spender).
+const testTokenCode = "60003560e01c8063313ce5671461004d57806370a082311461005a578063dd62ed3e14610070578063095ea7b31461008c578063a9059cbb146100ac57806323b872dd1461010f575b600080fd5b5060005460005260206000f35b5060043560005260206000205460005260206000f35b5060043560243560205260005260406000205460005260206000f35b503360043560205260005260406000206024359055600160005260206000f35b50336004356024358260005260206000208054828110610048578290039055816000526020600020805482019055600052907fddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef60206000a3600160005260206000f35b506004353360205260005260406000208054604435811061004857604435900390556004356024356044358260005260206000208054828110610048578290039055816000526020600020805482019055600052907fddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef60206000a3600160005260206000f3"
+
+var testTokenAddress = common.HexToAddress("0x00000000000000000000000000000000000c0de1")
+
+// testToken is the genesis account of a token with decimals, giving each
+// holder their balance in base units.
+func testToken(decimals uint8, holders map[common.Address]*big.Int) types.Account {
+	storage := map[common.Hash]common.Hash{
+		{}: common.BigToHash(big.NewInt(int64(decimals))),
+	}
+	for holder, balance := range holders {
+		storage[crypto.Keccak256Hash(common.LeftPadBytes(holder.Bytes(), 32))] = common.BigToHash(balance)
+	}
+	return types.Account{Code: common.FromHex(testTokenCode), Storage: storage, Balance: new(big.Int)}
+}
+
+func newKey(t *testing.T) (*ecdsa.PrivateKey, common.Address) {
+	key, err := crypto.GenerateKey()
+	assert.Nil(t, err)
+	return key, crypto.PubkeyToAddress(key.PublicKey)
+}
+
+func TestBaseUnits(t *testing.T) {
+	wei, err := ToBaseUnits(orderbook.MustParseAmount("1234.5"), 18)
+	assert.Nil(t, err)
+	assert.Equal(t, wei.String(), "1234500000000000000000")
+	eth, err := FromBaseUnits(wei, 18)
+	assert.Nil(t, err)
+	assert.Equal(t, eth, orderbook.MustParseAmount("1234.5"))
+
+	units, err := ToBaseUnits(orderbook.MustParseAmount("0.000001"), 6)
+	assert.Nil(t, err)
+	assert.Equal(t, units.Int64(), int64(1))
+	_, err = ToBaseUnits(orderbook.MustParseAmount("0.0000001"), 6)
+	assert.ErrorIs(t, err, ErrPrecision)
+
+	zero, err := FromBaseUnits(new(big.Int), 8)
+	assert.Nil(t, err)
+	assert.True(t, zero.IsZero())
+
+	// beyond what an int64 holds at 18 decimals
+	wei, _ = new(big.Int).SetString("10000000000000000001", 10)
+	eth, err = FromBaseUnits(wei, 18)
+	assert.Nil(t, err)
+	assert.Equal(t, eth.String(), "10.000000000000000001")
+
+	// more decimals than an amount has, fine while the extra ones are zeros
+	units, _ = new(big.Int).SetString("1500000000000000000000000", 10)
+	amount, err := FromBaseUnits(units, 24)
+	assert.Nil(t, err)
+	assert.Equal(t, amount, orderbook.MustParseAmount("1.5"))
+	_, err = FromBaseUnits(big.NewInt(1), 24)
+	assert.ErrorIs(t, err, orderbook.ErrAmountScale)
+}
+
+func TestTokenTransfers(t *testing.T) {
+	ownerKey, owner := newKey(t)
+	spenderKey, spender := newKey(t)
+	_, receiver := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		owner:            {Balance: big.NewInt(1e18)},
+		spender:          {Balance: big.NewInt(1e18)},
+		testTokenAddress: testToken(6, map[common.Address]*big.Int{owner: big.NewInt(100_000_000)}),
+	})
+	defer backend.Close()
+	client := backend.Client()
+
+	_, err := NewToken(client, WBTC, testTokenAddress)
+	assert.NotNil(t, err, "WBTC has 8 decimals, the token 6")
+	token, err := NewToken(client, USDC, testTokenAddress)
+	assert.Nil(t, err)
+	nonces := NewNonceManager(client)
+
+	_, err = token.Transfer(nonces, ownerKey, receiver, orderbook.AmountFromInt(10))
+	assert.Nil(t, err)
+	_, err = token.Approve(nonces, ownerKey, spender, orderbook.AmountFromInt(50))
+	assert.Nil(t, err)
+	backend.Commit()
+
+	_, err = token.TransferFrom(nonces, spenderKey, owner, receiver, orderbook.MustParseAmount("20.5"))
+	assert.Nil(t, err)
+	backend.Commit()
+
+	balance, _ := token.BalanceOf(client, owner)
+	assert.Equal(t, balance, orderbook.MustParseAmount("69.5"))
+	balance, _ = token.BalanceOf(client, receiver)
+	assert.Equal(t, balance, orderbook.MustParseAmount("30.5"))
+	allowance, _ := token.Allowance(client, owner, spender)
+	assert.Equal(t, allowance, orderbook.MustParseAmount("29.5"))
+
+	// transfers the token refuses fail at gas estimation, before being sent
+	_, err = token.TransferFrom(nonces, spenderKey, owner, receiver, orderbook.AmountFromInt(30))
+	assert.NotNil(t, err)
+	_, err = token.Transfer(nonces, ownerKey, receiver, orderbook.AmountFromInt(70))
+	assert.NotNil(t, err)
+	_, err = token.Transfer(nonces, ownerKey, receiver, orderbook.MustParseAmount("0.0000001"))
+	assert.ErrorIs(t, err, ErrPrecision)
+}
+
+func TestExchangeSettlesTokensOnChain(t *testing.T) {
+	exchangeKey, err := crypto.HexToECDSA(exchangePrivateKey)
+	assert.Nil(t, err)
+	exchange := crypto.PubkeyToAddress(exchangeKey.PublicKey)
+	userKey, userAddress := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		exchange:         {Balance: big.NewInt(1e18)},
+		userAddress:      {Balance: new(big.Int).Mul(big.NewInt(5), big.NewInt(1e18))},
+		testTokenAddress: testToken(6, map[common.Address]*big.Int{userAddress: big.NewInt(1_000_000_000)}),
+	})
+	defer backend.Close()
+	client := backend.Client()
+
+	ex := NewExchange("", client)
+	defer ex.Close()
+	user := &User{Id: 1, PrivateKey: userKey}
+	ex.AddUser(user)
+	assert.Nil(t, ex.RegisterToken(USDC, testTokenAddress))
+	assert.NotNil(t, ex.RegisterToken(ETH, testTokenAddress))
+	token, _ := ex.token(AssetUSDC)
+
+	// the exchange pulls no more than it was approved
+	assert.NotNil(t, ex.deposit(context.Background(), user, AssetUSDC, orderbook.AmountFromInt(100)))
+	_, err = token.Approve(ex.nonces, userKey, exchange, orderbook.AmountFromInt(100))
+	assert.Nil(t, err)
+	backend.Commit()
+
+	// nothing is credited before the transfer is mined
+	ctx, cancel := context.WithTimeout(context.Background(), 3*receiptPollInterval)
+	assert.NotNil(t, ex.deposit(ctx, user, AssetETH, orderbook.AmountFromInt(2)))
+	cancel()
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("0", "0"))
+	backend.Commit()
+
+	mined := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(receiptPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-mined:
+				return
+			case <-ticker.C:
+				backend.Commit()
+			}
+		}
+	}()
+	assert.Nil(t, ex.deposit(context.Background(), user, AssetUSDC, orderbook.AmountFromInt(100)))
+	assert.Nil(t, ex.deposit(context.Background(), user, AssetETH, orderbook.AmountFromInt(2)))
+	close(mined)
+
+	assertBalance(t, ex.ledger, 1, AssetUSDC, balance("100", "0"))
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("2", "0"))
+	onChain, _ := token.BalanceOf(client, exchange)
+	assert.Equal(t, onChain, orderbook.AmountFromInt(100))
+
+	withdrawals := NewWithdrawalQueue(ex, 1)
+	w, err := withdrawals.Request(&WithdrawalRequest{UserId: 1, Asset: AssetUSDC, Amount: orderbook.MustParseAmount("40.25")})
+	assert.Nil(t, err)
+	assert.Nil(t, withdrawals.Process())
+	backend.Commit()
+	assert.Nil(t, withdrawals.Process())
+	w, _ = withdrawals.Withdrawal(w.Id)
+	assert.Equal(t, w.Status, WithdrawalConfirmed)
+	assertBalance(t, ex.ledger, 1, AssetUSDC, balance("59.75", "0"))
+	onChain, _ = token.BalanceOf(client, userAddress)
+	assert.Equal(t, onChain, orderbook.MustParseAmount("940.25"))
+
+	// withdrawals the chain can not carry are refused before the debit
+	_, err = withdrawals.Request(&WithdrawalRequest{UserId: 1, Asset: AssetUSDC, Amount: orderbook.MustParseAmount("0.0000001")})
+	assert.ErrorIs(t, err, ErrPrecision)
+	assertBalance(t, ex.ledger, 1, AssetUSDC, balance("59.75", "0"))
+	_, err = withdrawals.Request(&WithdrawalRequest{UserId: 1, Asset: AssetWBTC, Amount: orderbook.AmountFromInt(1)})
+	assert.NotNil(t, err)
+	assertBalanced(t, ex.ledger)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+// ErrorCode is the machine readable reason an order was rejected.
+type ErrorCode string
+
+const (
+	ErrCodeInvalidRequest     ErrorCode = "INVALID_REQUEST"
+	ErrCodeUnknownMarket      ErrorCode = "UNKNOWN_MARKET"
+	ErrCodeInvalidSize        ErrorCode = "INVALID_SIZE"
+	ErrCodeSizeBelowMin       ErrorCode = "SIZE_BELOW_MIN"
+	ErrCodeSizeAboveMax       ErrorCode = "SIZE_ABOVE_MAX"
+	ErrCodeInvalidLotSize     ErrorCode = "INVALID_LOT_SIZE"
+	ErrCodeInvalidPrice       ErrorCode = "INVALID_PRICE"
+	ErrCodeInvalidTickSize    ErrorCode = "INVALID_TICK_SIZE"
+	ErrCodePriceOutOfBand     ErrorCode = "PRICE_OUT_OF_BAND"
+	ErrCodeNotionalBelowMin   ErrorCode = "NOTIONAL_BELOW_MIN"
+	ErrCodeInsufficientVolume ErrorCode = "INSUFFICIENT_VOLUME"
+	ErrCodePostOnlyWouldCross ErrorCode = "POST_ONLY_WOULD_CROSS"
+	ErrCodeOrderExpired       ErrorCode = "ORDER_EXPIRED"
+	ErrCodeOrderNotFound      ErrorCode = "ORDER_NOT_FOUND"
+	ErrCodeInsufficientFunds  ErrorCode = "INSUFFICIENT_FUNDS"
+	ErrCodeUnknownUser        ErrorCode = "UNKNOWN_USER"
+	ErrCodeTooManyOpenOrders  ErrorCode = "TOO_MANY_OPEN_ORDERS"
+	ErrCodePositionLimit      ErrorCode = "POSITION_LIMIT"
+	ErrCodeMarketHalted       ErrorCode = "MARKET_HALTED"
+	ErrCodeMarketCancelOnly   ErrorCode = "MARKET_CANCEL_ONLY"
+	ErrCodeMarketPostOnly     ErrorCode = "MARKET_POST_ONLY"
+	ErrCodeMarketDelisted     ErrorCode = "MARKET_DELISTED"
+	ErrCodeRejected           ErrorCode = "REJECTED"
+)
+
+// OrderError is an order rejection with a structured code.
+type OrderError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *OrderError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func newOrderError(code ErrorCode, format string, args ...any) *OrderError {
+	return &OrderError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// errorCode returns the code an order rejected with err is reported with.
+func errorCode(err error) ErrorCode {
+	var orderErr *OrderError
+	if errors.As(err, &orderErr) {
+		return orderErr.Code
+	}
+
+	var volumeErr *orderbook.InsufficientVolumeError
+	switch {
+	case errors.As(err, &volumeErr):
+		return ErrCodeInsufficientVolume
+	case errors.Is(err, orderbook.ErrPostOnlyWouldCross):
+		return ErrCodePostOnlyWouldCross
+	case errors.Is(err, orderbook.ErrOrderExpired):
+		return ErrCodeOrderExpired
+	case errors.Is(err, orderbook.ErrPricePrecision), errors.Is(err, orderbook.ErrInvalidStopPrice):
+		return ErrCodeInvalidPrice
+	case errors.Is(err, orderbook.ErrSizePrecision):
+		return ErrCodeInvalidSize
+	case errors.Is(err, orderbook.ErrOrderNotFound):
+		return ErrCodeOrderNotFound
+	case errors.Is(err, ErrInsufficientFunds):
+		return ErrCodeInsufficientFunds
+	case errors.Is(err, orderbook.ErrInvalidAmend), errors.Is(err, orderbook.ErrAmendStopOrder):
+		return ErrCodeInvalidRequest
+	}
+	return ErrCodeRejected
+}
+
+// rejectOrder responds with the reason the order was rejected. Nothing of a
+// rejected order is filled.
+func rejectOrder(c echo.Context, orderId int64, size orderbook.Amount, err error) error {
+	reason := err.Error()
+	var orderErr *OrderError
+	if errors.As(err, &orderErr) {
+		reason = orderErr.Message
+	}
+
+	return c.JSON(http.StatusBadRequest, &OrderRejectedResponse{
+		OrderId:  orderId,
+		Code:     errorCode(err),
+		Reason:   reason,
+		Filled:   orderbook.Amount{},
+		Unfilled: size,
+	})
+}
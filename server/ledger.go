@@ -0,0 +1,763 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+)
+
+// Asset is a currency the ledger keeps balances in.
+type Asset string
+
+const (
+	AssetETH  Asset = "ETH"
+	AssetUSDC Asset = "USDC"
+	AssetWBTC Asset = "WBTC"
+
+	// externalUser owns the accounts of the world outside the exchange.
+	// Deposits are taken from them and withdrawals go back to them, so the
+	// balances of every asset always sum to zero.
+	externalUser int64 = 0
+
+	ledgerJournalFile = "ledger"
+)
+
+var (
+	// ErrInsufficientFunds is returned when a user's available balance
+	// can not cover a hold or a withdrawal.
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	// ErrInvalidAmount is returned for deposits and withdrawals that are
+	// not positive.
+	ErrInvalidAmount = errors.New("amount must be positive")
+	// ErrBooked is returned for an external event the ledger booked
+	// already.
+	ErrBooked = errors.New("booked already")
+)
+
+// Posting is one leg of a ledger entry. Credits are positive, debits
+// negative.
+type Posting struct {
+	UserId int64
+	Asset  Asset
+	// Held postings move the part of the balance set aside for open orders
+	Held   bool
+	Amount orderbook.Amount
+}
+
+// Entry is a set of postings that sum to zero for every asset, applied all
+// at once or not at all.
+type Entry struct {
+	Id   int64
+	Memo string
+	// Ref names the event outside the ledger the entry books, e.g. a
+	// withdrawal, every ref is booked once at most
+	Ref      string `json:",omitempty"`
+	Postings []Posting
+}
+
+// Balance is what a user owns of an asset. Held is set aside for open
+// orders, Available can be traded or withdrawn.
+type Balance struct {
+	Asset     Asset
+	Available orderbook.Amount
+	Held      orderbook.Amount
+}
+
+type account struct {
+	userId int64
+	asset  Asset
+	held   bool
+}
+
+// Hold is what is set aside for an open order.
+type Hold struct {
+	OrderId int64
+	UserId  int64
+	Market  Market
+	Bid     bool
+	// Size is what the order may still buy or sell of the base asset
+	Size   orderbook.Amount
+	Asset  Asset
+	Amount orderbook.Amount
+}
+
+// Ledger is a double-entry ledger of user balances. Placing an order holds
+// what it may spend, every fill moves the base and the quote legs between
+// buyer and seller in one entry, and what is left of a hold is released
+// when the order closes. A ledger opened with OpenLedger journals every
+// change before applying it, so it survives restarts. It is safe for
+// concurrent use.
+type Ledger struct {
+	mu       sync.Mutex
+	balances map[account]orderbook.Amount
+	// holds maps an order id to the funds set aside for it
+	holds   map[int64]*Hold
+	entries []*Entry
+	// followed is the sequence number of the last event of each market the
+	// ledger followed, the fills up to it are settled already
+	followed map[Market]uint64
+	// refs are the refs of the entries booked
+	refs map[string]bool
+	// journal is nil for a ledger kept in memory only
+	journal *orderbook.Journal
+}
+
+// ledgerRecord is what one update of the ledger changed, the unit the
+// ledger journals and replays.
+type ledgerRecord struct {
+	Entries []*Entry
+	// Holds are the holds the update set, Released the orders whose holds
+	// it dropped
+	Holds    []*Hold
+	Released []int64
+	// Followed is how far the ledger followed every market with the
+	// update, updates that were not journaled included
+	Followed map[Market]uint64 `json:",omitempty"`
+	// Closed are the markets the update forgot having followed
+	Closed []Market `json:",omitempty"`
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{
+		balances: make(map[account]orderbook.Amount),
+		holds:    make(map[int64]*Hold),
+		entries:  []*Entry{},
+		followed: make(map[Market]uint64),
+		refs:     make(map[string]bool),
+	}
+}
+
+// OpenLedger opens the ledger journaled in dir, creating dir when needed,
+// and replays its journal. Every change is journaled to dir from then on.
+func OpenLedger(dir string) (*Ledger, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	journal, err := orderbook.OpenJournal(filepath.Join(dir, ledgerJournalFile))
+	if err != nil {
+		return nil, err
+	}
+	records, err := journal.Records()
+	if err != nil {
+		journal.Close()
+		return nil, fmt.Errorf("reading the ledger journal: %w", err)
+	}
+
+	l := NewLedger()
+	for i, payload := range records {
+		rec := &ledgerRecord{}
+		if err := json.Unmarshal(payload, rec); err != nil {
+			journal.Close()
+			return nil, fmt.Errorf("%w: ledger record %d: %s", orderbook.ErrJournalCorrupt, i, err)
+		}
+		l.apply(rec)
+	}
+	l.journal = journal
+	return l, nil
+}
+
+// Close closes the journal of the ledger.
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.journal == nil {
+		return nil
+	}
+	return l.journal.Close()
+}
+
+// ledgerTx stages the changes of one update. Reads see the staged changes
+// on top of the ledger, nothing reaches the ledger before the update is
+// committed.
+type ledgerTx struct {
+	l        *Ledger
+	balances map[account]orderbook.Amount
+	// holds are the holds changed, nil for the ones released
+	holds    map[int64]*Hold
+	entries  []*Entry
+	followed map[Market]uint64
+	closed   map[Market]bool
+	// ref is the ref of the next entry posted
+	ref string
+}
+
+// update runs fn on a new transaction and commits what it staged: the
+// changes are journaled when the ledger is durable, then applied all at
+// once. Nothing changes when fn or the journal fails. An update that only
+// follows markets is not journaled, the next record carries how far it
+// followed them.
+func (l *Ledger) update(fn func(tx *ledgerTx) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tx := &ledgerTx{
+		l:        l,
+		balances: make(map[account]orderbook.Amount),
+		holds:    make(map[int64]*Hold),
+		followed: make(map[Market]uint64),
+		closed:   make(map[Market]bool),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	rec := tx.record()
+	if len(rec.Entries) == 0 && len(rec.Holds) == 0 && len(rec.Released) == 0 && len(rec.Closed) == 0 {
+		l.apply(rec)
+		return nil
+	}
+	if l.journal != nil {
+		payload, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err := l.journal.Append(payload); err != nil {
+			return fmt.Errorf("journaling the ledger: %w", err)
+		}
+	}
+	l.apply(rec)
+	return nil
+}
+
+// record returns the changes tx staged, holds in order id order.
+func (tx *ledgerTx) record() *ledgerRecord {
+	rec := &ledgerRecord{Entries: tx.entries, Holds: []*Hold{}, Released: []int64{}}
+	if len(tx.l.followed) > 0 || len(tx.followed) > 0 {
+		rec.Followed = make(map[Market]uint64)
+		for market := range tx.l.followed {
+			if !tx.closed[market] {
+				rec.Followed[market] = tx.following(market)
+			}
+		}
+		for market := range tx.followed {
+			rec.Followed[market] = tx.following(market)
+		}
+	}
+	for market := range tx.closed {
+		rec.Closed = append(rec.Closed, market)
+	}
+	sort.Slice(rec.Closed, func(i, j int) bool { return rec.Closed[i] < rec.Closed[j] })
+	for orderId, h := range tx.holds {
+		if h == nil {
+			rec.Released = append(rec.Released, orderId)
+		} else {
+			rec.Holds = append(rec.Holds, h)
+		}
+	}
+	sort.Slice(rec.Holds, func(i, j int) bool { return rec.Holds[i].OrderId < rec.Holds[j].OrderId })
+	sort.Slice(rec.Released, func(i, j int) bool { return rec.Released[i] < rec.Released[j] })
+	return rec
+}
+
+// apply makes the changes of rec to the ledger. l.mu must be held or the
+// ledger not shared yet.
+func (l *Ledger) apply(rec *ledgerRecord) {
+	for _, entry := range rec.Entries {
+		for _, p := range entry.Postings {
+			acc := account{userId: p.UserId, asset: p.Asset, held: p.Held}
+			l.balances[acc] = l.balances[acc].Add(p.Amount)
+		}
+		if entry.Ref != "" {
+			l.refs[entry.Ref] = true
+		}
+		l.entries = append(l.entries, entry)
+	}
+	for _, h := range rec.Holds {
+		copied := *h
+		l.holds[h.OrderId] = &copied
+	}
+	for _, orderId := range rec.Released {
+		delete(l.holds, orderId)
+	}
+	for _, market := range rec.Closed {
+		delete(l.followed, market)
+	}
+	for market, seq := range rec.Followed {
+		l.followed[market] = max(l.followed[market], seq)
+	}
+}
+
+// following returns the sequence number of the last event of market
+// followed, staged or not.
+func (tx *ledgerTx) following(market Market) uint64 {
+	if seq, ok := tx.followed[market]; ok {
+		return seq
+	}
+	if tx.closed[market] {
+		return 0
+	}
+	return tx.l.followed[market]
+}
+
+// unfollow forgets how far market was followed.
+func (tx *ledgerTx) unfollow(market Market) {
+	delete(tx.followed, market)
+	if _, ok := tx.l.followed[market]; ok {
+		tx.closed[market] = true
+	}
+}
+
+// follow marks the events of market up to seq as followed.
+func (tx *ledgerTx) follow(market Market, seq uint64) {
+	if seq > tx.following(market) {
+		tx.followed[market] = seq
+	}
+}
+
+func (tx *ledgerTx) balance(acc account) orderbook.Amount {
+	if balance, ok := tx.balances[acc]; ok {
+		return balance
+	}
+	return tx.l.balances[acc]
+}
+
+// peekHold returns the hold of an order as staged, it must not be changed.
+func (tx *ledgerTx) peekHold(orderId int64) (*Hold, bool) {
+	if h, ok := tx.holds[orderId]; ok {
+		return h, h != nil
+	}
+	h, ok := tx.l.holds[orderId]
+	return h, ok
+}
+
+// holdOf returns the hold of an order for tx to change.
+func (tx *ledgerTx) holdOf(orderId int64) (*Hold, bool) {
+	if h, ok := tx.holds[orderId]; ok {
+		return h, h != nil
+	}
+	h, ok := tx.l.holds[orderId]
+	if !ok {
+		return nil, false
+	}
+	copied := *h
+	tx.holds[orderId] = &copied
+	return &copied, true
+}
+
+// holdIds returns the orders with a hold, in order id order.
+func (tx *ledgerTx) holdIds() []int64 {
+	ids := []int64{}
+	for orderId := range tx.l.holds {
+		if _, staged := tx.holds[orderId]; !staged {
+			ids = append(ids, orderId)
+		}
+	}
+	for orderId, h := range tx.holds {
+		if h != nil {
+			ids = append(ids, orderId)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// post stages the postings as one entry. It fails when they do not balance
+// or would take a user balance below zero.
+func (tx *ledgerTx) post(memo string, postings ...Posting) error {
+	sums := make(map[Asset]orderbook.Amount)
+	updated := make(map[account]orderbook.Amount)
+	for _, p := range postings {
+		sums[p.Asset] = sums[p.Asset].Add(p.Amount)
+
+		acc := account{userId: p.UserId, asset: p.Asset, held: p.Held}
+		balance, ok := updated[acc]
+		if !ok {
+			balance = tx.balance(acc)
+		}
+		updated[acc] = balance.Add(p.Amount)
+	}
+	for asset, sum := range sums {
+		if !sum.IsZero() {
+			return fmt.Errorf("unbalanced entry %q: %s is off by %s", memo, asset, sum)
+		}
+	}
+	for acc, balance := range updated {
+		if acc.userId != externalUser && balance.Sign() < 0 {
+			return fmt.Errorf("%w: user %d has %s %s", ErrInsufficientFunds, acc.userId, tx.balance(acc), acc.asset)
+		}
+	}
+
+	for acc, balance := range updated {
+		tx.balances[acc] = balance
+	}
+	tx.entries = append(tx.entries, &Entry{
+		Id:       int64(len(tx.l.entries) + len(tx.entries) + 1),
+		Memo:     memo,
+		Ref:      tx.ref,
+		Postings: postings,
+	})
+	tx.ref = ""
+	return nil
+}
+
+// Deposit credits amount of asset to the user.
+func (l *Ledger) Deposit(userId int64, asset Asset, amount orderbook.Amount) error {
+	return l.update(func(tx *ledgerTx) error {
+		return tx.transfer(externalUser, userId, asset, amount, "deposit")
+	})
+}
+
+// Credit credits amount of asset to the user for the deposit booked under
+// ref.
+func (l *Ledger) Credit(ref string, userId int64, asset Asset, amount orderbook.Amount) error {
+	return l.update(func(tx *ledgerTx) error {
+		if err := tx.book(ref); err != nil {
+			return err
+		}
+		return tx.transfer(externalUser, userId, asset, amount, "deposit")
+	})
+}
+
+// Withdraw debits amount of asset from the available balance of the user
+// for the withdrawal booked under ref.
+func (l *Ledger) Withdraw(ref string, userId int64, asset Asset, amount orderbook.Amount) error {
+	return l.update(func(tx *ledgerTx) error {
+		if err := tx.book(ref); err != nil {
+			return err
+		}
+		return tx.transfer(userId, externalUser, asset, amount, "withdrawal")
+	})
+}
+
+// ReverseWithdrawal credits back a withdrawal that never left the exchange,
+// booked under ref.
+func (l *Ledger) ReverseWithdrawal(ref string, userId int64, asset Asset, amount orderbook.Amount) error {
+	return l.update(func(tx *ledgerTx) error {
+		if err := tx.book(ref); err != nil {
+			return err
+		}
+		return tx.transfer(externalUser, userId, asset, amount, "reversed withdrawal")
+	})
+}
+
+// Booked reports whether the event named ref is booked.
+func (l *Ledger) Booked(ref string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.refs[ref]
+}
+
+// book makes ref the ref of the next entry tx posts.
+func (tx *ledgerTx) book(ref string) error {
+	if tx.l.refs[ref] {
+		return fmt.Errorf("%w: %s", ErrBooked, ref)
+	}
+	for _, entry := range tx.entries {
+		if entry.Ref == ref {
+			return fmt.Errorf("%w: %s", ErrBooked, ref)
+		}
+	}
+	tx.ref = ref
+	return nil
+}
+
+func (tx *ledgerTx) transfer(from, to int64, asset Asset, amount orderbook.Amount, memo string) error {
+	if amount.Sign() <= 0 {
+		return ErrInvalidAmount
+	}
+	return tx.post(memo,
+		Posting{UserId: from, Asset: asset, Amount: amount.Neg()},
+		Posting{UserId: to, Asset: asset, Amount: amount},
+	)
+}
+
+// Balance returns what the user owns of asset.
+func (l *Ledger) Balance(userId int64, asset Asset) Balance {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.balance(userId, asset)
+}
+
+func (l *Ledger) balance(userId int64, asset Asset) Balance {
+	return Balance{
+		Asset:     asset,
+		Available: l.balances[account{userId: userId, asset: asset}],
+		Held:      l.balances[account{userId: userId, asset: asset, held: true}],
+	}
+}
+
+// Balances returns every balance the user has, by asset.
+func (l *Ledger) Balances(userId int64) []Balance {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	assets := []Asset{}
+	for acc := range l.balances {
+		if acc.userId == userId && !acc.held {
+			assets = append(assets, acc.asset)
+		}
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i] < assets[j] })
+
+	balances := make([]Balance, 0, len(assets))
+	for _, asset := range assets {
+		balances = append(balances, l.balance(userId, asset))
+	}
+	return balances
+}
+
+// Owed returns what the users have of asset, held or available, which is
+// what the exchange owes them.
+func (l *Ledger) Owed(asset Asset) orderbook.Amount {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	owed := orderbook.Amount{}
+	for acc, balance := range l.balances {
+		if acc.asset == asset && acc.userId != externalUser {
+			owed = owed.Add(balance)
+		}
+	}
+	return owed
+}
+
+// Entries returns the entries posted so far, oldest first.
+func (l *Ledger) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]Entry, len(l.entries))
+	for i, entry := range l.entries {
+		entries[i] = *entry
+	}
+	return entries
+}
+
+// Hold sets h.Amount aside for the order of h, adding to what the order
+// already holds, and records what the order may still trade.
+func (l *Ledger) Hold(h Hold) error {
+	return l.update(func(tx *ledgerTx) error {
+		return tx.hold(h)
+	})
+}
+
+// HoldAvailable sets everything the user of h has available of h.Asset
+// aside for the order and returns how much that is.
+func (l *Ledger) HoldAvailable(h Hold) (orderbook.Amount, error) {
+	err := l.update(func(tx *ledgerTx) error {
+		h.Amount = tx.balance(account{userId: h.UserId, asset: h.Asset})
+		if h.Amount.Sign() <= 0 {
+			return fmt.Errorf("%w: user %d has no %s available", ErrInsufficientFunds, h.UserId, h.Asset)
+		}
+		return tx.hold(h)
+	})
+	if err != nil {
+		return orderbook.Amount{}, err
+	}
+	return h.Amount, nil
+}
+
+func (tx *ledgerTx) hold(h Hold) error {
+	if h.Amount.Sign() < 0 {
+		return ErrInvalidAmount
+	}
+	if !h.Amount.IsZero() {
+		err := tx.post(fmt.Sprintf("hold for order %d", h.OrderId),
+			Posting{UserId: h.UserId, Asset: h.Asset, Amount: h.Amount.Neg()},
+			Posting{UserId: h.UserId, Asset: h.Asset, Held: true, Amount: h.Amount},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if held, ok := tx.holdOf(h.OrderId); ok {
+		held.Amount = held.Amount.Add(h.Amount)
+		held.Size = h.Size
+		return nil
+	}
+	tx.holds[h.OrderId] = &h
+	return nil
+}
+
+// Holds returns the holds of the open orders of the user in market.
+func (l *Ledger) Holds(userId int64, market Market) []Hold {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	holds := []Hold{}
+	for _, h := range l.holds {
+		if h.UserId == userId && h.Market == market {
+			holds = append(holds, *h)
+		}
+	}
+	sort.Slice(holds, func(i, j int) bool { return holds[i].OrderId < holds[j].OrderId })
+	return holds
+}
+
+// Held returns what is set aside for an order.
+func (l *Ledger) Held(orderId int64) orderbook.Amount {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if h, ok := l.holds[orderId]; ok {
+		return h.Amount
+	}
+	return orderbook.Amount{}
+}
+
+// ResizeHold sets what is held for an order to amount, holding more or
+// releasing the difference, and what the order may still trade to size.
+func (l *Ledger) ResizeHold(orderId int64, amount, size orderbook.Amount) error {
+	return l.update(func(tx *ledgerTx) error {
+		return tx.resizeHold(orderId, amount, size)
+	})
+}
+
+func (tx *ledgerTx) resizeHold(orderId int64, amount, size orderbook.Amount) error {
+	h, ok := tx.holdOf(orderId)
+	if !ok {
+		return nil
+	}
+	if amount.GreaterThan(h.Amount) {
+		more := *h
+		more.Amount = amount.Sub(h.Amount)
+		more.Size = size
+		return tx.hold(more)
+	}
+	h.Size = size
+	return tx.unhold(h, h.Amount.Sub(amount))
+}
+
+// Release gives back what is left of the hold of a closed order.
+func (l *Ledger) Release(orderId int64) error {
+	return l.update(func(tx *ledgerTx) error {
+		return tx.release(orderId)
+	})
+}
+
+func (tx *ledgerTx) release(orderId int64) error {
+	h, ok := tx.holdOf(orderId)
+	if !ok {
+		return nil
+	}
+	if err := tx.unhold(h, h.Amount); err != nil {
+		return err
+	}
+	tx.holds[orderId] = nil
+	return nil
+}
+
+// ReleaseClosed releases the holds of every order of market that open
+// reports closed.
+func (l *Ledger) ReleaseClosed(market Market, open func(orderId int64) bool) error {
+	return l.update(func(tx *ledgerTx) error {
+		return tx.releaseClosed(market, open)
+	})
+}
+
+func (tx *ledgerTx) releaseClosed(market Market, open func(orderId int64) bool) error {
+	for _, orderId := range tx.holdIds() {
+		if h, _ := tx.peekHold(orderId); h.Market != market || open(orderId) {
+			continue
+		}
+		if err := tx.release(orderId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CloseMarket releases the holds of every order of market and forgets how
+// far the ledger followed it, for a market whose book is gone. A market
+// opened again under the same name numbers its events from the start.
+func (l *Ledger) CloseMarket(market Market) error {
+	return l.update(func(tx *ledgerTx) error {
+		if err := tx.releaseClosed(market, func(int64) bool { return false }); err != nil {
+			return err
+		}
+		tx.unfollow(market)
+		return nil
+	})
+}
+
+// Markets returns the markets the ledger holds funds for or followed.
+func (l *Ledger) Markets() []Market {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seen := make(map[Market]bool)
+	for market := range l.followed {
+		seen[market] = true
+	}
+	for _, h := range l.holds {
+		seen[h.Market] = true
+	}
+	markets := make([]Market, 0, len(seen))
+	for market := range seen {
+		markets = append(markets, market)
+	}
+	sort.Slice(markets, func(i, j int) bool { return markets[i] < markets[j] })
+	return markets
+}
+
+func (tx *ledgerTx) unhold(h *Hold, amount orderbook.Amount) error {
+	if amount.IsZero() {
+		return nil
+	}
+	err := tx.post(fmt.Sprintf("release for order %d", h.OrderId),
+		Posting{UserId: h.UserId, Asset: h.Asset, Held: true, Amount: amount.Neg()},
+		Posting{UserId: h.UserId, Asset: h.Asset, Amount: amount},
+	)
+	if err != nil {
+		return err
+	}
+	h.Amount = h.Amount.Sub(amount)
+	return nil
+}
+
+// Settle moves the base and the quote legs of a match between buyer and
+// seller in one entry. Each side pays from the hold of its order, or from
+// its available balance when the order holds nothing. A match of a user
+// with themselves moves nothing. seq is the sequence number of the matched
+// event of the fill, fills are settled in sequence order and one the
+// ledger followed already is skipped.
+func (l *Ledger) Settle(spec *MarketSpec, seq uint64, match orderbook.Match) error {
+	return l.update(func(tx *ledgerTx) error {
+		return tx.settle(spec, seq, match)
+	})
+}
+
+func (tx *ledgerTx) settle(spec *MarketSpec, seq uint64, match orderbook.Match) error {
+	if seq <= tx.following(spec.Market) {
+		return nil
+	}
+	tx.follow(spec.Market, seq)
+
+	buyer, seller := match.Bid.UserId, match.Ask.UserId
+	if buyer == seller {
+		return nil
+	}
+	base := match.SizeFilled
+	quote := match.Price.Mul(match.SizeFilled)
+
+	buyerHold, buyerHeld := tx.holdOf(match.Bid.Id)
+	sellerHold, sellerHeld := tx.holdOf(match.Ask.Id)
+
+	err := tx.post(fmt.Sprintf("%s trade of order %d with order %d", spec.Market, match.Bid.Id, match.Ask.Id),
+		Posting{UserId: buyer, Asset: spec.Quote.Asset, Held: buyerHeld, Amount: quote.Neg()},
+		Posting{UserId: seller, Asset: spec.Quote.Asset, Amount: quote},
+		Posting{UserId: seller, Asset: spec.Base.Asset, Held: sellerHeld, Amount: base.Neg()},
+		Posting{UserId: buyer, Asset: spec.Base.Asset, Amount: base},
+	)
+	if err != nil {
+		return err
+	}
+	if buyerHeld {
+		buyerHold.Amount = buyerHold.Amount.Sub(quote)
+		buyerHold.Size = buyerHold.Size.Sub(base)
+	}
+	if sellerHeld {
+		sellerHold.Amount = sellerHold.Amount.Sub(base)
+		sellerHold.Size = sellerHold.Size.Sub(base)
+	}
+	return nil
+}
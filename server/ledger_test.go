@@ -0,0 +1,255 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/stretchr/testify/assert"
+)
+
+// fund registers every user and deposits 10 ETH and 10,000 USDC for them.
+func fund(t *testing.T, ex *Exchange, userIds ...int64) {
+	for _, userId := range userIds {
+		ex.AddUser(&User{Id: userId})
+		assert.Nil(t, ex.ledger.Deposit(userId, AssetETH, orderbook.AmountFromInt(10)))
+		assert.Nil(t, ex.ledger.Deposit(userId, AssetUSDC, orderbook.AmountFromInt(10_000)))
+	}
+}
+
+func assertBalanced(t *testing.T, l *Ledger) {
+	sums := map[Asset]orderbook.Amount{}
+	for acc, balance := range l.balances {
+		sums[acc.asset] = sums[acc.asset].Add(balance)
+	}
+	for asset, sum := range sums {
+		assert.True(t, sum.IsZero(), "%s sums to %s", asset, sum)
+	}
+}
+
+func balance(available, held string) Balance {
+	return Balance{
+		Available: orderbook.MustParseAmount(available),
+		Held:      orderbook.MustParseAmount(held),
+	}
+}
+
+func assertBalance(t *testing.T, l *Ledger, userId int64, asset Asset, want Balance) {
+	want.Asset = asset
+	assert.Equal(t, l.Balance(userId, asset), want, "%s of user %d", asset, userId)
+}
+
+func TestLedgerTransfers(t *testing.T) {
+	l := NewLedger()
+
+	assert.Nil(t, l.Deposit(1, AssetETH, orderbook.AmountFromInt(3)))
+	assert.True(t, errors.Is(l.Withdraw("withdrawal 1", 1, AssetETH, orderbook.AmountFromInt(4)), ErrInsufficientFunds))
+	assert.Equal(t, l.Withdraw("withdrawal 1", 1, AssetETH, orderbook.Amount{}), ErrInvalidAmount)
+	assert.Nil(t, l.Withdraw("withdrawal 1", 1, AssetETH, orderbook.AmountFromInt(1)))
+	assertBalance(t, l, 1, AssetETH, balance("2", "0"))
+	// an event is booked once
+	assert.ErrorIs(t, l.Withdraw("withdrawal 1", 1, AssetETH, orderbook.AmountFromInt(1)), ErrBooked)
+	assert.True(t, l.Booked("withdrawal 1"))
+	assert.False(t, l.Booked("withdrawal 2"))
+
+	// a failed hold changes nothing
+	h := Hold{OrderId: 7, UserId: 1, Market: MarketETHUSDC, Asset: AssetETH, Amount: orderbook.AmountFromInt(3)}
+	assert.True(t, errors.Is(l.Hold(h), ErrInsufficientFunds))
+	h.Amount = orderbook.AmountFromInt(2)
+	assert.Nil(t, l.Hold(h))
+	assertBalance(t, l, 1, AssetETH, balance("0", "2"))
+	assert.Nil(t, l.Release(7))
+	assertBalance(t, l, 1, AssetETH, balance("2", "0"))
+
+	assert.Equal(t, len(l.Entries()), 4)
+	for _, entry := range l.Entries() {
+		sum := orderbook.Amount{}
+		for _, posting := range entry.Postings {
+			sum = sum.Add(posting.Amount)
+		}
+		assert.True(t, sum.IsZero(), entry.Memo)
+	}
+	assertBalanced(t, l)
+}
+
+func TestLedgerSettlesFillsOnce(t *testing.T) {
+	l := NewLedger()
+	assert.Nil(t, l.Deposit(1, AssetUSDC, orderbook.AmountFromInt(1000)))
+	assert.Nil(t, l.Deposit(2, AssetETH, orderbook.AmountFromInt(1)))
+	match := orderbook.Match{
+		Bid:        &orderbook.Order{Id: 1, UserId: 1, Bid: true},
+		Ask:        &orderbook.Order{Id: 2, UserId: 2},
+		Price:      orderbook.AmountFromInt(100),
+		SizeFilled: orderbook.AmountFromInt(1),
+	}
+
+	assert.Nil(t, l.Settle(ETHUSDCSpec, 7, match))
+	assert.Nil(t, l.Settle(ETHUSDCSpec, 7, match))
+	assertBalance(t, l, 1, AssetETH, balance("1", "0"))
+	assertBalance(t, l, 2, AssetUSDC, balance("100", "0"))
+	assert.Equal(t, l.Owed(AssetUSDC), orderbook.AmountFromInt(1000))
+
+	// the same sequence number of another market is another fill
+	assert.NotNil(t, l.Settle(WBTCETHSpec, 7, match))
+	assertBalanced(t, l)
+}
+
+func TestLedgerReplaysItsJournal(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLedger(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, l.Deposit(1, AssetUSDC, orderbook.AmountFromInt(1000)))
+	assert.Nil(t, l.Deposit(2, AssetETH, orderbook.AmountFromInt(3)))
+	assert.Nil(t, l.Hold(Hold{OrderId: 1, UserId: 1, Market: MarketETHUSDC, Bid: true, Size: orderbook.AmountFromInt(2), Asset: AssetUSDC, Amount: orderbook.AmountFromInt(200)}))
+	assert.Nil(t, l.Hold(Hold{OrderId: 2, UserId: 2, Market: MarketETHUSDC, Size: orderbook.AmountFromInt(3), Asset: AssetETH, Amount: orderbook.AmountFromInt(3)}))
+	assert.Nil(t, l.Settle(ETHUSDCSpec, 1, orderbook.Match{
+		Bid:        &orderbook.Order{Id: 1, UserId: 1, Bid: true},
+		Ask:        &orderbook.Order{Id: 2, UserId: 2},
+		Price:      orderbook.AmountFromInt(100),
+		SizeFilled: orderbook.AmountFromInt(1),
+	}))
+	assert.Nil(t, l.Release(2))
+	// failed updates are not journaled
+	assert.ErrorIs(t, l.Withdraw("withdrawal 1", 2, AssetETH, orderbook.AmountFromInt(5)), ErrInsufficientFunds)
+	assert.Nil(t, l.Close())
+
+	replayed, err := OpenLedger(dir)
+	assert.Nil(t, err)
+	defer replayed.Close()
+	assert.Equal(t, replayed.balances, l.balances)
+	assert.Equal(t, replayed.holds, l.holds)
+	assert.Equal(t, replayed.followed, map[Market]uint64{MarketETHUSDC: 1})
+	assert.Equal(t, replayed.Entries(), l.Entries())
+	assertBalance(t, replayed, 1, AssetUSDC, balance("800", "100"))
+	assertBalance(t, replayed, 2, AssetETH, balance("2", "0"))
+	assert.Equal(t, replayed.Holds(1, MarketETHUSDC)[0].Size, orderbook.AmountFromInt(1))
+	assertBalanced(t, replayed)
+
+	// it keeps journaling
+	assert.Nil(t, replayed.Deposit(3, AssetWBTC, orderbook.AmountFromInt(1)))
+	assert.Equal(t, replayed.Entries()[len(replayed.Entries())-1].Id, int64(len(l.Entries())+1))
+}
+
+func TestExchangeSettlesTrades(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1, 2)
+	ob, _ := ex.orderbook(MarketETHUSDC)
+
+	ask := ob.NewOrder(false, orderbook.AmountFromInt(2), 1)
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ask)
+	assert.Nil(t, err)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("8", "2"))
+
+	// the bid holds 3 at 101 and pays 2 at 100
+	bid := ob.NewOrder(true, orderbook.AmountFromInt(3), 2)
+	matches, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(101), bid)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("8", "0"))
+	assertBalance(t, ex.ledger, 1, AssetUSDC, balance("10200", "0"))
+	assertBalance(t, ex.ledger, 2, AssetETH, balance("12", "0"))
+	assertBalance(t, ex.ledger, 2, AssetUSDC, balance("9697", "103"))
+
+	// cancelling the rest gives back the whole hold
+	res := ex.submit(MarketETHUSDC, orderbook.Command{Type: orderbook.CommandCancel, OrderId: bid.Id})
+	assert.Nil(t, res.Err)
+	assertBalance(t, ex.ledger, 2, AssetUSDC, balance("9800", "0"))
+	assertBalanced(t, ex.ledger)
+}
+
+func TestExchangeMarketBuySpendsOnlyItsHold(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1)
+	ex.AddUser(&User{Id: 2})
+	assert.Nil(t, ex.ledger.Deposit(2, AssetUSDC, orderbook.AmountFromInt(250)))
+	ob, _ := ex.orderbook(MarketETHUSDC)
+
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(false, orderbook.AmountFromInt(5), 1))
+	assert.Nil(t, err)
+
+	buy := ob.NewOrder(true, orderbook.AmountFromInt(5), 2)
+	matches, _, err := ex.handlePlaceMarketOrder(MarketETHUSDC, buy)
+	assert.Nil(t, err)
+	assert.Equal(t, matches[0].SizeFilled, orderbook.MustParseAmount("2.5"))
+	assertBalance(t, ex.ledger, 2, AssetETH, balance("2.5", "0"))
+	assertBalance(t, ex.ledger, 2, AssetUSDC, balance("0", "0"))
+
+	// nothing left to spend
+	_, _, err = ex.handlePlaceMarketOrder(MarketETHUSDC, ob.NewOrder(true, orderbook.AmountFromInt(1), 2))
+	assert.Equal(t, errorCode(err), ErrCodeInsufficientFunds)
+	assertBalanced(t, ex.ledger)
+}
+
+func TestExchangeRejectsOrdersItCanNotHold(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1)
+	ob, _ := ex.orderbook(MarketETHUSDC)
+
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(true, orderbook.AmountFromInt(101), 1))
+	assert.Equal(t, errorCode(err), ErrCodeInsufficientFunds)
+	assert.Equal(t, ob.OrderCount(), 0)
+
+	// an amend that needs more than there is leaves the order alone
+	bid := ob.NewOrder(true, orderbook.AmountFromInt(50), 1)
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), bid)
+	assert.Nil(t, err)
+	res := ex.submit(MarketETHUSDC, orderbook.Command{Type: orderbook.CommandAmend, OrderId: bid.Id, Size: orderbook.AmountFromInt(200)})
+	assert.Equal(t, errorCode(res.Err), ErrCodeInsufficientFunds)
+	assertBalance(t, ex.ledger, 1, AssetUSDC, balance("5000", "5000"))
+
+	// a smaller amend gives back what it no longer needs
+	res = ex.submit(MarketETHUSDC, orderbook.Command{Type: orderbook.CommandAmend, OrderId: bid.Id, Size: orderbook.AmountFromInt(20)})
+	assert.Nil(t, res.Err)
+	assertBalance(t, ex.ledger, 1, AssetUSDC, balance("8000", "2000"))
+	assertBalanced(t, ex.ledger)
+}
+
+func TestExchangeNeverSettlesSelfTrades(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1)
+	ob, _ := ex.orderbook(MarketETHUSDC)
+
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(false, orderbook.AmountFromInt(1), 1))
+	assert.Nil(t, err)
+	// self-trades are allowed on this order, the book matches it
+	matches, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(true, orderbook.AmountFromInt(1), 1))
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("10", "0"))
+	assertBalance(t, ex.ledger, 1, AssetUSDC, balance("10000", "0"))
+	assertBalanced(t, ex.ledger)
+}
+
+func TestExchangeHaltsMarketTheLedgerCanNotSettle(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1, 2)
+	ob, _ := ex.orderbook(MarketETHUSDC)
+
+	ask := ob.NewOrder(false, orderbook.AmountFromInt(2), 1)
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ask)
+	assert.Nil(t, err)
+	// the hold of the ask is lost and its ETH withdrawn
+	assert.Nil(t, ex.ledger.Release(ask.Id))
+	assert.Nil(t, ex.ledger.Withdraw("withdrawal 1", 1, AssetETH, orderbook.AmountFromInt(10)))
+
+	bid := ob.NewOrder(true, orderbook.AmountFromInt(1), 2)
+	matches, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), bid)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+
+	// nothing of the fill settled, and the market stops until an admin
+	// resumes it
+	assert.Equal(t, ex.state(MarketETHUSDC), MarketHalted)
+	assertBalance(t, ex.ledger, 2, AssetETH, balance("10", "0"))
+	assertBalance(t, ex.ledger, 2, AssetUSDC, balance("9900", "100"))
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(true, orderbook.AmountFromInt(1), 2))
+	assert.Equal(t, errorCode(err), ErrCodeMarketHalted)
+	assertBalanced(t, ex.ledger)
+}
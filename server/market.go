@@ -0,0 +1,258 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+// AssetSpec describes an asset the exchange trades.
+type AssetSpec struct {
+	Asset Asset
+	// Decimals is how many decimals the smallest unit of the asset has on
+	// chain, 18 for wei.
+	Decimals uint8
+}
+
+var (
+	ETH  = AssetSpec{Asset: AssetETH, Decimals: 18}
+	USDC = AssetSpec{Asset: AssetUSDC, Decimals: 6}
+	WBTC = AssetSpec{Asset: AssetWBTC, Decimals: 8}
+)
+
+// Pair returns the name of the market trading base for quote, e.g. ETH-USDC.
+func Pair(base, quote Asset) Market {
+	return Market(string(base) + "-" + string(quote))
+}
+
+// MarketSpec holds the trading rules of a market. Zero limits are not
+// enforced.
+type MarketSpec struct {
+	Market Market
+	// Base is the asset traded, Quote the asset prices are in. Sizes are in
+	// Base, prices and notionals in Quote.
+	Base  AssetSpec
+	Quote AssetSpec
+
+	// TickSize is the price increment, LotSize the size increment.
+	TickSize orderbook.Amount
+	LotSize  orderbook.Amount
+
+	MinSize     orderbook.Amount
+	MaxSize     orderbook.Amount
+	MinNotional orderbook.Amount
+
+	// MinPrice and MaxPrice band the prices orders may be placed at.
+	MinPrice orderbook.Amount
+	MaxPrice orderbook.Amount
+
+	// MaxOpenOrders is the most orders a user may have open at once.
+	// MaxPosition is the most of the base asset a user may own once all
+	// their open buys fill.
+	MaxOpenOrders int
+	MaxPosition   orderbook.Amount
+}
+
+var (
+	// ETHUSDCSpec is the spec of the ETH-USDC market, ETH priced in USDC.
+	ETHUSDCSpec = &MarketSpec{
+		Market:      MarketETHUSDC,
+		Base:        ETH,
+		Quote:       USDC,
+		TickSize:    orderbook.MustParseAmount("0.01"),
+		LotSize:     orderbook.MustParseAmount("0.0001"),
+		MinSize:     orderbook.MustParseAmount("0.001"),
+		MaxSize:     orderbook.AmountFromInt(10_000),
+		MinNotional: orderbook.AmountFromInt(1),
+		MinPrice:    orderbook.MustParseAmount("0.01"),
+		MaxPrice:    orderbook.AmountFromInt(1_000_000),
+
+		MaxOpenOrders: 200,
+		MaxPosition:   orderbook.AmountFromInt(100_000),
+	}
+
+	// WBTCETHSpec is the spec of the WBTC-ETH market, WBTC priced in ETH.
+	WBTCETHSpec = &MarketSpec{
+		Market:      MarketWBTCETH,
+		Base:        WBTC,
+		Quote:       ETH,
+		TickSize:    orderbook.MustParseAmount("0.00001"),
+		LotSize:     orderbook.MustParseAmount("0.0001"),
+		MinSize:     orderbook.MustParseAmount("0.0001"),
+		MaxSize:     orderbook.AmountFromInt(1_000),
+		MinNotional: orderbook.MustParseAmount("0.001"),
+		MinPrice:    orderbook.MustParseAmount("0.00001"),
+		MaxPrice:    orderbook.AmountFromInt(10_000),
+
+		MaxOpenOrders: 200,
+		MaxPosition:   orderbook.AmountFromInt(1_000),
+	}
+
+	// DefaultMarkets are the markets every exchange opens with.
+	DefaultMarkets = []*MarketSpec{ETHUSDCSpec, WBTCETHSpec}
+)
+
+// Check makes sure the spec describes a market that can settle: it is named
+// after its pair, and every size and notional the book can produce is a
+// whole number of the smallest unit of its asset on chain.
+func (spec *MarketSpec) Check() error {
+	if spec.Base.Asset == "" || spec.Quote.Asset == "" || spec.Base.Asset == spec.Quote.Asset {
+		return fmt.Errorf("market %s needs two different assets", spec.Market)
+	}
+	if want := Pair(spec.Base.Asset, spec.Quote.Asset); spec.Market != want {
+		return fmt.Errorf("market %s trades %s for %s and should be named %s", spec.Market, spec.Base.Asset, spec.Quote.Asset, want)
+	}
+	if spec.TickSize.Sign() <= 0 || spec.LotSize.Sign() <= 0 {
+		return fmt.Errorf("market %s needs a positive tick and lot size", spec.Market)
+	}
+	if spec.LotSize.Scale() > spec.Base.Decimals {
+		return fmt.Errorf("market %s: lot size %s is finer than the %d decimals of %s", spec.Market, spec.LotSize, spec.Base.Decimals, spec.Base.Asset)
+	}
+	// a fill moves price * size of the quote asset
+	if spec.TickSize.Scale()+spec.LotSize.Scale() > spec.Quote.Decimals {
+		return fmt.Errorf("market %s: notionals of tick %s and lot %s are finer than the %d decimals of %s", spec.Market, spec.TickSize, spec.LotSize, spec.Quote.Decimals, spec.Quote.Asset)
+	}
+	return nil
+}
+
+// NewOrderbook returns an empty orderbook that enforces the spec's tick and
+// lot precision.
+func (spec *MarketSpec) NewOrderbook() *orderbook.Orderbook {
+	ob := orderbook.NewOrderbook()
+	ob.TickSize = spec.TickSize
+	ob.PriceDecimals = spec.TickSize.Scale()
+	ob.SizeDecimals = spec.LotSize.Scale()
+	return ob
+}
+
+// Validate checks an order request against the spec before it reaches the
+// orderbook.
+func (spec *MarketSpec) Validate(req *PlaceOrderRequest) *OrderError {
+	if req.Size.Sign() <= 0 {
+		return newOrderError(ErrCodeInvalidSize, "size must be positive")
+	}
+	if err := spec.validateSize("size", req.Size); err != nil {
+		return err
+	}
+	if spec.MaxSize.Sign() > 0 && req.Size.GreaterThan(spec.MaxSize) {
+		return newOrderError(ErrCodeSizeAboveMax, "size %s is above the maximum %s", req.Size, spec.MaxSize)
+	}
+	if req.DisplaySize.Sign() != 0 {
+		if err := spec.validateSize("display size", req.DisplaySize); err != nil {
+			return err
+		}
+	}
+
+	switch req.Type {
+	case LIMITORDER:
+		return spec.validateLimitPrice(req)
+	case MARKETORDER:
+		return nil
+	case STOPMARKETORDER:
+		return spec.validatePrice("stop price", req.StopPrice)
+	case STOPLIMITORDER:
+		if err := spec.validatePrice("stop price", req.StopPrice); err != nil {
+			return err
+		}
+		return spec.validateLimitPrice(req)
+	}
+	return newOrderError(ErrCodeInvalidRequest, "unknown order type %q", req.Type)
+}
+
+// ValidateAmend checks the new price and size of a resting order against
+// the spec. Zero values keep those of the order.
+func (spec *MarketSpec) ValidateAmend(order *orderbook.Order, req *AmendOrderRequest) *OrderError {
+	if req.Price.Sign() < 0 || req.Size.Sign() < 0 {
+		return newOrderError(ErrCodeInvalidRequest, "amended price and size must be positive")
+	}
+
+	price := order.Limit.Price
+	if req.Price.Sign() > 0 {
+		if err := spec.validatePrice("price", req.Price); err != nil {
+			return err
+		}
+		price = req.Price
+	}
+	size := order.Size.Add(order.Hidden)
+	if req.Size.Sign() > 0 {
+		if err := spec.validateSize("size", req.Size); err != nil {
+			return err
+		}
+		if spec.MaxSize.Sign() > 0 && req.Size.GreaterThan(spec.MaxSize) {
+			return newOrderError(ErrCodeSizeAboveMax, "size %s is above the maximum %s", req.Size, spec.MaxSize)
+		}
+		size = req.Size
+	}
+
+	notional := price.Mul(size)
+	if spec.MinNotional.Sign() > 0 && notional.LessThan(spec.MinNotional) {
+		return newOrderError(ErrCodeNotionalBelowMin, "notional %s is below the minimum %s", notional, spec.MinNotional)
+	}
+	return nil
+}
+
+func (spec *MarketSpec) validateSize(name string, size orderbook.Amount) *OrderError {
+	if size.Sign() <= 0 {
+		return newOrderError(ErrCodeInvalidSize, "%s must be positive", name)
+	}
+	if spec.MinSize.Sign() > 0 && size.LessThan(spec.MinSize) {
+		return newOrderError(ErrCodeSizeBelowMin, "%s %s is below the minimum %s", name, size, spec.MinSize)
+	}
+	if !isMultiple(size, spec.LotSize) {
+		return newOrderError(ErrCodeInvalidLotSize, "%s %s is not a multiple of the lot size %s", name, size, spec.LotSize)
+	}
+	return nil
+}
+
+func (spec *MarketSpec) validateLimitPrice(req *PlaceOrderRequest) *OrderError {
+	if err := spec.validatePrice("price", req.Price); err != nil {
+		return err
+	}
+	notional := req.Price.Mul(req.Size)
+	if spec.MinNotional.Sign() > 0 && notional.LessThan(spec.MinNotional) {
+		return newOrderError(ErrCodeNotionalBelowMin, "notional %s is below the minimum %s", notional, spec.MinNotional)
+	}
+	return nil
+}
+
+func (spec *MarketSpec) validatePrice(name string, price orderbook.Amount) *OrderError {
+	if price.Sign() <= 0 {
+		return newOrderError(ErrCodeInvalidPrice, "%s must be positive", name)
+	}
+	if !isMultiple(price, spec.TickSize) {
+		return newOrderError(ErrCodeInvalidTickSize, "%s %s is not a multiple of the tick size %s", name, price, spec.TickSize)
+	}
+	if spec.MinPrice.Sign() > 0 && price.LessThan(spec.MinPrice) ||
+		spec.MaxPrice.Sign() > 0 && price.GreaterThan(spec.MaxPrice) {
+		return newOrderError(ErrCodePriceOutOfBand, "%s %s is outside the band [%s, %s]", name, price, spec.MinPrice, spec.MaxPrice)
+	}
+	return nil
+}
+
+// isMultiple reports whether a is a whole multiple of step. A zero step
+// allows anything.
+func isMultiple(a, step orderbook.Amount) bool {
+	if step.Sign() <= 0 {
+		return true
+	}
+	return a.Div(step, 0).Mul(step).Equal(a)
+}
+
+func (ex *Exchange) handleGetMarkets(c echo.Context) error {
+	markets := []*MarketResponse{}
+	for _, spec := range ex.specs() {
+		markets = append(markets, &MarketResponse{MarketSpec: spec, State: ex.state(spec.Market)})
+	}
+	return c.JSON(http.StatusOK, markets)
+}
+
+func (ex *Exchange) handleGetMarket(c echo.Context) error {
+	market := Market(c.Param("market"))
+	spec, ok := ex.market(market)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]any{"message": "Market not found"})
+	}
+	return c.JSON(http.StatusOK, &MarketResponse{MarketSpec: spec, State: ex.state(market)})
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarketSpecCheck(t *testing.T) {
+	for _, spec := range DefaultMarkets {
+		assert.Nil(t, spec.Check(), spec.Market)
+	}
+
+	misnamed := *WBTCETHSpec
+	misnamed.Market = "WBTC"
+	assert.NotNil(t, misnamed.Check())
+
+	// prices in cents of sizes in ten thousandths of an ETH need 6 decimals
+	coarse := *ETHUSDCSpec
+	coarse.LotSize = orderbook.MustParseAmount("0.00001")
+	assert.NotNil(t, coarse.Check())
+
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	assert.NotNil(t, ex.AddMarket(&coarse))
+}
+
+func TestMarketSpecValidate(t *testing.T) {
+	amount := orderbook.MustParseAmount
+	banded := *ETHUSDCSpec
+	banded.MinPrice = amount("1000")
+	unlimited := &MarketSpec{TickSize: amount("0.01"), LotSize: amount("0.0001")}
+
+	tests := []struct {
+		name string
+		spec *MarketSpec
+		req  PlaceOrderRequest
+		code ErrorCode // empty when the order is valid
+	}{
+		{"limit", ETHUSDCSpec, PlaceOrderRequest{Type: LIMITORDER, Size: amount("1.5"), Price: amount("2000.01")}, ""},
+		{"market", ETHUSDCSpec, PlaceOrderRequest{Type: MARKETORDER, Size: amount("1")}, ""},
+		{"iceberg", ETHUSDCSpec, PlaceOrderRequest{Type: LIMITORDER, Size: amount("10"), Price: amount("2000"), DisplaySize: amount("1")}, ""},
+		{"zero limits are not enforced", unlimited, PlaceOrderRequest{Type: LIMITORDER, Size: amount("1000000"), Price: amount("0.01")}, ""},
+		{"zero size", ETHUSDCSpec, PlaceOrderRequest{Type: MARKETORDER}, ErrCodeInvalidSize},
+		{"negative size", ETHUSDCSpec, PlaceOrderRequest{Type: MARKETORDER, Size: amount("-1")}, ErrCodeInvalidSize},
+		{"size below min", ETHUSDCSpec, PlaceOrderRequest{Type: MARKETORDER, Size: amount("0.0009")}, ErrCodeSizeBelowMin},
+		{"size above max", ETHUSDCSpec, PlaceOrderRequest{Type: MARKETORDER, Size: amount("10000.0001")}, ErrCodeSizeAboveMax},
+		{"size off lot", ETHUSDCSpec, PlaceOrderRequest{Type: MARKETORDER, Size: amount("1.00005")}, ErrCodeInvalidLotSize},
+		{"display size off lot", ETHUSDCSpec, PlaceOrderRequest{Type: LIMITORDER, Size: amount("10"), Price: amount("2000"), DisplaySize: amount("1.00005")}, ErrCodeInvalidLotSize},
+		{"display size below min", ETHUSDCSpec, PlaceOrderRequest{Type: LIMITORDER, Size: amount("10"), Price: amount("2000"), DisplaySize: amount("0.0001")}, ErrCodeSizeBelowMin},
+		{"zero price", ETHUSDCSpec, PlaceOrderRequest{Type: LIMITORDER, Size: amount("1")}, ErrCodeInvalidPrice},
+		{"negative price", ETHUSDCSpec, PlaceOrderRequest{Type: LIMITORDER, Size: amount("1"), Price: amount("-2000")}, ErrCodeInvalidPrice},
+		{"price off tick", ETHUSDCSpec, PlaceOrderRequest{Type: LIMITORDER, Size: amount("1"), Price: amount("2000.005")}, ErrCodeInvalidTickSize},
+		{"price above band", ETHUSDCSpec, PlaceOrderRequest{Type: LIMITORDER, Size: amount("1"), Price: amount("1000000.01")}, ErrCodePriceOutOfBand},
+		{"price below band", &banded, PlaceOrderRequest{Type: LIMITORDER, Size: amount("1"), Price: amount("999.99")}, ErrCodePriceOutOfBand},
+		{"notional below min", ETHUSDCSpec, PlaceOrderRequest{Type: LIMITORDER, Size: amount("0.001"), Price: amount("999.99")}, ErrCodeNotionalBelowMin},
+		{"stop market", ETHUSDCSpec, PlaceOrderRequest{Type: STOPMARKETORDER, Size: amount("1"), StopPrice: amount("1900")}, ""},
+		{"stop market without stop price", ETHUSDCSpec, PlaceOrderRequest{Type: STOPMARKETORDER, Size: amount("1")}, ErrCodeInvalidPrice},
+		{"stop limit", ETHUSDCSpec, PlaceOrderRequest{Type: STOPLIMITORDER, Size: amount("1"), StopPrice: amount("1900"), Price: amount("1890")}, ""},
+		{"stop limit stop price off tick", ETHUSDCSpec, PlaceOrderRequest{Type: STOPLIMITORDER, Size: amount("1"), StopPrice: amount("1900.001"), Price: amount("1890")}, ErrCodeInvalidTickSize},
+		{"stop limit price above band", ETHUSDCSpec, PlaceOrderRequest{Type: STOPLIMITORDER, Size: amount("1"), StopPrice: amount("1900"), Price: amount("2000000")}, ErrCodePriceOutOfBand},
+		{"unknown type", ETHUSDCSpec, PlaceOrderRequest{Type: "TRAILING_STOP", Size: amount("1")}, ErrCodeInvalidRequest},
+	}
+	for _, test := range tests {
+		err := test.spec.Validate(&test.req)
+		if test.code == "" {
+			assert.Nil(t, err, test.name)
+			continue
+		}
+		if assert.NotNil(t, err, test.name) {
+			assert.Equal(t, err.Code, test.code, test.name)
+		}
+	}
+}
+
+func TestExchangeSettlesPairsInTheirAssets(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1, 2)
+	assert.Nil(t, ex.ledger.Deposit(1, AssetWBTC, orderbook.AmountFromInt(1)))
+	ob, _ := ex.orderbook(MarketWBTCETH)
+
+	ask := ob.NewOrder(false, orderbook.MustParseAmount("0.5"), 1)
+	_, err := ex.handlePlaceLimitOrder(MarketWBTCETH, orderbook.MustParseAmount("15.5"), ask)
+	assert.Nil(t, err)
+	bid := ob.NewOrder(true, orderbook.MustParseAmount("0.2"), 2)
+	matches, err := ex.handlePlaceLimitOrder(MarketWBTCETH, orderbook.MustParseAmount("15.5"), bid)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+
+	// WBTC is paid for in ETH, USDC is left alone
+	assertBalance(t, ex.ledger, 1, AssetWBTC, balance("0.5", "0.3"))
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("13.1", "0"))
+	assertBalance(t, ex.ledger, 2, AssetWBTC, balance("0.2", "0"))
+	assertBalance(t, ex.ledger, 2, AssetETH, balance("6.9", "0"))
+	assertBalance(t, ex.ledger, 2, AssetUSDC, balance("10000", "0"))
+	assertBalanced(t, ex.ledger)
+
+	// the order is cancelled in the market it rests in
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodDelete, "/", nil), rec)
+	c.SetParamNames("orderID")
+	c.SetParamValues(strconv.FormatInt(ask.Id, 10))
+	assert.Nil(t, ex.handleCancelOrder(c))
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, ob.OrderCount(), 0)
+	assertBalance(t, ex.ledger, 1, AssetWBTC, balance("0.8", "0"))
+}
+
+func TestHandleGetMarkets(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/markets", nil), rec)
+	assert.Nil(t, ex.handleGetMarkets(c))
+
+	markets := []*MarketSpec{}
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&markets))
+	assert.Equal(t, len(markets), 2)
+	assert.Equal(t, markets[0].Market, MarketETHUSDC)
+	assert.Equal(t, markets[1].Market, MarketWBTCETH)
+	assert.Equal(t, markets[1].Base, WBTC)
+	assert.Equal(t, markets[1].Quote, ETH)
+}
+
+func TestHandleGetMarket(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+
+	get := func(market string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/markets/"+market, nil), rec)
+		c.SetParamNames("market")
+		c.SetParamValues(market)
+		assert.Nil(t, ex.handleGetMarket(c))
+		return rec
+	}
+
+	rec := get(string(MarketETHUSDC))
+	assert.Equal(t, rec.Code, http.StatusOK)
+	var resp MarketResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, resp.State, MarketOpen)
+	assert.Equal(t, resp.Market, MarketETHUSDC)
+	assert.Equal(t, resp.TickSize, ETHUSDCSpec.TickSize)
+	assert.Equal(t, resp.LotSize, ETHUSDCSpec.LotSize)
+	assert.Equal(t, resp.MinSize, ETHUSDCSpec.MinSize)
+	assert.Equal(t, resp.MaxSize, ETHUSDCSpec.MaxSize)
+	assert.Equal(t, resp.MinNotional, ETHUSDCSpec.MinNotional)
+	assert.Equal(t, resp.MinPrice, ETHUSDCSpec.MinPrice)
+	assert.Equal(t, resp.MaxPrice, ETHUSDCSpec.MaxPrice)
+
+	assert.Equal(t, get("DOGE-USDC").Code, http.StatusNotFound)
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	// feeBump is how much more, in percent, a replacement pays than the
+	// transaction it replaces. Nodes want at least 10% more.
+	feeBump = 10
+	// defaultStuckAfter is how long a transaction may wait to be mined
+	// before it is replaced with one paying more
+	defaultStuckAfter = 2 * time.Minute
+)
+
+// NonceManager signs and sends transactions, handing out the nonces of each
+// sender itself so transactions sent at the same time from one key do not
+// take the same nonce. It pays EIP-1559 fees when the chain has a base fee,
+// signs for the chain ID of the node and, in Check, looks after the
+// transactions that are not mined yet.
+type NonceManager struct {
+	client ChainBackend
+	// StuckAfter is how long a transaction may wait to be mined before
+	// Check replaces it, zero never replaces
+	StuckAfter time.Duration
+
+	mu       sync.Mutex
+	chainID  *big.Int
+	accounts map[common.Address]*nonceAccount
+	// replacedBy maps each replaced transaction to the one replacing it
+	replacedBy map[common.Hash]common.Hash
+}
+
+// nonceAccount is a sender. Its mu is held while one of its transactions is
+// signed and sent, so its nonces reach the node in order.
+type nonceAccount struct {
+	mu      sync.Mutex
+	key     *ecdsa.PrivateKey
+	address common.Address
+	synced  bool
+	next    uint64
+	// sent are the transactions sent that are not mined yet, by nonce
+	sent map[uint64]*sentTx
+}
+
+type sentTx struct {
+	tx     *types.Transaction // the last one sent for the nonce
+	sentAt time.Time
+}
+
+func NewNonceManager(client ChainBackend) *NonceManager {
+	return &NonceManager{
+		client:     client,
+		StuckAfter: defaultStuckAfter,
+		accounts:   make(map[common.Address]*nonceAccount),
+		replacedBy: make(map[common.Hash]common.Hash),
+	}
+}
+
+// ChainID returns the chain ID of the node, asking it only once.
+func (m *NonceManager) ChainID() (*big.Int, error) {
+	if m.client == nil {
+		return nil, ErrNoChain
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.chainID == nil {
+		chainID, err := m.client.ChainID(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("reading the chain ID: %w", err)
+		}
+		m.chainID = chainID
+	}
+	return m.chainID, nil
+}
+
+func (m *NonceManager) account(key *ecdsa.PrivateKey) *nonceAccount {
+	address := crypto.PubkeyToAddress(key.PublicKey)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.accounts[address]
+	if !ok {
+		a = &nonceAccount{key: key, address: address, sent: make(map[uint64]*sentTx)}
+		m.accounts[address] = a
+	}
+	return a
+}
+
+// Send signs and sends a transaction from the owner of key. A zero gasLimit
+// is estimated, which also catches calls that would revert. When sending
+// fails the nonce is handed out again, the transaction is returned as
+// signed anyway.
+func (m *NonceManager) Send(key *ecdsa.PrivateKey, to common.Address, value *big.Int, data []byte, gasLimit uint64) (*types.Transaction, error) {
+	chainID, err := m.ChainID()
+	if err != nil {
+		return nil, err
+	}
+	a := m.account(key)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if gasLimit == 0 {
+		gasLimit, err = m.client.EstimateGas(context.Background(), ethereum.CallMsg{
+			From:  a.address,
+			To:    &to,
+			Value: value,
+			Data:  data,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("estimating gas: %w", err)
+		}
+	}
+	if !a.synced {
+		if err := m.sync(a); err != nil {
+			return nil, err
+		}
+	}
+
+	for resynced := false; ; resynced = true {
+		tx, err := m.newTx(chainID, a, a.next, to, value, data, gasLimit, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = m.client.SendTransaction(context.Background(), tx)
+		if err == nil || isTxError(err, "already known") {
+			a.sent[a.next] = &sentTx{tx: tx, sentAt: time.Now()}
+			a.next++
+			return tx, nil
+		}
+		// the key sent transactions the manager did not see
+		if !resynced && isTxError(err, "nonce too low") {
+			if err := m.sync(a); err != nil {
+				return tx, err
+			}
+			continue
+		}
+		return tx, err
+	}
+}
+
+// sync takes the next nonce of a from the node.
+func (m *NonceManager) sync(a *nonceAccount) error {
+	nonce, err := m.client.PendingNonceAt(context.Background(), a.address)
+	if err != nil {
+		return err
+	}
+	a.next, a.synced = max(a.next, nonce), true
+	return nil
+}
+
+// newTx signs a transaction paying the fees the node suggests now. A
+// replacement of prev pays at least feeBump percent more than prev.
+func (m *NonceManager) newTx(chainID *big.Int, a *nonceAccount, nonce uint64, to common.Address, value *big.Int, data []byte, gasLimit uint64, prev *types.Transaction) (*types.Transaction, error) {
+	head, err := m.client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var tx *types.Transaction
+	if head.BaseFee == nil {
+		gasPrice, err := m.client.SuggestGasPrice(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil {
+			gasPrice = maxBig(gasPrice, bump(prev.GasPrice()))
+		}
+		tx = types.NewTx(&types.LegacyTx{
+			Nonce:    nonce,
+			GasPrice: gasPrice,
+			Gas:      gasLimit,
+			To:       &to,
+			Value:    value,
+			Data:     data,
+		})
+	} else {
+		tip, err := m.client.SuggestGasTipCap(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil {
+			tip = maxBig(tip, bump(prev.GasTipCap()))
+		}
+		// room for the base fee to double before the transaction is
+		// priced out
+		feeCap := new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), tip)
+		if prev != nil {
+			feeCap = maxBig(feeCap, bump(prev.GasFeeCap()))
+		}
+		tx = types.NewTx(&types.DynamicFeeTx{
+			ChainID:   chainID,
+			Nonce:     nonce,
+			GasTipCap: tip,
+			GasFeeCap: feeCap,
+			Gas:       gasLimit,
+			To:        &to,
+			Value:     value,
+			Data:      data,
+		})
+	}
+	return types.SignTx(tx, types.LatestSignerForChainID(chainID), a.key)
+}
+
+// Run checks the transactions sent on each tick of interval.
+func (m *NonceManager) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		<-ticker.C
+
+		if err := m.Check(); err != nil {
+			fmt.Printf("checking sent transactions failed: %s\n", err)
+		}
+	}
+}
+
+// Check looks after the transactions sent that are not mined yet. It
+// forgets the mined ones, sends the ones the node dropped again, fills the
+// gaps of nonces handed out that never reached the node, since every later
+// transaction waits on them, and replaces the ones waiting longer than
+// StuckAfter with ones paying more.
+func (m *NonceManager) Check() error {
+	if m.client == nil {
+		return ErrNoChain
+	}
+	chainID, err := m.ChainID()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	accounts := make([]*nonceAccount, 0, len(m.accounts))
+	for _, a := range m.accounts {
+		accounts = append(accounts, a)
+	}
+	m.mu.Unlock()
+
+	for _, a := range accounts {
+		if err := m.check(chainID, a); err != nil {
+			return fmt.Errorf("checking the transactions of %s: %w", a.address, err)
+		}
+	}
+	return nil
+}
+
+func (m *NonceManager) check(chainID *big.Int, a *nonceAccount) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	mined, err := m.client.NonceAt(context.Background(), a.address, nil)
+	if err != nil {
+		return err
+	}
+	for nonce := range a.sent {
+		if nonce < mined {
+			delete(a.sent, nonce)
+		}
+	}
+	a.next = max(a.next, mined)
+
+	for nonce := mined; nonce < a.next; nonce++ {
+		s, ok := a.sent[nonce]
+		if !ok {
+			// nothing to replace, an empty transfer to itself takes the nonce
+			tx, err := m.newTx(chainID, a, nonce, a.address, new(big.Int), nil, 21000, nil)
+			if err != nil {
+				return err
+			}
+			if err := m.client.SendTransaction(context.Background(), tx); err != nil {
+				return fmt.Errorf("filling the gap at nonce %d: %w", nonce, err)
+			}
+			a.sent[nonce] = &sentTx{tx: tx, sentAt: time.Now()}
+			continue
+		}
+
+		_, _, err := m.client.TransactionByHash(context.Background(), s.tx.Hash())
+		if errors.Is(err, ethereum.NotFound) {
+			if err := m.client.SendTransaction(context.Background(), s.tx); err != nil && !isTxError(err, "already known") {
+				fmt.Printf("sending dropped transaction %s again failed: %s\n", s.tx.Hash(), err)
+			}
+			continue
+		}
+		if err != nil || m.StuckAfter == 0 || time.Since(s.sentAt) < m.StuckAfter {
+			continue
+		}
+		if err := m.replace(chainID, a, s); err != nil {
+			fmt.Printf("replacing stuck transaction %s failed: %s\n", s.tx.Hash(), err)
+		}
+	}
+	return nil
+}
+
+// replace sends the transaction of s again with higher fees.
+func (m *NonceManager) replace(chainID *big.Int, a *nonceAccount, s *sentTx) error {
+	old := s.tx
+	tx, err := m.newTx(chainID, a, old.Nonce(), *old.To(), old.Value(), old.Data(), old.Gas(), old)
+	if err != nil {
+		return err
+	}
+	if err := m.client.SendTransaction(context.Background(), tx); err != nil {
+		return err
+	}
+	s.tx, s.sentAt = tx, time.Now()
+
+	m.mu.Lock()
+	m.replacedBy[old.Hash()] = tx.Hash()
+	m.mu.Unlock()
+	return nil
+}
+
+// Hashes returns hash and the hashes of the transactions that replaced it,
+// any of them may be the one mined.
+func (m *NonceManager) Hashes(hash common.Hash) []common.Hash {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hashes := []common.Hash{hash}
+	for next, ok := m.replacedBy[hash]; ok; next, ok = m.replacedBy[next] {
+		hashes = append(hashes, next)
+	}
+	return hashes
+}
+
+// isTxError tells if err, as the node reported it, is the one with msg.
+// Errors lose their type over RPC.
+func isTxError(err error, msg string) bool {
+	return strings.Contains(err.Error(), msg)
+}
+
+// bump returns fee raised by feeBump percent, rounded up.
+func bump(fee *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(fee, big.NewInt(100+feeBump))
+	bumped.Add(bumped, big.NewInt(99))
+	return bumped.Div(bumped, big.NewInt(100))
+}
+
+func maxBig(a, b *big.Int) *big.Int {
+	if a.Cmp(b) >= 0 {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNonceManagerSendsConcurrently(t *testing.T) {
+	senderKey, sender := newKey(t)
+	_, receiver := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		sender: {Balance: big.NewInt(1e18)},
+	})
+	defer backend.Close()
+	client := backend.Client()
+	nonces := NewNonceManager(client)
+
+	var wg sync.WaitGroup
+	txs := make([]*types.Transaction, 10)
+	for i := range txs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx, err := nonces.Send(senderKey, receiver, big.NewInt(1000), nil, 21000)
+			assert.Nil(t, err)
+			txs[i] = tx
+		}()
+	}
+	wg.Wait()
+	backend.Commit()
+
+	seen := map[uint64]bool{}
+	for _, tx := range txs {
+		assert.False(t, seen[tx.Nonce()])
+		seen[tx.Nonce()] = true
+		assert.Equal(t, tx.Type(), uint8(types.DynamicFeeTxType))
+		assert.Equal(t, tx.ChainId().Int64(), int64(1337))
+	}
+	received, err := client.BalanceAt(context.Background(), receiver, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, received.Int64(), int64(10_000))
+}
+
+func TestNonceManagerFollowsOtherSenders(t *testing.T) {
+	senderKey, sender := newKey(t)
+	_, receiver := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		sender: {Balance: big.NewInt(1e18)},
+	})
+	defer backend.Close()
+	client := backend.Client()
+	nonces := NewNonceManager(client)
+
+	_, err := nonces.Send(senderKey, receiver, big.NewInt(1), nil, 21000)
+	assert.Nil(t, err)
+	backend.Commit()
+	// the key is used behind the manager's back
+	_, err = NewNonceManager(client).Send(senderKey, receiver, big.NewInt(1), nil, 21000)
+	assert.Nil(t, err)
+	backend.Commit()
+
+	tx, err := nonces.Send(senderKey, receiver, big.NewInt(1), nil, 21000)
+	assert.Nil(t, err)
+	assert.Equal(t, tx.Nonce(), uint64(2))
+}
+
+func TestNonceManagerReplacesStuckTransactions(t *testing.T) {
+	senderKey, sender := newKey(t)
+	_, receiver := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		sender: {Balance: big.NewInt(1e18)},
+	})
+	defer backend.Close()
+	client := backend.Client()
+	nonces := NewNonceManager(client)
+
+	stuck, err := nonces.Send(senderKey, receiver, big.NewInt(1), nil, 21000)
+	assert.Nil(t, err)
+	assert.Nil(t, nonces.Check())
+	assert.Equal(t, len(nonces.Hashes(stuck.Hash())), 1, "not stuck for long yet")
+
+	nonces.StuckAfter = time.Nanosecond
+	assert.Nil(t, nonces.Check())
+	hashes := nonces.Hashes(stuck.Hash())
+	assert.Equal(t, len(hashes), 2)
+	replacement, _, err := client.TransactionByHash(context.Background(), hashes[1])
+	assert.Nil(t, err)
+	assert.Equal(t, replacement.Nonce(), stuck.Nonce())
+	assert.Equal(t, replacement.GasTipCap(), bump(stuck.GasTipCap()))
+	assert.True(t, replacement.GasFeeCap().Cmp(bump(stuck.GasFeeCap())) >= 0)
+
+	backend.Commit()
+	receipt, err := client.TransactionReceipt(context.Background(), hashes[1])
+	assert.Nil(t, err)
+	assert.Equal(t, receipt.Status, types.ReceiptStatusSuccessful)
+	assert.Nil(t, nonces.Check())
+	assert.Equal(t, len(nonces.account(senderKey).sent), 0)
+}
+
+func TestNonceManagerFillsGaps(t *testing.T) {
+	senderKey, sender := newKey(t)
+	_, receiver := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		sender: {Balance: big.NewInt(1e18)},
+	})
+	defer backend.Close()
+	client := backend.Client()
+	nonces := NewNonceManager(client)
+
+	_, err := nonces.Send(senderKey, receiver, big.NewInt(1), nil, 21000)
+	assert.Nil(t, err)
+	backend.Commit()
+	// nonce 1 is handed out but never sent, nonce 2 waits on it
+	nonces.account(senderKey).next++
+	waiting, err := nonces.Send(senderKey, receiver, big.NewInt(1), nil, 21000)
+	assert.Nil(t, err)
+	assert.Equal(t, waiting.Nonce(), uint64(2))
+
+	assert.Nil(t, nonces.Check())
+	backend.Commit()
+	receipt, err := client.TransactionReceipt(context.Background(), waiting.Hash())
+	assert.Nil(t, err)
+	assert.Equal(t, receipt.Status, types.ReceiptStatusSuccessful)
+	mined, err := client.NonceAt(context.Background(), sender, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, mined, uint64(3))
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+)
+
+type DiscrepancyKind string
+
+const (
+	// DiscrepancyShortfall is flagged when the exchange holds less of an
+	// asset on chain than it owes its users and the withdrawals in flight
+	DiscrepancyShortfall DiscrepancyKind = "SHORTFALL"
+	// DiscrepancyWithdrawalMissing is flagged for a confirmed withdrawal
+	// whose transaction is no longer on chain, or reverted
+	DiscrepancyWithdrawalMissing DiscrepancyKind = "WITHDRAWAL_MISSING"
+	// DiscrepancyDepositMissing is flagged for a credited deposit whose
+	// transaction is no longer on chain, or reverted
+	DiscrepancyDepositMissing DiscrepancyKind = "DEPOSIT_MISSING"
+)
+
+type (
+	// AssetReconciliation compares what the ledger expects of an asset with
+	// what is on chain.
+	AssetReconciliation struct {
+		Asset Asset
+		// Owed is what the users have in the ledger
+		Owed orderbook.Amount
+		// InFlight is what was debited for withdrawals that did not leave
+		// the hot wallet yet
+		InFlight orderbook.Amount
+		// OnChain is what the hot wallet and the deposit addresses hold.
+		// It may be more than Owed and InFlight, the exchange pays gas from
+		// its own funds and deposits are only owed once confirmed.
+		OnChain orderbook.Amount
+	}
+
+	Discrepancy struct {
+		Kind   DiscrepancyKind
+		Asset  Asset
+		UserId int64       // the user of a missing deposit or withdrawal
+		TxHash common.Hash // the transaction of a missing deposit or withdrawal
+		Detail string
+	}
+
+	ReconciliationReport struct {
+		Time          int64 // unix nano
+		Block         uint64
+		Assets        []AssetReconciliation
+		Discrepancies []Discrepancy
+	}
+)
+
+// Reconciler compares the ledger with the chain: the assets settled on
+// chain against what the users are owed, and the deposits credited and
+// withdrawals confirmed in the last reorgWindow blocks against their
+// transactions. Older deposits and withdrawals are taken as final.
+type Reconciler struct {
+	ex          *Exchange
+	client      ChainBackend
+	deposits    *DepositWatcher
+	withdrawals *WithdrawalQueue
+
+	mu   sync.Mutex
+	last *ReconciliationReport
+}
+
+func NewReconciler(ex *Exchange, deposits *DepositWatcher, withdrawals *WithdrawalQueue) *Reconciler {
+	return &Reconciler{
+		ex:          ex,
+		client:      ex.client,
+		deposits:    deposits,
+		withdrawals: withdrawals,
+	}
+}
+
+// Run reconciles on each tick of interval.
+func (r *Reconciler) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		<-ticker.C
+
+		report, err := r.Reconcile()
+		if err != nil {
+			fmt.Printf("reconciling failed: %s\n", err)
+			continue
+		}
+		for _, d := range report.Discrepancies {
+			fmt.Printf("reconciliation found %s of %s: %s\n", d.Kind, d.Asset, d.Detail)
+		}
+	}
+}
+
+// Report returns the report of the last reconciliation.
+func (r *Reconciler) Report() (*ReconciliationReport, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.last, r.last != nil
+}
+
+// Reconcile compares the ledger with the chain at its head now.
+func (r *Reconciler) Reconcile() (*ReconciliationReport, error) {
+	if r.client == nil {
+		return nil, ErrNoChain
+	}
+	head, err := r.client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	report := &ReconciliationReport{
+		Time:          time.Now().UnixNano(),
+		Block:         head.Number.Uint64(),
+		Assets:        []AssetReconciliation{},
+		Discrepancies: []Discrepancy{},
+	}
+	withdrawals := r.withdrawals.all()
+
+	if err := r.reconcileAssets(report, withdrawals); err != nil {
+		return nil, err
+	}
+	recent := func(block uint64) bool {
+		return block+reorgWindow > report.Block
+	}
+	for _, w := range withdrawals {
+		if w.Status != WithdrawalConfirmed || !recent(w.Block) {
+			continue
+		}
+		if err := r.checkTransaction(report, DiscrepancyWithdrawalMissing, w.Asset, w.UserId, w.TxHash, fmt.Sprintf("withdrawal %d of %s", w.Id, w.Amount)); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range r.deposits.all() {
+		if d.Status != DepositCredited || !recent(d.Block) {
+			continue
+		}
+		if err := r.checkTransaction(report, DiscrepancyDepositMissing, d.Asset, d.UserId, d.TxHash, fmt.Sprintf("deposit of %s", d.Amount)); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.Lock()
+	r.last = report
+	r.mu.Unlock()
+	return report, nil
+}
+
+// reconcileAssets adds the assets settled on chain to report, flagging the
+// ones the exchange holds too little of.
+func (r *Reconciler) reconcileAssets(report *ReconciliationReport, withdrawals []Withdrawal) error {
+	inFlight := make(map[Asset]orderbook.Amount)
+	for _, w := range withdrawals {
+		switch w.Status {
+		case WithdrawalAwaitingApproval, WithdrawalPending, WithdrawalBroadcast:
+			inFlight[w.Asset] = inFlight[w.Asset].Add(w.Amount)
+		}
+	}
+	holders := append([]common.Address{crypto.PubkeyToAddress(r.ex.PrivateKey.PublicKey)}, r.ex.allDepositAddresses()...)
+
+	tokens := r.ex.tokensByAddress()
+	assets := make([]Asset, 0, len(tokens)+1)
+	byAsset := make(map[Asset]*Token, len(tokens))
+	assets = append(assets, AssetETH)
+	for _, token := range tokens {
+		assets = append(assets, token.Asset.Asset)
+		byAsset[token.Asset.Asset] = token
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i] < assets[j] })
+
+	for _, asset := range assets {
+		onChain := orderbook.Amount{}
+		for _, holder := range holders {
+			var (
+				held orderbook.Amount
+				err  error
+			)
+			if asset == AssetETH {
+				var wei *big.Int
+				wei, err = r.client.BalanceAt(context.Background(), holder, nil)
+				if err == nil {
+					held, err = FromBaseUnits(wei, ETH.Decimals)
+				}
+			} else {
+				held, err = byAsset[asset].BalanceOf(r.client, holder)
+			}
+			if err != nil {
+				return fmt.Errorf("reading the %s of %s: %w", asset, holder, err)
+			}
+			onChain = onChain.Add(held)
+		}
+
+		rec := AssetReconciliation{
+			Asset:    asset,
+			Owed:     r.ex.ledger.Owed(asset),
+			InFlight: inFlight[asset],
+			OnChain:  onChain,
+		}
+		report.Assets = append(report.Assets, rec)
+		if expected := rec.Owed.Add(rec.InFlight); expected.GreaterThan(onChain) {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Kind:   DiscrepancyShortfall,
+				Asset:  asset,
+				Detail: fmt.Sprintf("%s on chain, %s owed and %s in flight", onChain, rec.Owed, rec.InFlight),
+			})
+		}
+	}
+	return nil
+}
+
+// checkTransaction flags a deposit or withdrawal whose transaction is not
+// on chain or reverted.
+func (r *Reconciler) checkTransaction(report *ReconciliationReport, kind DiscrepancyKind, asset Asset, userId int64, hash common.Hash, what string) error {
+	receipt, err := r.client.TransactionReceipt(context.Background(), hash)
+	if err != nil && !errors.Is(err, ethereum.NotFound) {
+		return err
+	}
+	detail := ""
+	switch {
+	case err != nil:
+		detail = fmt.Sprintf("%s of user %d is not on chain", what, userId)
+	case receipt.Status != types.ReceiptStatusSuccessful:
+		detail = fmt.Sprintf("%s of user %d reverted", what, userId)
+	default:
+		return nil
+	}
+	report.Discrepancies = append(report.Discrepancies, Discrepancy{
+		Kind:   kind,
+		Asset:  asset,
+		UserId: userId,
+		TxHash: hash,
+		Detail: detail,
+	})
+	return nil
+}
+
+// handleGetReconciliation returns the last report, reconciling first when
+// there is none yet.
+func (r *Reconciler) handleGetReconciliation(c echo.Context) error {
+	report, ok := r.Report()
+	if !ok {
+		var err error
+		if report, err = r.Reconcile(); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+	}
+	return c.JSON(http.StatusOK, report)
+}
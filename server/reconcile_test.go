@@ -0,0 +1,77 @@
+package server
+
+import (
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcilerFlagsDiscrepancies(t *testing.T) {
+	exchangeKey, err := crypto.HexToECDSA(exchangePrivateKey)
+	assert.Nil(t, err)
+	senderKey, sender := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		crypto.PubkeyToAddress(exchangeKey.PublicKey): {Balance: big.NewInt(1e18)},
+		sender:           {Balance: new(big.Int).Mul(big.NewInt(10), big.NewInt(1e18))},
+		testTokenAddress: testToken(6, map[common.Address]*big.Int{sender: big.NewInt(1_000_000_000)}),
+	})
+	defer backend.Close()
+
+	ex := NewExchange("", backend.Client())
+	defer ex.Close()
+	ex.AddUser(&User{Id: 1, PrivateKey: senderKey})
+	assert.Nil(t, ex.RegisterToken(USDC, testTokenAddress))
+	token, _ := ex.token(AssetUSDC)
+	deposits := NewDepositWatcher(ex, 1)
+	withdrawals := NewWithdrawalQueue(ex, 1)
+	r := NewReconciler(ex, deposits, withdrawals)
+
+	assert.Nil(t, TransferETH(ex.nonces, senderKey, ex.DepositAddress(1).Hex(), orderbook.AmountFromInt(2)))
+	_, err = token.Transfer(ex.nonces, senderKey, ex.DepositAddress(1), orderbook.AmountFromInt(300))
+	assert.Nil(t, err)
+	backend.Commit()
+	assert.Nil(t, deposits.Poll())
+	_, err = withdrawals.Request(&WithdrawalRequest{UserId: 1, Asset: AssetUSDC, Amount: orderbook.AmountFromInt(100)})
+	assert.Nil(t, err)
+
+	report, err := r.Reconcile()
+	assert.Nil(t, err)
+	assert.Empty(t, report.Discrepancies)
+	assert.Equal(t, len(report.Assets), 2)
+	usdc := report.Assets[1]
+	assert.Equal(t, usdc.Asset, AssetUSDC)
+	assert.Equal(t, usdc.Owed, orderbook.AmountFromInt(200))
+	assert.Equal(t, usdc.InFlight, orderbook.AmountFromInt(100))
+	assert.Equal(t, usdc.OnChain, orderbook.AmountFromInt(300))
+
+	// credited without anything arriving on chain
+	assert.Nil(t, ex.ledger.Deposit(1, AssetUSDC, orderbook.AmountFromInt(1)))
+	// confirmed without a transaction
+	withdrawals.mu.Lock()
+	withdrawals.withdrawals[99] = &Withdrawal{Id: 99, UserId: 1, Asset: AssetETH, Amount: orderbook.AmountFromInt(1), Status: WithdrawalConfirmed, TxHash: common.HexToHash("0xbad"), Block: report.Block}
+	withdrawals.mu.Unlock()
+
+	report, err = r.Reconcile()
+	assert.Nil(t, err)
+	assert.Equal(t, len(report.Discrepancies), 2)
+	assert.Equal(t, report.Discrepancies[0].Kind, DiscrepancyShortfall)
+	assert.Equal(t, report.Discrepancies[0].Asset, AssetUSDC)
+	assert.Equal(t, report.Discrepancies[1].Kind, DiscrepancyWithdrawalMissing)
+	assert.Equal(t, report.Discrepancies[1].TxHash, common.HexToHash("0xbad"))
+
+	e := echo.New()
+	e.GET("/admin/reconciliation", r.handleGetReconciliation)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/reconciliation", nil))
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Contains(t, rec.Body.String(), `"Kind":"SHORTFALL"`)
+}
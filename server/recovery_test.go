@@ -0,0 +1,241 @@
+package server
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/stretchr/testify/assert"
+)
+
+func openOrderIds(ex *Exchange) map[int64][]int64 {
+	ids := map[int64][]int64{}
+	for userId, orders := range ex.Orders {
+		for _, order := range orders {
+			ids[userId] = append(ids[userId], order.Id)
+		}
+		sort.Slice(ids[userId], func(i, j int) bool { return ids[userId][i] < ids[userId][j] })
+	}
+	return ids
+}
+
+func TestExchangeRecoversMarket(t *testing.T) {
+	dir := t.TempDir()
+
+	ex := NewExchange("", nil)
+	assert.Nil(t, ex.RecoverLedger(filepath.Join(dir, ledgerDir)))
+	assert.Nil(t, ex.RecoverMarket(ETHUSDCSpec, filepath.Join(dir, string(MarketETHUSDC))))
+	fund(t, ex, 1, 2, 3, 4)
+
+	price := orderbook.MustParseAmount("100.5")
+	for userId := int64(1); userId <= 3; userId++ {
+		ask := orderbook.NewOrder(false, orderbook.AmountFromInt(userId), userId)
+		_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, price, ask)
+		assert.Nil(t, err)
+		bid := orderbook.NewOrder(true, orderbook.AmountFromInt(1), userId)
+		_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(99), bid)
+		assert.Nil(t, err)
+	}
+	stop := &orderbook.StopOrder{
+		Order:     orderbook.NewOrder(true, orderbook.AmountFromInt(1), 2),
+		StopPrice: orderbook.AmountFromInt(120),
+	}
+	_, err := ex.handlePlaceStopOrder(MarketETHUSDC, stop)
+	assert.Nil(t, err)
+
+	// the taker fills user 1 and part of user 2
+	taker := orderbook.NewOrder(true, orderbook.AmountFromInt(2), 4)
+	matches, _, err := ex.handlePlaceMarketOrder(MarketETHUSDC, taker)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 2)
+
+	ob, _ := ex.orderbook(MarketETHUSDC)
+	wantAsks, wantBids, wantTrades := ob.Asks(), ob.Bids(), ob.Trades()
+	wantOrders := openOrderIds(ex)
+	assert.Nil(t, ex.Close())
+
+	recovered := NewExchange("", nil)
+	assert.Nil(t, recovered.RecoverLedger(filepath.Join(dir, ledgerDir)))
+	assert.Nil(t, recovered.RecoverMarket(ETHUSDCSpec, filepath.Join(dir, string(MarketETHUSDC))))
+	defer recovered.Close()
+	assert.Equal(t, recovered.state(MarketETHUSDC), MarketOpen)
+
+	ob, _ = recovered.orderbook(MarketETHUSDC)
+	assert.Equal(t, ob.Asks(), wantAsks)
+	assert.Equal(t, ob.Bids(), wantBids)
+	assert.Equal(t, ob.Trades(), wantTrades)
+	assert.Equal(t, len(ob.Stops()), 1)
+	assert.Equal(t, openOrderIds(recovered), wantOrders)
+	assert.Equal(t, len(wantOrders[1]), 1)
+}
+
+func TestExchangeRecoversLedger(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Exchange {
+		ex := NewExchange("", nil)
+		assert.Nil(t, ex.RecoverLedger(filepath.Join(dir, ledgerDir)))
+		assert.Nil(t, ex.RecoverMarket(ETHUSDCSpec, filepath.Join(dir, string(MarketETHUSDC))))
+		return ex
+	}
+
+	ex := open()
+	fund(t, ex, 1, 2)
+	ask := orderbook.NewOrder(false, orderbook.AmountFromInt(2), 1)
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ask)
+	assert.Nil(t, err)
+	bid := orderbook.NewOrder(true, orderbook.AmountFromInt(1), 2)
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), bid)
+	assert.Nil(t, err)
+	assert.Nil(t, ex.Close())
+
+	// the rest of the ask is still held after a restart
+	recovered := open()
+	defer recovered.Close()
+	assertBalance(t, recovered.ledger, 1, AssetETH, balance("8", "1"))
+	assertBalance(t, recovered.ledger, 1, AssetUSDC, balance("10100", "0"))
+	assertBalance(t, recovered.ledger, 2, AssetETH, balance("11", "0"))
+	assert.Equal(t, recovered.ledger.Held(ask.Id), orderbook.AmountFromInt(1))
+
+	// and pays for its next fill
+	recovered.AddUser(&User{Id: 2})
+	bid = orderbook.NewOrder(true, orderbook.AmountFromInt(1), 2)
+	_, err = recovered.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), bid)
+	assert.Nil(t, err)
+	assert.Equal(t, recovered.state(MarketETHUSDC), MarketOpen)
+	assertBalance(t, recovered.ledger, 1, AssetETH, balance("8", "0"))
+	assertBalance(t, recovered.ledger, 2, AssetETH, balance("12", "0"))
+	assertBalanced(t, recovered.ledger)
+}
+
+func TestReplacedMarketReleasesHolds(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1, 2)
+
+	// replacing a market drops its book and the orders in it
+	ob, _ := ex.orderbook(MarketETHUSDC)
+	for i := 0; i < 5; i++ {
+		_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(20), ob.NewOrder(true, orderbook.AmountFromInt(1), 1))
+		assert.Nil(t, err)
+	}
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(101), ob.NewOrder(false, orderbook.AmountFromInt(1), 2))
+	assert.Nil(t, err)
+	assert.Nil(t, ex.AddMarket(ETHUSDCSpec))
+	assertBalance(t, ex.ledger, 1, AssetUSDC, balance("10000", "0"))
+	assertBalance(t, ex.ledger, 2, AssetETH, balance("10", "0"))
+
+	// the new book numbers its events from the start, they are settled
+	ob, _ = ex.orderbook(MarketETHUSDC)
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(true, orderbook.AmountFromInt(1), 1))
+	assert.Nil(t, err)
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(false, orderbook.AmountFromInt(1), 2))
+	assert.Nil(t, err)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("11", "0"))
+	assertBalance(t, ex.ledger, 2, AssetUSDC, balance("10100", "0"))
+	assertBalanced(t, ex.ledger)
+}
+
+func TestExchangeReleasesHoldsOfRuntimeMarkets(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Exchange {
+		ex := NewExchange("", nil)
+		assert.Nil(t, ex.RecoverLedger(filepath.Join(dir, ledgerDir)))
+		for _, spec := range DefaultMarkets {
+			assert.Nil(t, ex.RecoverMarket(spec, filepath.Join(dir, string(spec.Market))))
+		}
+		return ex
+	}
+
+	ex := open()
+	fund(t, ex, 1)
+	ob, _ := ex.orderbook(MarketETHUSDC)
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(true, orderbook.AmountFromInt(1), 1))
+	assert.Nil(t, err)
+
+	// markets listed at runtime are not journaled
+	wbtcUSDC := &MarketSpec{
+		Market:   "WBTC-USDC",
+		Base:     WBTC,
+		Quote:    USDC,
+		TickSize: orderbook.AmountFromInt(1),
+		LotSize:  orderbook.MustParseAmount("0.0001"),
+	}
+	assert.Nil(t, ex.CreateMarket(wbtcUSDC))
+	ob, _ = ex.orderbook(wbtcUSDC.Market)
+	_, err = ex.handlePlaceLimitOrder(wbtcUSDC.Market, orderbook.AmountFromInt(1000), ob.NewOrder(true, orderbook.AmountFromInt(1), 1))
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = ex.handlePlaceLimitOrder(wbtcUSDC.Market, orderbook.AmountFromInt(100), ob.NewOrder(true, orderbook.MustParseAmount("0.1"), 1))
+		assert.Nil(t, err)
+	}
+	assertBalance(t, ex.ledger, 1, AssetUSDC, balance("8850", "1150"))
+	assert.Nil(t, ex.Close())
+
+	recovered := open()
+	defer recovered.Close()
+	assertBalance(t, recovered.ledger, 1, AssetUSDC, balance("8850", "1150"))
+	assert.Nil(t, recovered.CloseUnlistedMarkets())
+	assertBalance(t, recovered.ledger, 1, AssetUSDC, balance("9900", "100"))
+	assert.Equal(t, recovered.ledger.Markets(), []Market{MarketETHUSDC})
+	assertBalanced(t, recovered.ledger)
+
+	// listed again, the market trades from the first event of its book
+	recovered.AddUser(&User{Id: 2})
+	assert.Nil(t, recovered.ledger.Deposit(2, AssetWBTC, orderbook.AmountFromInt(1)))
+	assert.Nil(t, recovered.CreateMarket(wbtcUSDC))
+	recovered.AddUser(&User{Id: 1})
+	ob, _ = recovered.orderbook(wbtcUSDC.Market)
+	_, err = recovered.handlePlaceLimitOrder(wbtcUSDC.Market, orderbook.AmountFromInt(1000), ob.NewOrder(true, orderbook.AmountFromInt(1), 1))
+	assert.Nil(t, err)
+	_, err = recovered.handlePlaceLimitOrder(wbtcUSDC.Market, orderbook.AmountFromInt(1000), ob.NewOrder(false, orderbook.AmountFromInt(1), 2))
+	assert.Nil(t, err)
+	assertBalance(t, recovered.ledger, 1, AssetWBTC, balance("1", "0"))
+	assertBalance(t, recovered.ledger, 2, AssetUSDC, balance("1000", "0"))
+	assertBalanced(t, recovered.ledger)
+}
+
+func TestExchangeSettlesFillsJournaledBeforeACrash(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Exchange {
+		ex := NewExchange("", nil)
+		assert.Nil(t, ex.RecoverLedger(filepath.Join(dir, ledgerDir)))
+		assert.Nil(t, ex.RecoverMarket(ETHUSDCSpec, filepath.Join(dir, string(MarketETHUSDC))))
+		return ex
+	}
+
+	ex := open()
+	fund(t, ex, 1, 2)
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), orderbook.NewOrder(false, orderbook.AmountFromInt(2), 1))
+	assert.Nil(t, err)
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), orderbook.NewOrder(true, orderbook.AmountFromInt(1), 2))
+	assert.Nil(t, err)
+	entries := len(ex.ledger.Entries())
+	assert.Nil(t, ex.Close())
+
+	// the crash came after the book journaled the bid, before the ledger
+	// journaled its fill
+	path := filepath.Join(dir, ledgerDir, ledgerJournalFile)
+	journal, err := orderbook.OpenJournal(path)
+	assert.Nil(t, err)
+	records, err := journal.Records()
+	assert.Nil(t, err)
+	assert.Nil(t, journal.Reset())
+	for _, payload := range records[:len(records)-1] {
+		assert.Nil(t, journal.Append(payload))
+	}
+	assert.Nil(t, journal.Close())
+
+	// recovery settles the fill once, however often it runs
+	for i := 0; i < 2; i++ {
+		recovered := open()
+		assert.Equal(t, recovered.state(MarketETHUSDC), MarketOpen)
+		assert.Equal(t, len(recovered.ledger.Entries()), entries)
+		assertBalance(t, recovered.ledger, 1, AssetETH, balance("8", "1"))
+		assertBalance(t, recovered.ledger, 1, AssetUSDC, balance("10100", "0"))
+		assertBalance(t, recovered.ledger, 2, AssetETH, balance("11", "0"))
+		assertBalance(t, recovered.ledger, 2, AssetUSDC, balance("9900", "0"))
+		assertBalanced(t, recovered.ledger)
+		assert.Nil(t, recovered.Close())
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import "github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+
+// AddUser registers a user with the exchange. Only registered users can
+// place orders.
+func (ex *Exchange) AddUser(user *User) {
+	address := ex.DepositAddress(user.Id)
+
+	ex.usersMu.Lock()
+	defer ex.usersMu.Unlock()
+
+	ex.Users[user.Id] = user
+	ex.depositAddresses[address] = user.Id
+}
+
+// user returns the registered user with the given id.
+func (ex *Exchange) user(id int64) (*User, bool) {
+	ex.usersMu.RLock()
+	defer ex.usersMu.RUnlock()
+
+	user, ok := ex.Users[id]
+	return user, ok
+}
+
+// checkRisk runs the pre-trade checks on an order about to hold h: the user
+// must be registered, stay within the open order and position limits of the
+// market, and have h.Amount available. placed is false for an order already
+// in the book that asks for more.
+func (ex *Exchange) checkRisk(spec *MarketSpec, h Hold, placed bool) error {
+	if _, ok := ex.user(h.UserId); !ok {
+		return newOrderError(ErrCodeUnknownUser, "user %d not found", h.UserId)
+	}
+
+	holds := ex.ledger.Holds(h.UserId, spec.Market)
+	if placed && spec.MaxOpenOrders > 0 && len(holds) >= spec.MaxOpenOrders {
+		return newOrderError(ErrCodeTooManyOpenOrders, "user %d already has %d open orders in %s", h.UserId, len(holds), spec.Market)
+	}
+
+	// the worst case for a buy is that every open buy of the user fills
+	if h.Bid && spec.MaxPosition.Sign() > 0 {
+		base := ex.ledger.Balance(h.UserId, spec.Base.Asset)
+		position := base.Available.Add(base.Held).Add(h.Size)
+		for _, open := range holds {
+			if open.Bid && open.OrderId != h.OrderId {
+				position = position.Add(open.Size)
+			}
+		}
+		if position.GreaterThan(spec.MaxPosition) {
+			return newOrderError(ErrCodePositionLimit, "filled, the order takes the %s position of user %d to %s, above the limit of %s", spec.Base.Asset, h.UserId, position, spec.MaxPosition)
+		}
+	}
+
+	available := ex.ledger.Balance(h.UserId, h.Asset).Available
+	if h.Amount.GreaterThan(available) {
+		return newOrderError(ErrCodeInsufficientFunds, "the order needs %s %s, user %d has %s available", h.Amount, h.Asset, h.UserId, available)
+	}
+	return nil
+}
+
+// orderHold is what the order o at price holds: the quote notional of a
+// buy, the base size of a sell.
+func orderHold(spec *MarketSpec, o *orderbook.Order, price orderbook.Amount) Hold {
+	h := Hold{
+		OrderId: o.Id,
+		UserId:  o.UserId,
+		Market:  spec.Market,
+		Bid:     o.Bid,
+		Size:    o.Size.Add(o.Hidden),
+		Asset:   spec.Base.Asset,
+		Amount:  o.Size.Add(o.Hidden),
+	}
+	if o.Bid {
+		h.Asset = spec.Quote.Asset
+		h.Amount = required(true, price, h.Size)
+	}
+	return h
+}
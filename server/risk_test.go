@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRiskRejectsUnknownUsers(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	ob, _ := ex.orderbook(MarketETHUSDC)
+
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(false, orderbook.AmountFromInt(1), 9))
+	assert.Equal(t, errorCode(err), ErrCodeUnknownUser)
+	assert.Equal(t, ob.OrderCount(), 0)
+
+	// the handler rejects them before they get an order id
+	body := `{"UserId": 9, "Type": "LIMIT", "Size": "1", "Price": "100", "Market": "ETH-USDC"}`
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)), rec)
+	assert.Nil(t, ex.handlePlaceOrder(c))
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+	assert.Contains(t, rec.Body.String(), string(ErrCodeUnknownUser))
+}
+
+func TestRiskLimitsOpenOrders(t *testing.T) {
+	spec := *ETHUSDCSpec
+	spec.MaxOpenOrders = 2
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	assert.Nil(t, ex.AddMarket(&spec))
+	fund(t, ex, 1)
+	ob, _ := ex.orderbook(MarketETHUSDC)
+
+	for i := 0; i < 2; i++ {
+		_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(false, orderbook.AmountFromInt(1), 1))
+		assert.Nil(t, err)
+	}
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(false, orderbook.AmountFromInt(1), 1))
+	assert.Equal(t, errorCode(err), ErrCodeTooManyOpenOrders)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("8", "2"))
+}
+
+func TestRiskLimitsPosition(t *testing.T) {
+	spec := *ETHUSDCSpec
+	spec.MaxPosition = orderbook.AmountFromInt(15)
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	assert.Nil(t, ex.AddMarket(&spec))
+	fund(t, ex, 1)
+	ob, _ := ex.orderbook(MarketETHUSDC)
+
+	// 10 owned and 4 bid for is within the limit
+	bid := ob.NewOrder(true, orderbook.AmountFromInt(4), 1)
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(10), bid)
+	assert.Nil(t, err)
+
+	// both bids filling would take it to 16
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(10), ob.NewOrder(true, orderbook.AmountFromInt(2), 1))
+	assert.Equal(t, errorCode(err), ErrCodePositionLimit)
+	res := ex.submit(MarketETHUSDC, orderbook.Command{Type: orderbook.CommandAmend, OrderId: bid.Id, Size: orderbook.AmountFromInt(6)})
+	assert.Equal(t, errorCode(res.Err), ErrCodePositionLimit)
+
+	// selling never adds to the position
+	_, err = ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(100), ob.NewOrder(false, orderbook.AmountFromInt(10), 1))
+	assert.Nil(t, err)
+}
+
+func TestRiskExplainsMissingFunds(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1)
+	ob, _ := ex.orderbook(MarketETHUSDC)
+
+	_, err := ex.handlePlaceLimitOrder(MarketETHUSDC, orderbook.AmountFromInt(20), ob.NewOrder(false, orderbook.AmountFromInt(11), 1))
+	assert.Equal(t, err.Error(), "INSUFFICIENT_FUNDS: the order needs 11 ETH, user 1 has 10 available")
+}
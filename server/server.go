@@ -8,14 +8,17 @@ import (
 	"log"
 	"math/big"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/labstack/echo/v4"
 )
 
@@ -25,48 +28,167 @@ const (
 	exchangeAddress              = "0x90F8bf6A479f320ead074411a4B0e7944Ea8c9C1"
 	LIMITORDER         OrderType = "LIMIT"
 	MARKETORDER        OrderType = "MARKET"
-	MarketETH          Market    = "ETH"
+	STOPMARKETORDER    OrderType = "STOP_MARKET"
+	STOPLIMITORDER     OrderType = "STOP_LIMIT"
+	MarketETHUSDC      Market    = "ETH-USDC"
+	MarketWBTCETH      Market    = "WBTC-ETH"
+
+	GTC TimeInForce = "GTC" // good till cancel, the default
+	IOC TimeInForce = "IOC" // immediate or cancel
+	FOK TimeInForce = "FOK" // fill or kill
+	GTD TimeInForce = "GTD" // good till date, see PlaceOrderRequest.ExpiresAt
+
+	// users never trade with themselves, these decide which of their
+	// orders gives way
+	CancelNewest       SelfTradePrevention = "CANCEL_NEWEST" // the default
+	CancelOldest       SelfTradePrevention = "CANCEL_OLDEST"
+	CancelBoth         SelfTradePrevention = "CANCEL_BOTH"
+	DecrementAndCancel SelfTradePrevention = "DECREMENT_AND_CANCEL"
+
+	expirySweepInterval = time.Second
+	depositPollInterval = time.Second
+	nonceCheckInterval  = 10 * time.Second
+	// the dev chain mines a block per transaction, so one is enough there
+	depositConfirmations    = 1
+	withdrawalPollInterval  = time.Second
+	withdrawalConfirmations = 1
+	reconcileInterval       = time.Minute
+	// depositTimeout is how long a deposit request waits for its transfer
+	// to be mined, receiptPollInterval how often it looks
+	depositTimeout      = 30 * time.Second
+	receiptPollInterval = 100 * time.Millisecond
+	// simulatedBlockInterval is how often the simulated chain mines
+	simulatedBlockInterval = time.Second
+	// dataDir keeps the journal and snapshots of every market, the
+	// journal of the ledger in ledgerDir, the one of the withdrawal queue
+	// in withdrawalsDir and what the deposit watcher saw in depositsDir
+	dataDir        = "data"
+	ledgerDir      = "ledger"
+	withdrawalsDir = "withdrawals"
+	depositsDir    = "deposits"
 )
 
+// devFunds are what the dev users start with of the assets that are not
+// settled on chain
+var devFunds = map[Asset]orderbook.Amount{
+	AssetETH:  orderbook.AmountFromInt(100),
+	AssetUSDC: orderbook.AmountFromInt(1_000_000),
+	AssetWBTC: orderbook.AmountFromInt(10),
+}
+
+// simulatedFunds is the ETH, in wei, the exchange and the dev users start
+// with on the simulated chain
+var simulatedFunds = new(big.Int).Mul(big.NewInt(100), big.NewInt(1e18))
+
+// withdrawalApprovalThresholds are the amounts above which a withdrawal
+// waits for an admin to approve it
+var withdrawalApprovalThresholds = map[Asset]orderbook.Amount{
+	AssetETH:  orderbook.AmountFromInt(10),
+	AssetUSDC: orderbook.AmountFromInt(50_000),
+	AssetWBTC: orderbook.AmountFromInt(1),
+}
+
 // All Type Defined here
 type (
-	OrderType string
-	Market    string
+	OrderType           string
+	Market              string
+	TimeInForce         string
+	SelfTradePrevention string
 
 	Exchange struct {
-		client *ethclient.Client
-		Users  map[int64]*User
-		mu     sync.RWMutex
+		client ChainBackend
+		// nonces sends every transaction of the exchange and its users
+		nonces *NonceManager
+		// usersMu guards Users and depositAddresses, register them with
+		// AddUser
+		usersMu          sync.RWMutex
+		Users            map[int64]*User
+		depositAddresses map[common.Address]int64
+		// mu guards Orders, orderbooks, sequencers, markets and tokens
+		mu sync.RWMutex
 
 		// orders maps a user to it's orders
 		Orders     map[int64][]*orderbook.Order
 		orderbooks map[Market]*orderbook.Orderbook
+		// sequencers make every change to the orderbook of their market,
+		// handlers only read the books directly
+		sequencers map[Market]*orderbook.Sequencer
+		markets    map[Market]*MarketSpec
+		// tokens are the ERC-20 contracts of the assets settled on chain
+		// other than ETH
+		tokens map[Asset]*Token
+		// ids numbers the orders of every market, so order ids are unique
+		// across the exchange
+		ids *orderbook.SequenceIDGenerator
+		// statesMu guards states, the markets that are not open. It is
+		// separate from mu because the sequencers read it.
+		statesMu sync.RWMutex
+		states   map[Market]MarketState
+		// ledger keeps the balances of the users, trades settle in it
+		ledger     *Ledger
 		PrivateKey *ecdsa.PrivateKey
+		// AdminToken is the bearer token of the admin API, which is off
+		// when it is empty
+		AdminToken string
 	}
 
 	OrderResponse struct {
 		UserId    int64
 		Id        int64
-		Price     float64
-		Size      float64
+		Price     orderbook.Amount
+		Size      orderbook.Amount
+		Hidden    orderbook.Amount // iceberg reserve, only shown to the order's owner
 		Bid       bool
 		TimeStamp int64
 	}
 
 	OrderbookData struct {
-		TotalBidVolume float64
-		TotalAskVolume float64
+		TotalBidVolume orderbook.Amount
+		TotalAskVolume orderbook.Amount
 		Asks           []*OrderResponse
 		Bids           []*OrderResponse
 	}
 
 	PlaceOrderRequest struct {
-		UserId int64
-		Type   OrderType // Limit or Market
-		Bid    bool
-		Size   float64
-		Price  float64
-		Market Market
+		UserId      int64
+		Type        OrderType // Limit, Market, StopMarket or StopLimit
+		Bid         bool
+		Size        orderbook.Amount
+		Price       orderbook.Amount // limit price of Limit and StopLimit orders
+		StopPrice   orderbook.Amount // trigger price of StopMarket and StopLimit orders
+		Market      Market
+		TimeInForce TimeInForce // GTC when empty
+		ExpiresAt   int64       // unix nano, GTD orders only
+		// PostOnly limit orders never take liquidity. One that would cross
+		// the spread is rejected, or repriced one tick away when Reprice is set.
+		PostOnly bool
+		Reprice  bool
+		// DisplaySize makes a limit order an iceberg showing only this much
+		// of its size in the book
+		DisplaySize orderbook.Amount
+		// SelfTradePrevention is what happens when the order meets a resting
+		// order of the same user, CANCEL_NEWEST when empty
+		SelfTradePrevention SelfTradePrevention
+	}
+
+	// AmendOrderRequest changes a resting limit order. A zero Price or Size
+	// keeps the current one, Size is what is left of the order to fill.
+	AmendOrderRequest struct {
+		Market Market // the market of the order when empty
+		Price  orderbook.Amount
+		Size   orderbook.Amount
+	}
+
+	// AmendOrderResponse is the state of the order after the amend.
+	AmendOrderResponse struct {
+		OrderId int64
+		Price   orderbook.Amount
+		Size    orderbook.Amount
+		Hidden  orderbook.Amount
+		// Filled is what the order traded when its new price crossed
+		Filled orderbook.Amount
+		// Open is false when the amend filled the whole order
+		Open bool
 	}
 
 	CancelOrderRequest struct {
@@ -76,8 +198,8 @@ type (
 
 	MatchedOrder struct {
 		UserId int64
-		Price  float64
-		Size   float64
+		Price  orderbook.Amount
+		Size   orderbook.Amount
 		Id     int64
 	}
 
@@ -87,11 +209,22 @@ type (
 	}
 
 	PlaceOrderResponse struct {
-		OrderId int64
+		OrderId  int64
+		Price    orderbook.Amount // the price the rest of a limit order rests at
+		Filled   orderbook.Amount
+		Unfilled orderbook.Amount
+	}
+
+	OrderRejectedResponse struct {
+		OrderId  int64
+		Code     ErrorCode
+		Reason   string
+		Filled   orderbook.Amount
+		Unfilled orderbook.Amount
 	}
 
 	BestBidResponse struct {
-		Price float64
+		Price orderbook.Amount
 	}
 
 	OrdersByUserIdResponse struct {
@@ -106,13 +239,6 @@ func StartServer() {
 
 	e.HTTPErrorHandler = httpErrorHandler
 
-	client, err := ethclient.Dial("http://localhost:8545")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	ex := NewExchange("4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d ", client)
-
 	pv1, err := crypto.HexToECDSA("6cbed15c793ce57650b9877cf6fa156fbef513c4e6134f022a85b1ffdd59b2a1")
 	if err != nil {
 		log.Fatal(err)
@@ -127,32 +253,123 @@ func StartServer() {
 		Id:         1,
 		PrivateKey: pv1,
 	}
-	ex.Users[user1.Id] = user1
 
 	user2 := &User{
 		Id:         2,
 		PrivateKey: pv2,
 	}
-	ex.Users[user2.Id] = user2
 
 	// Get addresses for both users
 	user1Address := crypto.PubkeyToAddress(*user1.PrivateKey.Public().(*ecdsa.PublicKey))
 	user2Address := crypto.PubkeyToAddress(*user2.PrivateKey.Public().(*ecdsa.PublicKey))
 
-	// Get balances
-	user1Balance, err := client.BalanceAt(context.Background(), user1Address, nil)
+	// EXCHANGE_CHAIN picks the chain: a node at EXCHANGE_RPC_URL by default,
+	// "simulated" for one in memory or "none" to keep balances in the
+	// ledger only
+	client, err := NewChainBackend(ChainConfig{
+		Mode: ChainMode(os.Getenv("EXCHANGE_CHAIN")),
+		URL:  os.Getenv("EXCHANGE_RPC_URL"),
+		Alloc: types.GenesisAlloc{
+			common.HexToAddress(exchangeAddress): {Balance: simulatedFunds},
+			user1Address:                         {Balance: simulatedFunds},
+			user2Address:                         {Balance: simulatedFunds},
+		},
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	user2Balance, err := client.BalanceAt(context.Background(), user2Address, nil)
+	if chain, ok := client.(*SimulatedChain); ok {
+		go chain.Run(simulatedBlockInterval)
+	}
+
+	ex := NewExchange("4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d ", client)
+	ex.AdminToken = os.Getenv("EXCHANGE_ADMIN_TOKEN")
+	if err := ex.RecoverLedger(filepath.Join(dataDir, ledgerDir)); err != nil {
+		log.Fatal(err)
+	}
+	// the dev users are only funded once, a recovered ledger has their
+	// balances already
+	funded := len(ex.ledger.Entries()) > 0
+	for _, spec := range DefaultMarkets {
+		if err := ex.RecoverMarket(spec, filepath.Join(dataDir, string(spec.Market))); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := ex.CloseUnlistedMarkets(); err != nil {
+		log.Fatal(err)
+	}
+	ex.AddUser(user1)
+	ex.AddUser(user2)
+
+	// tokens are settled on chain when their contract is configured, e.g.
+	// EXCHANGE_USDC_TOKEN=0x..., otherwise the dev users start with some.
+	// Without a chain they start with some of every asset.
+	devAssets := []AssetSpec{USDC, WBTC}
+	if client == nil {
+		devAssets = append(devAssets, ETH)
+	}
+	for _, asset := range devAssets {
+		if address := os.Getenv("EXCHANGE_" + string(asset.Asset) + "_TOKEN"); address != "" && client != nil {
+			if err := ex.RegisterToken(asset, common.HexToAddress(address)); err != nil {
+				log.Fatal(err)
+			}
+			continue
+		}
+		if funded {
+			continue
+		}
+		for _, user := range []*User{user1, user2} {
+			if err := ex.ledger.Deposit(user.Id, asset.Asset, devFunds[asset.Asset]); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	deposits, err := OpenDepositWatcher(ex, depositConfirmations, filepath.Join(dataDir, depositsDir))
 	if err != nil {
 		log.Fatal(err)
 	}
+	if client != nil {
+		// Get balances
+		user1Balance, err := client.BalanceAt(context.Background(), user1Address, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		user2Balance, err := client.BalanceAt(context.Background(), user2Address, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	fmt.Printf("User 1 (%s) balance: %s ETH\n", user1Address.Hex(),
-		new(big.Float).Quo(new(big.Float).SetInt(user1Balance), big.NewFloat(1e18)))
-	fmt.Printf("User 2 (%s) balance: %s ETH\n", user2Address.Hex(),
-		new(big.Float).Quo(new(big.Float).SetInt(user2Balance), big.NewFloat(1e18)))
+		fmt.Printf("User 1 (%s) balance: %s ETH\n", user1Address.Hex(),
+			new(big.Float).Quo(new(big.Float).SetInt(user1Balance), big.NewFloat(1e18)))
+		fmt.Printf("User 2 (%s) balance: %s ETH\n", user2Address.Hex(),
+			new(big.Float).Quo(new(big.Float).SetInt(user2Balance), big.NewFloat(1e18)))
+
+		// a new watcher credits deposits from the blocks added from now
+		// on, a saved one carries on after the last block it scanned
+		if s := os.Getenv("EXCHANGE_DEPOSIT_CONFIRMATIONS"); s != "" {
+			if deposits.Confirmations, err = strconv.ParseUint(s, 10, 64); err != nil {
+				log.Fatal(err)
+			}
+		}
+		head, err := client.HeaderByNumber(context.Background(), nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		deposits.FromBlock = head.Number.Uint64() + 1
+		for _, user := range []*User{user1, user2} {
+			fmt.Printf("User %d deposits to %s\n", user.Id, ex.DepositAddress(user.Id).Hex())
+		}
+	}
+
+	withdrawals, err := OpenWithdrawalQueue(ex, withdrawalConfirmations, filepath.Join(dataDir, withdrawalsDir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for asset, threshold := range withdrawalApprovalThresholds {
+		withdrawals.ApprovalThresholds[asset] = threshold
+	}
+	reconciler := NewReconciler(ex, deposits, withdrawals)
 
 	e.POST("/order", ex.handlePlaceOrder)
 	e.GET("/order/:userId", ex.handleGetOrdersByUserid)
@@ -160,8 +377,32 @@ func StartServer() {
 	e.GET("/book/:market", ex.handleGetOrderbook)
 	e.GET("/book", ex.handleGetBook)
 	e.DELETE("/order/:orderID", ex.handleCancelOrder)
+	e.PATCH("/order/:orderID", ex.handleAmendOrder)
 	e.GET("/book/:market/bid", ex.handleGetBestBid)
 	e.GET("/book/:market/ask", ex.handleGetBestAsk)
+	e.GET("/markets", ex.handleGetMarkets)
+	e.GET("/markets/:market", ex.handleGetMarket)
+	e.GET("/balances/:userId", ex.handleGetBalances)
+	e.POST("/deposit", ex.handleDeposit)
+	e.GET("/deposits/:userId", deposits.handleGetDeposits)
+	e.POST("/withdrawals", withdrawals.handleRequestWithdrawal)
+	e.GET("/withdrawals/:id", withdrawals.handleGetWithdrawal)
+
+	admin := e.Group("/admin", ex.requireAdmin)
+	admin.POST("/markets", ex.handleCreateMarket)
+	admin.PUT("/markets/:market/state", ex.handleSetMarketState)
+	admin.DELETE("/markets/:market", ex.handleDelistMarket)
+	admin.POST("/withdrawals/:id/approve", withdrawals.handleApproveWithdrawal)
+	admin.POST("/withdrawals/:id/reject", withdrawals.handleRejectWithdrawal)
+	admin.GET("/reconciliation", reconciler.handleGetReconciliation)
+
+	go ex.sweepExpiredOrders(expirySweepInterval)
+	if client != nil {
+		go ex.nonces.Run(nonceCheckInterval)
+		go deposits.Run(depositPollInterval)
+		go withdrawals.Run(withdrawalPollInterval)
+		go reconciler.Run(reconcileInterval)
+	}
 
 	e.Start(":3000")
 
@@ -173,22 +414,224 @@ func httpErrorHandler(err error, c echo.Context) {
 
 }
 
-func NewExchange(privateKey string, client *ethclient.Client) *Exchange {
+func NewExchange(privateKey string, client ChainBackend) *Exchange {
 	pv, err := crypto.HexToECDSA(exchangePrivateKey)
 	if err != nil {
 		log.Fatal(err)
 	}
 	ex := &Exchange{
-		client:     client,
-		Users:      make(map[int64]*User),
-		Orders:     make(map[int64][]*orderbook.Order),
-		orderbooks: make(map[Market]*orderbook.Orderbook),
-		PrivateKey: pv,
+		client:           client,
+		nonces:           NewNonceManager(client),
+		Users:            make(map[int64]*User),
+		depositAddresses: make(map[common.Address]int64),
+		Orders:           make(map[int64][]*orderbook.Order),
+		orderbooks:       make(map[Market]*orderbook.Orderbook),
+		sequencers:       make(map[Market]*orderbook.Sequencer),
+		markets:          make(map[Market]*MarketSpec),
+		states:           make(map[Market]MarketState),
+		tokens:           make(map[Asset]*Token),
+		ids:              orderbook.NewSequenceIDGenerator(),
+		ledger:           NewLedger(),
+		PrivateKey:       pv,
+	}
+	for _, spec := range DefaultMarkets {
+		if err := ex.AddMarket(spec); err != nil {
+			log.Fatal(err)
+		}
 	}
-	ex.orderbooks[MarketETH] = orderbook.NewOrderbook()
 	return ex
 }
 
+// AddMarket opens an empty orderbook trading under spec and starts the
+// sequencer driving it. The orders of a market it replaces are gone with
+// its book, so the ledger releases their holds.
+func (ex *Exchange) AddMarket(spec *MarketSpec) error {
+	if err := spec.Check(); err != nil {
+		return err
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	old, replaced := ex.sequencers[spec.Market]
+	if replaced {
+		old.Close()
+	}
+	ex.addMarket(spec)
+	if replaced {
+		return ex.ledger.CloseMarket(spec.Market)
+	}
+	return nil
+}
+
+// addMarket opens the orderbook and sequencer of spec. ex.mu must be held.
+func (ex *Exchange) addMarket(spec *MarketSpec) {
+	ob := spec.NewOrderbook()
+	ob.IDs = ex.ids
+	ex.markets[spec.Market] = spec
+	ex.orderbooks[spec.Market] = ob
+	seq := orderbook.NewSequencer(ob)
+	seq.SetHooks(ex.ledgerHooks(spec, ob))
+	ex.sequencers[spec.Market] = seq
+}
+
+// RecoverLedger opens the ledger journaled in dir in place of the one kept
+// in memory. It has to come before the markets are recovered and any order
+// is placed.
+func (ex *Exchange) RecoverLedger(dir string) error {
+	ledger, err := OpenLedger(dir)
+	if err != nil {
+		return err
+	}
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	ex.ledger.Close()
+	ex.ledger = ledger
+	return nil
+}
+
+// RecoverMarket opens the market of spec from the journal and snapshots in
+// dir, rebuilding its orderbook and the open orders of its users, and keeps
+// journaling to dir from then on. It replaces an in-memory market opened by
+// AddMarket. Holds of orders the book does not have, left by a crash after
+// the hold was journaled and before the order was, are released.
+func (ex *Exchange) RecoverMarket(spec *MarketSpec, dir string) error {
+	if err := spec.Check(); err != nil {
+		return err
+	}
+	store, err := orderbook.OpenStore(dir)
+	if err != nil {
+		return err
+	}
+	ob := spec.NewOrderbook()
+	ob.IDs = ex.ids
+	// the ledger settles what it missed of the journal as it is replayed
+	seq, err := orderbook.RecoverSequencerWithHooks(ob, store, ex.ledgerHooks(spec, ob))
+	if err != nil {
+		store.Close()
+		return fmt.Errorf("recovering market %s: %w", spec.Market, err)
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if old, ok := ex.sequencers[spec.Market]; ok {
+		old.Close()
+	}
+	ex.markets[spec.Market] = spec
+	ex.orderbooks[spec.Market] = ob
+	ex.sequencers[spec.Market] = seq
+
+	for _, limit := range append(ob.Asks(), ob.Bids()...) {
+		for _, order := range limit.Orders() {
+			ex.Orders[order.UserId] = append(ex.Orders[order.UserId], order)
+		}
+	}
+	for _, stop := range ob.Stops() {
+		ex.Orders[stop.Order.UserId] = append(ex.Orders[stop.Order.UserId], stop.Order)
+	}
+	return ex.ledger.ReleaseClosed(spec.Market, func(orderId int64) bool {
+		_, open := ob.Order(orderId)
+		return open
+	})
+}
+
+// CloseUnlistedMarkets closes in the ledger the markets it holds funds for
+// or followed that are not listed. Markets listed at runtime are not
+// journaled, after a restart their books are gone and the holds of their
+// orders would stay locked. It has to come after the markets are
+// recovered.
+func (ex *Exchange) CloseUnlistedMarkets() error {
+	for _, market := range ex.ledger.Markets() {
+		if _, ok := ex.market(market); ok {
+			continue
+		}
+		if err := ex.ledger.CloseMarket(market); err != nil {
+			return fmt.Errorf("closing market %s: %w", market, err)
+		}
+	}
+	return nil
+}
+
+// Close stops the sequencers of every market and closes the ledger.
+func (ex *Exchange) Close() error {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	var firstErr error
+	for _, seq := range ex.sequencers {
+		if err := seq.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := ex.ledger.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// sequencer returns the sequencer of market.
+func (ex *Exchange) sequencer(market Market) (*orderbook.Sequencer, bool) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	seq, ok := ex.sequencers[market]
+	return seq, ok
+}
+
+// submit applies cmd to the orderbook of market through its sequencer.
+func (ex *Exchange) submit(market Market, cmd orderbook.Command) orderbook.Result {
+	seq, ok := ex.sequencer(market)
+	if !ok {
+		return orderbook.Result{Err: newOrderError(ErrCodeUnknownMarket, "market %q not found", market)}
+	}
+	return seq.Submit(cmd)
+}
+
+// orderbook returns the orderbook of market.
+func (ex *Exchange) orderbook(market Market) (*orderbook.Orderbook, bool) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	ob, ok := ex.orderbooks[market]
+	return ob, ok
+}
+
+// market returns the spec of market.
+func (ex *Exchange) market(market Market) (*MarketSpec, bool) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	spec, ok := ex.markets[market]
+	return spec, ok
+}
+
+// specs returns the specs of every market, by name.
+func (ex *Exchange) specs() []*MarketSpec {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	specs := make([]*MarketSpec, 0, len(ex.markets))
+	for _, spec := range ex.markets {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Market < specs[j].Market })
+	return specs
+}
+
+// books returns the orderbooks of every market.
+func (ex *Exchange) books() map[Market]*orderbook.Orderbook {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	books := make(map[Market]*orderbook.Orderbook, len(ex.orderbooks))
+	for market, ob := range ex.orderbooks {
+		books[market] = ob
+	}
+	return books
+}
+
 func NewUser(privateKey string, id int64) *User {
 	pv, err := crypto.HexToECDSA(privateKey)
 	if err != nil {
@@ -200,9 +643,15 @@ func NewUser(privateKey string, id int64) *User {
 	}
 }
 
-func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrder) {
-	ob := ex.orderbooks[market]
-	matches := ob.PlaceMarketOrder(order)
+func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrder, error) {
+	res := ex.submit(market, orderbook.Command{
+		Type:  orderbook.CommandPlaceMarket,
+		Order: order,
+	})
+	if res.Err != nil {
+		return nil, nil, res.Err
+	}
+	matches := res.Matches
 	matchedOrders := make([]*MatchedOrder, len(matches))
 
 	isBid := false
@@ -210,8 +659,8 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 		isBid = true
 	}
 
-	totalFilled := 0.0
-	sumPrice := 0.0
+	totalFilled := orderbook.Amount{}
+	sumPrice := orderbook.Amount{}
 	for i := 0; i < len(matches); i++ {
 		var limitUserId int64
 		limitUserId = matches[i].Bid.UserId
@@ -227,21 +676,98 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 			Size:   matches[i].SizeFilled,
 			Id:     id,
 		}
-		totalFilled += matches[i].SizeFilled
-		sumPrice += matches[i].Price * matches[i].SizeFilled
+		totalFilled = totalFilled.Add(matches[i].SizeFilled)
+		sumPrice = sumPrice.Add(matches[i].Price.Mul(matches[i].SizeFilled))
+	}
+
+	if totalFilled.Sign() > 0 {
+		avgPrice := sumPrice.Div(totalFilled, orderbook.DefaultPriceDecimals)
+		fmt.Printf("Average Price: %s\n", avgPrice)
 	}
 
-	avgPrice := sumPrice / float64(len(matches))
+	ex.pruneClosedOrders()
+
+	return matches, matchedOrders, nil
+}
+
+func (ex *Exchange) handlePlaceLimitOrder(market Market, price orderbook.Amount, order *orderbook.Order) ([]orderbook.Match, error) {
+	ob, _ := ex.orderbook(market)
+	size := order.Size
+	res := ex.submit(market, orderbook.Command{
+		Type:  orderbook.CommandPlaceLimit,
+		Order: order,
+		Price: price,
+	})
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	matches := res.Matches
+
+	ex.mu.Lock()
+	if _, ok := ob.Order(order.Id); ok {
+		ex.Orders[order.UserId] = append(ex.Orders[order.UserId], order)
+	}
+	ex.mu.Unlock()
+
+	if len(matches) > 0 {
+		ex.pruneClosedOrders()
+	}
+
+	fmt.Printf("new Limit Order Placed [ %s] | size [%s] | matches [%d]\n", price, size, len(matches))
+	return matches, nil
+}
+
+func (ex *Exchange) handlePlaceStopOrder(market Market, stop *orderbook.StopOrder) ([]orderbook.Match, error) {
+	order := stop.Order
+	size := order.Size
+	res := ex.submit(market, orderbook.Command{
+		Type: orderbook.CommandPlaceStop,
+		Stop: stop,
+	})
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	matches := res.Matches
+
+	ex.mu.Lock()
+	ex.Orders[order.UserId] = append(ex.Orders[order.UserId], order)
+	ex.mu.Unlock()
+
+	ex.pruneClosedOrders()
+
+	fmt.Printf("new Stop Order Placed [ %s] | size [%s] | matches [%d]\n", stop.StopPrice, size, len(matches))
+	return matches, nil
+}
+
+// openOrder returns a snapshot of the order with the given id while it
+// still rests in one of the books or waits in a stop book.
+func openOrder(books map[Market]*orderbook.Orderbook, id int64) (*orderbook.Order, bool) {
+	_, order, ok := findOrder(books, id)
+	return order, ok
+}
 
-	fmt.Printf("Average Price: %.2f\n", avgPrice)
+// findOrder returns the open order with the given id and the market it is
+// in. Order ids are unique across the exchange.
+func findOrder(books map[Market]*orderbook.Orderbook, id int64) (Market, *orderbook.Order, bool) {
+	for market, ob := range books {
+		if order, ok := ob.Order(id); ok {
+			return market, order, true
+		}
+	}
+	return "", nil, false
+}
 
+// pruneClosedOrders drops every order that is no longer open (filled,
+// cancelled or expired) from the per user order lists.
+func (ex *Exchange) pruneClosedOrders() {
 	newOrdermap := make(map[int64][]*orderbook.Order)
+	books := ex.books()
 
 	ex.mu.Lock()
 
 	for userid, Orderbookorders := range ex.Orders {
 		for i := 0; i < len(Orderbookorders); i++ {
-			if !Orderbookorders[i].IsFilled() {
+			if _, ok := openOrder(books, Orderbookorders[i].Id); ok {
 				newOrdermap[userid] = append(newOrdermap[userid], Orderbookorders[i])
 			}
 		}
@@ -250,64 +776,63 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 
 	ex.Orders = newOrdermap
 	ex.mu.Unlock()
-
-	return matches, matchedOrders
 }
 
-func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
-	for _, match := range matches {
-		// Determine who sends the ETH based on the match
-		var fromUser, toUser *User
-		var ok bool
-
-		// If it's a sell order (Ask), seller sends ETH to buyer
-		// If it's a buy order (Bid), buyer sends ETH to seller
-		if match.Bid.Bid {
-			// It's a buy order, buyer (Bid) sends ETH to seller (Ask)
-			fromUser, ok = ex.Users[match.Bid.UserId]
-			if !ok {
-				return fmt.Errorf("buyer user not found")
-			}
-			toUser, ok = ex.Users[match.Ask.UserId]
-			if !ok {
-				return fmt.Errorf("seller user not found")
-			}
-		} else {
-			// It's a sell order, seller (Ask) sends ETH to buyer (Bid)
-			fromUser, ok = ex.Users[match.Ask.UserId]
-			if !ok {
-				return fmt.Errorf("seller user not found")
-			}
-			toUser, ok = ex.Users[match.Bid.UserId]
-			if !ok {
-				return fmt.Errorf("buyer user not found")
+// sweepExpiredOrders removes expired GTD orders from every orderbook on
+// each tick of interval.
+func (ex *Exchange) sweepExpiredOrders(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		<-ticker.C
+
+		expired := 0
+		for market, ob := range ex.books() {
+			// an idle book journals nothing
+			if !ob.ExpiryDue(ob.Clock.Now()) {
+				continue
 			}
+			// the sequencer stamps the command with the clock of the book
+			res := ex.submit(market, orderbook.Command{
+				Type: orderbook.CommandExpire,
+			})
+			expired += len(res.Events)
 		}
-
-		toPubKey := toUser.PrivateKey.Public()
-		toPubKeyECDSA, ok := toPubKey.(*ecdsa.PublicKey)
-		if !ok {
-			return fmt.Errorf("cannot assert type: publicKey is not of type *ecdsa.PublicKey")
+		if expired > 0 {
+			fmt.Printf("expired %d GTD orders\n", expired)
+			ex.pruneClosedOrders()
 		}
+	}
+}
 
-		err := TransferETH(ex.client, fromUser.PrivateKey,
-			crypto.PubkeyToAddress(*toPubKeyECDSA).Hex(),
-			match.SizeFilled)
-		if err != nil {
-			return fmt.Errorf("transfer failed: %w", err)
-		}
+// toTimeInForce maps the time in force of a request onto the orderbook's.
+func toTimeInForce(tif TimeInForce) (orderbook.TimeInForce, error) {
+	switch tif {
+	case GTC, "":
+		return orderbook.GTC, nil
+	case IOC:
+		return orderbook.IOC, nil
+	case FOK:
+		return orderbook.FOK, nil
+	case GTD:
+		return orderbook.GTD, nil
 	}
-	return nil
+	return 0, fmt.Errorf("unknown time in force %q", tif)
 }
 
-func (ex *Exchange) handlePlaceLimitOrder(market Market, price float64, order *orderbook.Order) error {
-	ob := ex.orderbooks[market]
-	ob.PlaceLimitOrder(price, order)
-	ex.mu.Lock()
-	ex.Orders[order.UserId] = append(ex.Orders[order.UserId], order)
-	ex.mu.Unlock()
-	fmt.Printf("new Limit Order Placed [ %.2f] | size [%.2f]", order.Limit.Price, order.Size)
-	return nil
+// toSelfTradePrevention maps the self-trade prevention of a request onto
+// the orderbook's.
+func toSelfTradePrevention(stp SelfTradePrevention) (orderbook.SelfTradePrevention, error) {
+	switch stp {
+	case CancelNewest, "":
+		return orderbook.SelfTradeCancelNewest, nil
+	case CancelOldest:
+		return orderbook.SelfTradeCancelOldest, nil
+	case CancelBoth:
+		return orderbook.SelfTradeCancelBoth, nil
+	case DecrementAndCancel:
+		return orderbook.SelfTradeDecrementAndCancel, nil
+	}
+	return 0, fmt.Errorf("unknown self-trade prevention %q", stp)
 }
 
 func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
@@ -317,30 +842,92 @@ func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, err.Error())
 	}
 	market := Market(placeorderdata.Market)
-	order := orderbook.NewOrder(placeorderdata.Bid, placeorderdata.Size, placeorderdata.UserId)
+	spec, ok := ex.market(market)
+	if !ok {
+		return rejectOrder(c, 0, placeorderdata.Size, newOrderError(ErrCodeUnknownMarket, "market %q not found", market))
+	}
+	if _, ok := ex.user(placeorderdata.UserId); !ok {
+		return rejectOrder(c, 0, placeorderdata.Size, newOrderError(ErrCodeUnknownUser, "user %d not found", placeorderdata.UserId))
+	}
+	if err := spec.Validate(&placeorderdata); err != nil {
+		return rejectOrder(c, 0, placeorderdata.Size, err)
+	}
+
+	tif, err := toTimeInForce(placeorderdata.TimeInForce)
+	if err != nil {
+		return rejectOrder(c, 0, placeorderdata.Size, newOrderError(ErrCodeInvalidRequest, "%s", err))
+	}
+	if tif == orderbook.GTD && placeorderdata.Type == LIMITORDER && placeorderdata.ExpiresAt == 0 {
+		return rejectOrder(c, 0, placeorderdata.Size, newOrderError(ErrCodeInvalidRequest, "GTD orders need an ExpiresAt time"))
+	}
+	stp, err := toSelfTradePrevention(placeorderdata.SelfTradePrevention)
+	if err != nil {
+		return rejectOrder(c, 0, placeorderdata.Size, newOrderError(ErrCodeInvalidRequest, "%s", err))
+	}
+
+	ob, _ := ex.orderbook(market)
+	order := ob.NewOrder(placeorderdata.Bid, placeorderdata.Size, placeorderdata.UserId)
+	order.TimeInForce = tif
+	order.ExpiresAt = placeorderdata.ExpiresAt
+	order.DisplaySize = placeorderdata.DisplaySize
+	order.SelfTradePrevention = stp
+	if placeorderdata.PostOnly {
+		order.PostOnly = orderbook.PostOnlyReject
+		if placeorderdata.Reprice {
+			order.PostOnly = orderbook.PostOnlySlide
+		}
+	}
+
+	var matches []orderbook.Match
 
 	// LIMIT ORDER
 	if placeorderdata.Type == LIMITORDER {
-		err := ex.handlePlaceLimitOrder(market, placeorderdata.Price, order)
-
+		limitMatches, err := ex.handlePlaceLimitOrder(market, placeorderdata.Price, order)
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, err.Error())
+			return rejectOrder(c, order.Id, placeorderdata.Size, err)
 		}
+		matches = limitMatches
 	}
 
 	// MARKET ORDER
 	if placeorderdata.Type == MARKETORDER {
-		matches, _ := ex.handlePlaceMarketOrder(market, order)
+		marketMatches, _, err := ex.handlePlaceMarketOrder(market, order)
+		if err != nil {
+			return rejectOrder(c, order.Id, placeorderdata.Size, err)
+		}
+		matches = marketMatches
+	}
 
-		err := ex.handleMatches(matches)
+	// STOP ORDER
+	if placeorderdata.Type == STOPMARKETORDER || placeorderdata.Type == STOPLIMITORDER {
+		stop := &orderbook.StopOrder{
+			Order:      order,
+			StopPrice:  placeorderdata.StopPrice,
+			StopLimit:  placeorderdata.Type == STOPLIMITORDER,
+			LimitPrice: placeorderdata.Price,
+		}
+		stopMatches, err := ex.handlePlaceStopOrder(market, stop)
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, err.Error())
+			return rejectOrder(c, order.Id, placeorderdata.Size, err)
 		}
+		matches = stopMatches
+	}
 
+	// matches also hold the fills of stop orders this order triggered
+	filled := orderbook.Amount{}
+	for _, match := range matches {
+		if match.Bid == order || match.Ask == order {
+			filled = filled.Add(match.SizeFilled)
+		}
 	}
 
 	resp := &PlaceOrderResponse{
-		OrderId: order.Id,
+		OrderId:  order.Id,
+		Filled:   filled,
+		Unfilled: placeorderdata.Size.Sub(filled),
+	}
+	if resting, ok := ob.Order(order.Id); ok && resting.Limit != nil {
+		resp.Price = resting.Limit.Price
 	}
 	return c.JSON(http.StatusOK, resp)
 }
@@ -350,16 +937,86 @@ func (ex *Exchange) handleCancelOrder(c echo.Context) error {
 	idstr := c.Param("orderID")
 	id, _ := strconv.Atoi(idstr)
 
-	ob := ex.orderbooks[MarketETH]
-	order := ob.Orders[int64(id)]
-	ob.CancelOrder(order)
+	market, _, ok := findOrder(ex.books(), int64(id))
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"message": orderbook.ErrOrderNotFound.Error()})
+	}
+	res := ex.submit(market, orderbook.Command{
+		Type:    orderbook.CommandCancel,
+		OrderId: int64(id),
+	})
+	if res.Err != nil {
+		status := http.StatusBadRequest
+		if errorCode(res.Err) == ErrCodeOrderNotFound {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{"message": res.Err.Error()})
+	}
+	ex.pruneClosedOrders()
 	return c.JSON(http.StatusOK, map[string]string{"message": "Order canceled"})
 }
 
+func (ex *Exchange) handleAmendOrder(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("orderID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid order ID"})
+	}
+
+	var amend AmendOrderRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&amend); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	market := amend.Market
+	if market == "" {
+		found, _, ok := findOrder(ex.books(), id)
+		if !ok {
+			return rejectOrder(c, id, amend.Size, orderbook.ErrOrderNotFound)
+		}
+		market = found
+	}
+	spec, ok := ex.market(market)
+	if !ok {
+		return rejectOrder(c, id, amend.Size, newOrderError(ErrCodeUnknownMarket, "market %q not found", market))
+	}
+	ob, _ := ex.orderbook(market)
+	order, ok := ob.Order(id)
+	if !ok || order.Limit == nil {
+		return rejectOrder(c, id, amend.Size, orderbook.ErrOrderNotFound)
+	}
+	if err := spec.ValidateAmend(order, &amend); err != nil {
+		return rejectOrder(c, id, amend.Size, err)
+	}
+
+	res := ex.submit(market, orderbook.Command{
+		Type:    orderbook.CommandAmend,
+		OrderId: id,
+		Price:   amend.Price,
+		Size:    amend.Size,
+	})
+	if res.Err != nil {
+		return rejectOrder(c, id, amend.Size, res.Err)
+	}
+	ex.pruneClosedOrders()
+
+	resp := &AmendOrderResponse{OrderId: id}
+	for _, match := range res.Matches {
+		if match.Bid.Id == id || match.Ask.Id == id {
+			resp.Filled = resp.Filled.Add(match.SizeFilled)
+		}
+	}
+	if amended, ok := ob.Order(id); ok {
+		resp.Price = amended.Limit.Price
+		resp.Size = amended.Size
+		resp.Hidden = amended.Hidden
+		resp.Open = true
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
 func (ex *Exchange) handleGetOrderbook(c echo.Context) error {
 
 	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
+	ob, ok := ex.orderbook(market)
 	if !ok {
 		return c.JSON(http.StatusNotFound, map[string]any{"message": "Orderbook of This Market not found"})
 	}
@@ -370,7 +1027,7 @@ func (ex *Exchange) handleGetOrderbook(c echo.Context) error {
 		TotalAskVolume: ob.AskTotalVolumne(),
 	}
 	for _, limits := range ob.Asks() {
-		for _, orders := range limits.Orders {
+		for _, orders := range limits.Orders() {
 			orderresponse := OrderResponse{
 				UserId:    orders.UserId,
 				Id:        orders.Id,
@@ -383,7 +1040,7 @@ func (ex *Exchange) handleGetOrderbook(c echo.Context) error {
 		}
 	}
 	for _, limits := range ob.Bids() {
-		for _, orders := range limits.Orders {
+		for _, orders := range limits.Orders() {
 			orderresponse := OrderResponse{
 				UserId:    orders.UserId,
 				Id:        orders.Id,
@@ -402,15 +1059,16 @@ func (ex *Exchange) handleGetOrderbook(c echo.Context) error {
 
 func (ex *Exchange) handleGetBestBid(c echo.Context) error {
 	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
+	ob, ok := ex.orderbook(market)
 	if !ok {
 		return c.JSON(http.StatusNotFound, map[string]any{"message": "Orderbook of This Market not found"})
 	}
 
-	if len(ob.Bids()) == 0 {
+	bestBid := ob.BestBid()
+	if bestBid == nil {
 		return c.JSON(http.StatusOK, map[string]any{"message": "No bids found"})
 	}
-	bestBidPrice := ob.Bids()[0].Price
+	bestBidPrice := bestBid.Price
 	resp := BestBidResponse{
 		Price: bestBidPrice,
 	}
@@ -419,15 +1077,16 @@ func (ex *Exchange) handleGetBestBid(c echo.Context) error {
 
 func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
 	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
+	ob, ok := ex.orderbook(market)
 	if !ok {
 		return c.JSON(http.StatusNotFound, map[string]any{"message": "Orderbook of This Market not found"})
 	}
 
-	if len(ob.Asks()) == 0 {
+	bestAsk := ob.BestAsk()
+	if bestAsk == nil {
 		return c.JSON(http.StatusOK, map[string]any{"message": "No bids found"})
 	}
-	bestBidPrice := ob.Asks()[0].Price
+	bestBidPrice := bestAsk.Price
 	resp := BestBidResponse{
 		Price: bestBidPrice,
 	}
@@ -435,52 +1094,27 @@ func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
 }
 
 func (ex *Exchange) handleGetBook(c echo.Context) error {
-	return c.JSON(http.StatusOK, ex.orderbooks)
+	return c.JSON(http.StatusOK, ex.books())
 }
 
-// Convert ETH to Wei
-func EthToWei(eth float64) *big.Int {
-	wei := new(big.Float).Mul(big.NewFloat(eth), big.NewFloat(1e18))
-	weiInt, _ := wei.Int(nil) // Convert to big.Int
-	return weiInt
+// Convert ETH to Wei, decimals beyond wei are truncated
+func EthToWei(eth orderbook.Amount) *big.Int {
+	return eth.ScaledInt(18)
 }
 
-func TransferETH(client *ethclient.Client, from *ecdsa.PrivateKey, to string, amount float64) error {
-	// Convert ETH to Wei
-	value := EthToWei(amount)
-
-	// Since we already have the private key, we can use it directly
-	publicKey := from.Public()
-	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("cannot assert type: publicKey is not of type *ecdsa.PublicKey")
-	}
-
-	fromAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
-	nonce, err := client.PendingNonceAt(context.Background(), fromAddress)
-	if err != nil {
-		return err
-	}
-
-	gasLimit := uint64(21000) // in units
-	gasPrice, err := client.SuggestGasPrice(context.Background())
-	if err != nil {
-		return err
-	}
-
-	toAddress := common.HexToAddress(to)
-	var data []byte
-	tx := types.NewTransaction(nonce, toAddress, value, gasLimit, gasPrice, data)
-
-	chainID := big.NewInt(1337)
+func TransferETH(nonces *NonceManager, from *ecdsa.PrivateKey, to string, amount orderbook.Amount) error {
+	_, err := sendETH(nonces, from, common.HexToAddress(to), amount)
+	return err
+}
 
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), from)
+// sendETH sends amount of ETH from the owner of key to to.
+func sendETH(nonces *NonceManager, key *ecdsa.PrivateKey, to common.Address, amount orderbook.Amount) (*types.Transaction, error) {
+	value, err := ToBaseUnits(amount, ETH.Decimals)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return client.SendTransaction(context.Background(), signedTx)
-
+	// plain ETH transfers to an account always take 21000 gas
+	return nonces.Send(key, to, value, nil, 21000)
 }
 
 func (ex *Exchange) handleGetOrdersByUserid(c echo.Context) error {
@@ -490,20 +1124,25 @@ func (ex *Exchange) handleGetOrdersByUserid(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid user ID"})
 	}
 
-	// ex.mu.RLock()
+	books := ex.books()
 
+	ex.mu.RLock()
 	orderbooksOrders := ex.Orders[int64(userId)]
-	if orderbooksOrders == nil {
-		return c.JSON(http.StatusOK, []*OrderResponse{}) // Return empty array instead of null
-	}
+	ex.mu.RUnlock()
 
 	orders := make([]*OrderResponse, 0, len(orderbooksOrders))
 
 	for _, order := range orderbooksOrders {
+		// the book owns the order, read it back through a snapshot
+		order, ok := openOrder(books, order.Id)
+		if !ok {
+			continue
+		}
 		orderResp := &OrderResponse{
 			Id:        order.Id,
 			UserId:    order.UserId,
 			Size:      order.Size,
+			Hidden:    order.Hidden,
 			Bid:       order.Bid,
 			TimeStamp: order.TimeStamp,
 		}
@@ -516,16 +1155,14 @@ func (ex *Exchange) handleGetOrdersByUserid(c echo.Context) error {
 		orders = append(orders, orderResp)
 	}
 
-	// ex.mu.RUnlock()
-
 	return c.JSON(http.StatusOK, orders)
 }
 
 func (ex *Exchange) handleGetTrades(c echo.Context) error {
 	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
+	ob, ok := ex.orderbook(market)
 	if !ok {
 		return c.JSON(http.StatusNotFound, map[string]any{"message": "Orderbook of This Market not found"})
 	}
-	return c.JSON(http.StatusOK, ob.Trades)
+	return c.JSON(http.StatusOK, ob.Trades())
 }
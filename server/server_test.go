@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestRouter routes the order and book endpoints to ex like StartServer.
+func newTestRouter(ex *Exchange) *echo.Echo {
+	e := echo.New()
+	e.POST("/order", ex.handlePlaceOrder)
+	e.GET("/trades/:market", ex.handleGetTrades)
+	e.GET("/book/:market", ex.handleGetOrderbook)
+	e.GET("/book/:market/bid", ex.handleGetBestBid)
+	e.GET("/book/:market/ask", ex.handleGetBestAsk)
+	return e
+}
+
+func serve(e *echo.Echo, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandlersReadTheBook(t *testing.T) {
+	ex := NewExchange("", nil)
+	defer ex.Close()
+	fund(t, ex, 1, 2)
+	e := newTestRouter(ex)
+
+	rec := serve(e, http.MethodPost, "/order", `{"UserId": 1, "Type": "LIMIT", "Bid": true, "Size": "2", "Price": "100", "Market": "ETH-USDC"}`)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	rec = serve(e, http.MethodPost, "/order", `{"UserId": 2, "Type": "LIMIT", "Bid": false, "Size": "1", "Price": "101", "Market": "ETH-USDC"}`)
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	rec = serve(e, http.MethodGet, "/book/ETH-USDC", "")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	book := &OrderbookData{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), book))
+	assert.Equal(t, len(book.Bids), 1)
+	assert.Equal(t, len(book.Asks), 1)
+	assert.Equal(t, book.TotalBidVolume, orderbook.AmountFromInt(2))
+	assert.Equal(t, book.TotalAskVolume, orderbook.AmountFromInt(1))
+
+	best := &BestBidResponse{}
+	rec = serve(e, http.MethodGet, "/book/ETH-USDC/bid", "")
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), best))
+	assert.Equal(t, best.Price, orderbook.AmountFromInt(100))
+	rec = serve(e, http.MethodGet, "/book/ETH-USDC/ask", "")
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), best))
+	assert.Equal(t, best.Price, orderbook.AmountFromInt(101))
+
+	rec = serve(e, http.MethodPost, "/order", `{"UserId": 2, "Type": "MARKET", "Bid": false, "Size": "0.5", "Market": "ETH-USDC"}`)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	rec = serve(e, http.MethodGet, "/trades/ETH-USDC", "")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	trades := []*orderbook.Trade{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &trades))
+	assert.Equal(t, len(trades), 1)
+	assert.Equal(t, trades[0].Price, orderbook.AmountFromInt(100))
+
+	for _, path := range []string{"/book/DOGE-USDC", "/book/DOGE-USDC/bid", "/book/DOGE-USDC/ask", "/trades/DOGE-USDC"} {
+		assert.Equal(t, serve(e, http.MethodGet, path, "").Code, http.StatusNotFound, path)
+	}
+}
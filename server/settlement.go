@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+)
+
+// ErrNoChain is returned for on-chain transfers when the exchange runs
+// without an ethereum client.
+var ErrNoChain = errors.New("exchange is not connected to a chain")
+
+type (
+	// TransferRequest deposits Amount of Asset for a user.
+	TransferRequest struct {
+		UserId int64
+		Asset  Asset
+		Amount orderbook.Amount
+	}
+
+	BalancesResponse struct {
+		UserId   int64
+		Balances []Balance
+	}
+)
+
+// ledgerHooks check the state of one market, then hold and settle the
+// funds of its orders. They run in the sequencer of the market, so holds,
+// fills and releases reach the ledger in the order the book saw them.
+func (ex *Exchange) ledgerHooks(spec *MarketSpec, ob *orderbook.Orderbook) orderbook.Hooks {
+	return orderbook.Hooks{
+		Before: func(cmd *orderbook.Command) error {
+			if err := ex.checkState(spec.Market, cmd); err != nil {
+				return err
+			}
+			return ex.holdFunds(spec, ob, cmd)
+		},
+		After: func(cmd orderbook.Command, res orderbook.Result) {
+			ex.settle(spec, ob, cmd, res)
+		},
+	}
+}
+
+// holdFunds runs the pre-trade risk checks on the order of cmd and sets
+// aside what it may spend: the quote notional of a buy at its limit price,
+// the base size of a sell. Market buys hold everything the user has
+// available and spend no more than that, stop market buys spend no more
+// than their size at the stop price.
+func (ex *Exchange) holdFunds(spec *MarketSpec, ob *orderbook.Orderbook, cmd *orderbook.Command) error {
+	switch cmd.Type {
+	case orderbook.CommandPlaceLimit:
+		return ex.holdOrder(spec, orderHold(spec, cmd.Order, cmd.Price))
+
+	case orderbook.CommandPlaceMarket:
+		o := cmd.Order
+		h := orderHold(spec, o, orderbook.Amount{})
+		if !o.Bid {
+			return ex.holdOrder(spec, h)
+		}
+		h.Amount = orderbook.Amount{}
+		if err := ex.checkRisk(spec, h, true); err != nil {
+			return err
+		}
+		funds, err := ex.ledger.HoldAvailable(h)
+		if err != nil {
+			return err
+		}
+		o.Funds = funds
+		return nil
+
+	case orderbook.CommandPlaceStop:
+		o := cmd.Stop.Order
+		price := cmd.Stop.LimitPrice
+		if !cmd.Stop.StopLimit {
+			price = cmd.Stop.StopPrice
+			if o.Bid {
+				o.Funds = price.Mul(o.Size)
+			}
+		}
+		return ex.holdOrder(spec, orderHold(spec, o, price))
+
+	case orderbook.CommandAmend:
+		order, ok := ob.Order(cmd.OrderId)
+		if !ok || order.Limit == nil {
+			// the book rejects it
+			return nil
+		}
+		price := cmd.Price
+		if price.IsZero() {
+			price = order.Limit.Price
+		}
+		if !cmd.Size.IsZero() {
+			order.Size, order.Hidden = cmd.Size, orderbook.Amount{}
+		}
+		h := orderHold(spec, order, price)
+		held := ex.ledger.Held(order.Id)
+		if !h.Amount.GreaterThan(held) {
+			return nil
+		}
+		h.Amount = h.Amount.Sub(held)
+		if err := ex.checkRisk(spec, h, false); err != nil {
+			return err
+		}
+		return ex.ledger.Hold(h)
+	}
+	return nil
+}
+
+// holdOrder checks and holds h for an order about to be placed.
+func (ex *Exchange) holdOrder(spec *MarketSpec, h Hold) error {
+	if err := ex.checkRisk(spec, h, true); err != nil {
+		return err
+	}
+	return ex.ledger.Hold(h)
+}
+
+// required is what an order of size at price holds: quote for a buy, base
+// for a sell.
+func required(bid bool, price, size orderbook.Amount) orderbook.Amount {
+	if bid {
+		return price.Mul(size)
+	}
+	return size
+}
+
+// settle moves the funds of every fill of cmd, sizes the hold of an amended
+// order to what it needs now and releases the holds of the orders of the
+// market that closed, all in one update of the ledger. The book has applied
+// cmd already, so when the ledger can not follow the market is halted
+// rather than left trading on balances that no longer match it. A command
+// replayed after a restart whose events the ledger followed already is
+// skipped. Fills move no funds on chain, so they need no settlement queue:
+// the journal of the market is what is left to settle and replaying it
+// after a crash is the retry.
+func (ex *Exchange) settle(spec *MarketSpec, ob *orderbook.Orderbook, cmd orderbook.Command, res orderbook.Result) {
+	err := ex.ledger.update(func(tx *ledgerTx) error {
+		if len(res.Events) > 0 {
+			last := res.Events[len(res.Events)-1].Seq
+			if last <= tx.following(spec.Market) {
+				return nil
+			}
+			defer tx.follow(spec.Market, last)
+		}
+
+		for _, event := range res.Events {
+			if event.Type != orderbook.EventMatched {
+				continue
+			}
+			match := event.Match
+			if err := tx.settle(spec, event.Seq, match); err != nil {
+				return fmt.Errorf("settling the match of order %d with order %d: %w", match.Bid.Id, match.Ask.Id, err)
+			}
+		}
+
+		// an amend the book rejected keeps the order as it was, the hold
+		// holdFunds grew for it goes back to what the order needs
+		if cmd.Type == orderbook.CommandAmend {
+			if order, ok := ob.Order(cmd.OrderId); ok {
+				h := orderHold(spec, order, order.Limit.Price)
+				if err := tx.resizeHold(order.Id, h.Amount, h.Size); err != nil {
+					return fmt.Errorf("resizing the hold of order %d: %w", order.Id, err)
+				}
+			}
+		}
+
+		return tx.releaseClosed(spec.Market, func(orderId int64) bool {
+			_, open := ob.Order(orderId)
+			return open
+		})
+	})
+	if err != nil {
+		ex.haltMarket(spec.Market, fmt.Errorf("the ledger did not follow %s: %w", cmd.Type, err))
+	}
+}
+
+// RegisterToken settles asset on chain with the ERC-20 contract at
+// address. The contract must have the decimals of the asset.
+func (ex *Exchange) RegisterToken(asset AssetSpec, address common.Address) error {
+	if asset.Asset == AssetETH {
+		return fmt.Errorf("%s is native, it has no token", asset.Asset)
+	}
+	if ex.client == nil {
+		return ErrNoChain
+	}
+	token, err := NewToken(ex.client, asset, address)
+	if err != nil {
+		return err
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	ex.tokens[asset.Asset] = token
+	return nil
+}
+
+// token returns the ERC-20 contract asset settles with.
+func (ex *Exchange) token(asset Asset) (*Token, bool) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	token, ok := ex.tokens[asset]
+	return token, ok
+}
+
+// deposit moves amount of asset from the user's address to the exchange on
+// chain and credits it to the user once the transaction succeeded. ETH is
+// sent by the user, tokens are pulled by the exchange from what the user
+// approved it to spend. A transaction still not mined when ctx is done is
+// not credited, the ledger only follows transfers the chain carried out.
+func (ex *Exchange) deposit(ctx context.Context, user *User, asset Asset, amount orderbook.Amount) error {
+	if amount.Sign() <= 0 {
+		return ErrInvalidAmount
+	}
+	if ex.client == nil {
+		return ErrNoChain
+	}
+	from := crypto.PubkeyToAddress(user.PrivateKey.PublicKey)
+
+	var tx *types.Transaction
+	var err error
+	if asset == AssetETH {
+		tx, err = sendETH(ex.nonces, user.PrivateKey, common.HexToAddress(exchangeAddress), amount)
+	} else {
+		token, ok := ex.token(asset)
+		if !ok {
+			return fmt.Errorf("%s deposits are not supported", asset)
+		}
+		to := crypto.PubkeyToAddress(ex.PrivateKey.PublicKey)
+		tx, err = token.TransferFrom(ex.nonces, ex.PrivateKey, from, to, amount)
+	}
+	if err != nil {
+		return fmt.Errorf("deposit transfer failed: %w", err)
+	}
+
+	receipt, err := ex.waitMined(ctx, tx.Hash())
+	if err != nil {
+		return fmt.Errorf("deposit transfer %s was not mined: %w", tx.Hash().Hex(), err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return fmt.Errorf("deposit transfer %s reverted", receipt.TxHash.Hex())
+	}
+	// the exchange address is no deposit address, the watcher never sees
+	// these, the ref only keeps a retried request from crediting twice
+	err = ex.ledger.Credit(depositRef(depositKey{txHash: receipt.TxHash, logIndex: -1}), user.Id, asset, amount)
+	if errors.Is(err, ErrBooked) {
+		return nil
+	}
+	return err
+}
+
+// waitMined polls for the receipt of the transaction hash, or of one that
+// replaced it, until there is one or ctx is done.
+func (ex *Exchange) waitMined(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	ticker := time.NewTicker(receiptPollInterval)
+	defer ticker.Stop()
+	for {
+		for _, h := range ex.nonces.Hashes(hash) {
+			if receipt, err := ex.client.TransactionReceipt(ctx, h); err == nil {
+				return receipt, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ex *Exchange) handleDeposit(c echo.Context) error {
+	var req TransferRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	user, ok := ex.user(req.UserId)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "user not found"})
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), depositTimeout)
+	defer cancel()
+	if err := ex.deposit(ctx, user, req.Asset, req.Amount); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, &BalancesResponse{UserId: user.Id, Balances: ex.ledger.Balances(user.Id)})
+}
+
+func (ex *Exchange) handleGetBalances(c echo.Context) error {
+	userId, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid user ID"})
+	}
+	return c.JSON(http.StatusOK, &BalancesResponse{UserId: userId, Balances: ex.ledger.Balances(userId)})
+}
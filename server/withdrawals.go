@@ -0,0 +1,539 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+)
+
+type WithdrawalStatus string
+
+const (
+	// WithdrawalAwaitingApproval withdrawals are above the approval
+	// threshold of their asset and wait for an admin
+	WithdrawalAwaitingApproval WithdrawalStatus = "AWAITING_APPROVAL"
+	// WithdrawalPending withdrawals wait to be broadcast
+	WithdrawalPending WithdrawalStatus = "PENDING"
+	// WithdrawalBroadcast withdrawals are sent, their transaction is not
+	// confirmed yet
+	WithdrawalBroadcast WithdrawalStatus = "BROADCAST"
+	WithdrawalConfirmed WithdrawalStatus = "CONFIRMED"
+	// WithdrawalFailed and WithdrawalRejected withdrawals are credited back
+	WithdrawalFailed   WithdrawalStatus = "FAILED"
+	WithdrawalRejected WithdrawalStatus = "REJECTED"
+)
+
+const (
+	// maxWithdrawalAttempts is how often broadcasting a withdrawal is tried
+	// before it fails.
+	maxWithdrawalAttempts = 3
+
+	withdrawalsJournalFile = "withdrawals"
+)
+
+var (
+	ErrWithdrawalNotFound = errors.New("withdrawal not found")
+	// ErrWithdrawalState is returned when approving or rejecting a withdrawal
+	// that does not wait for approval.
+	ErrWithdrawalState = errors.New("withdrawal does not await approval")
+)
+
+type (
+	// WithdrawalRequest withdraws Amount of Asset of a user. Withdrawals
+	// only go to the registered address of the user, the address of their
+	// key, so a request naming another user can at worst pay that user.
+	WithdrawalRequest struct {
+		UserId int64
+		Asset  Asset
+		Amount orderbook.Amount
+	}
+
+	Withdrawal struct {
+		Id     int64
+		UserId int64
+		Asset  Asset
+		Amount orderbook.Amount
+		To     common.Address
+		Status WithdrawalStatus
+		TxHash common.Hash
+		// Sent are the transactions of every attempt the node was sent
+		Sent  []common.Hash
+		Block uint64 // the block the transaction is in once confirmed
+		// Attempts counts the broadcasts that failed
+		Attempts  int
+		Error     string
+		CreatedAt int64 // unix nano
+	}
+)
+
+// WithdrawalQueue sends withdrawals from the hot wallet of the exchange, the
+// address of Exchange.PrivateKey. The amount is debited when a withdrawal
+// is requested and credited back when it is rejected or fails for good: the
+// broadcast failed maxWithdrawalAttempts times or the transaction reverted.
+// A queue opened with OpenWithdrawalQueue journals every change of a
+// withdrawal before the ledger books it, so both survive restarts.
+type WithdrawalQueue struct {
+	ex     *Exchange
+	client ChainBackend
+	// ApprovalThresholds are the amounts of each asset above which a
+	// withdrawal waits for an admin to approve it
+	ApprovalThresholds map[Asset]orderbook.Amount
+	// Confirmations is how many blocks, the one of the transaction
+	// included, have to be on chain before a withdrawal is confirmed
+	Confirmations uint64
+
+	mu          sync.Mutex
+	nextId      int64
+	withdrawals map[int64]*Withdrawal
+	// journal is nil for a queue kept in memory only
+	journal *orderbook.Journal
+}
+
+func NewWithdrawalQueue(ex *Exchange, confirmations uint64) *WithdrawalQueue {
+	return &WithdrawalQueue{
+		ex:                 ex,
+		client:             ex.client,
+		ApprovalThresholds: make(map[Asset]orderbook.Amount),
+		Confirmations:      confirmations,
+		withdrawals:        make(map[int64]*Withdrawal),
+	}
+}
+
+// OpenWithdrawalQueue opens the queue journaled in dir, creating dir when
+// needed, and replays its journal. The ledger of ex has to be recovered
+// already: a withdrawal the ledger never debited is dropped, and one that
+// failed or was rejected but not credited back yet is credited back now.
+func OpenWithdrawalQueue(ex *Exchange, confirmations uint64, dir string) (*WithdrawalQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	journal, err := orderbook.OpenJournal(filepath.Join(dir, withdrawalsJournalFile))
+	if err != nil {
+		return nil, err
+	}
+	records, err := journal.Records()
+	if err != nil {
+		journal.Close()
+		return nil, fmt.Errorf("reading the withdrawals journal: %w", err)
+	}
+
+	q := NewWithdrawalQueue(ex, confirmations)
+	for i, payload := range records {
+		w := &Withdrawal{}
+		if err := json.Unmarshal(payload, w); err != nil {
+			journal.Close()
+			return nil, fmt.Errorf("%w: withdrawal record %d: %s", orderbook.ErrJournalCorrupt, i, err)
+		}
+		q.withdrawals[w.Id] = w
+	}
+	q.journal = journal
+
+	for id, w := range q.withdrawals {
+		if !ex.ledger.Booked(withdrawalRef(id)) {
+			delete(q.withdrawals, id)
+			continue
+		}
+		q.nextId = max(q.nextId, id)
+		if w.Status == WithdrawalFailed || w.Status == WithdrawalRejected {
+			q.creditBack(w)
+		}
+	}
+	return q, nil
+}
+
+// Close closes the journal of the queue.
+func (q *WithdrawalQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.journal == nil {
+		return nil
+	}
+	return q.journal.Close()
+}
+
+// withdrawalRef is what the ledger books the debit of a withdrawal under,
+// reversedRef what it books crediting it back under.
+func withdrawalRef(id int64) string {
+	return fmt.Sprintf("withdrawal %d", id)
+}
+
+func reversedRef(id int64) string {
+	return fmt.Sprintf("withdrawal %d reversed", id)
+}
+
+// save journals the state of w when the queue is durable.
+func (q *WithdrawalQueue) save(w *Withdrawal) error {
+	if q.journal == nil {
+		return nil
+	}
+	payload, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	if err := q.journal.Append(payload); err != nil {
+		return fmt.Errorf("journaling withdrawal %d: %w", w.Id, err)
+	}
+	return nil
+}
+
+// Request debits the withdrawal of req and queues it.
+func (q *WithdrawalQueue) Request(req *WithdrawalRequest) (Withdrawal, error) {
+	user, ok := q.ex.user(req.UserId)
+	if !ok {
+		return Withdrawal{}, newOrderError(ErrCodeUnknownUser, "user %d not found", req.UserId)
+	}
+	if q.client == nil {
+		return Withdrawal{}, ErrNoChain
+	}
+	decimals := ETH.Decimals
+	if req.Asset != AssetETH {
+		token, ok := q.ex.token(req.Asset)
+		if !ok {
+			return Withdrawal{}, fmt.Errorf("%s withdrawals are not supported", req.Asset)
+		}
+		decimals = token.Asset.Decimals
+	}
+	if req.Amount.Sign() <= 0 {
+		return Withdrawal{}, ErrInvalidAmount
+	}
+	if _, err := ToBaseUnits(req.Amount, decimals); err != nil {
+		return Withdrawal{}, err
+	}
+	if user.PrivateKey == nil {
+		return Withdrawal{}, fmt.Errorf("user %d has no registered address to withdraw to", user.Id)
+	}
+	to := crypto.PubkeyToAddress(user.PrivateKey.PublicKey)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w := &Withdrawal{
+		Id:        q.nextId + 1,
+		UserId:    user.Id,
+		Asset:     req.Asset,
+		Amount:    req.Amount,
+		To:        to,
+		Status:    WithdrawalPending,
+		CreatedAt: time.Now().UnixNano(),
+	}
+	if threshold, ok := q.ApprovalThresholds[req.Asset]; ok && req.Amount.GreaterThan(threshold) {
+		w.Status = WithdrawalAwaitingApproval
+	}
+	// journaled first, a withdrawal the ledger then does not debit is
+	// dropped when the queue is opened again, and its id is taken by the
+	// next one
+	if err := q.save(w); err != nil {
+		return Withdrawal{}, err
+	}
+	if err := q.ex.ledger.Withdraw(withdrawalRef(w.Id), user.Id, req.Asset, req.Amount); err != nil {
+		return Withdrawal{}, err
+	}
+	q.nextId = w.Id
+	q.withdrawals[w.Id] = w
+	return *w, nil
+}
+
+// Withdrawal returns the withdrawal with the given id.
+func (q *WithdrawalQueue) Withdrawal(id int64) (Withdrawal, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w, ok := q.withdrawals[id]
+	if !ok {
+		return Withdrawal{}, false
+	}
+	return *w, true
+}
+
+// all returns every withdrawal, oldest first.
+func (q *WithdrawalQueue) all() []Withdrawal {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	withdrawals := make([]Withdrawal, 0, len(q.withdrawals))
+	for _, w := range q.withdrawals {
+		withdrawals = append(withdrawals, *w)
+	}
+	sort.Slice(withdrawals, func(i, j int) bool { return withdrawals[i].Id < withdrawals[j].Id })
+	return withdrawals
+}
+
+// Approve lets a withdrawal awaiting approval be broadcast.
+func (q *WithdrawalQueue) Approve(id int64) (Withdrawal, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w, err := q.awaitingApproval(id)
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	w.Status = WithdrawalPending
+	if err := q.save(w); err != nil {
+		w.Status = WithdrawalAwaitingApproval
+		return Withdrawal{}, err
+	}
+	return *w, nil
+}
+
+// Reject credits back a withdrawal awaiting approval.
+func (q *WithdrawalQueue) Reject(id int64) (Withdrawal, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w, err := q.awaitingApproval(id)
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	if err := q.reverse(w, WithdrawalRejected, "rejected by an admin"); err != nil {
+		return Withdrawal{}, err
+	}
+	return *w, nil
+}
+
+func (q *WithdrawalQueue) awaitingApproval(id int64) (*Withdrawal, error) {
+	w, ok := q.withdrawals[id]
+	if !ok {
+		return nil, ErrWithdrawalNotFound
+	}
+	if w.Status != WithdrawalAwaitingApproval {
+		return nil, fmt.Errorf("%w: withdrawal %d is %s", ErrWithdrawalState, id, w.Status)
+	}
+	return w, nil
+}
+
+// Run processes the queue on each tick of interval.
+func (q *WithdrawalQueue) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		<-ticker.C
+
+		if err := q.Process(); err != nil {
+			fmt.Printf("processing withdrawals failed: %s\n", err)
+		}
+	}
+}
+
+// Process broadcasts the pending withdrawals, oldest first, and settles the
+// broadcast ones whose transaction has enough confirmations.
+func (q *WithdrawalQueue) Process() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ids := make([]int64, 0, len(q.withdrawals))
+	for id, w := range q.withdrawals {
+		if w.Status == WithdrawalPending || w.Status == WithdrawalBroadcast {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		if w := q.withdrawals[id]; w.Status == WithdrawalPending {
+			if err := q.broadcast(w); err != nil {
+				return err
+			}
+		}
+	}
+
+	head, err := q.client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if w := q.withdrawals[id]; w.Status == WithdrawalBroadcast {
+			if err := q.confirm(w, head.Number.Uint64()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// broadcast sends the transaction of w from the hot wallet. A failed send
+// is tried again on the next Process, unless it was the last attempt.
+func (q *WithdrawalQueue) broadcast(w *Withdrawal) error {
+	// the node may have taken the transaction of an earlier attempt
+	// although sending it failed
+	if found, err := q.sentTx(w); err != nil || found {
+		return err
+	}
+
+	var (
+		tx  *types.Transaction
+		err error
+	)
+	if w.Asset == AssetETH {
+		tx, err = sendETH(q.ex.nonces, q.ex.PrivateKey, w.To, w.Amount)
+	} else if token, ok := q.ex.token(w.Asset); ok {
+		tx, err = token.Transfer(q.ex.nonces, q.ex.PrivateKey, w.To, w.Amount)
+	} else {
+		err = fmt.Errorf("%s is no longer settled on chain", w.Asset)
+	}
+	if tx != nil {
+		w.TxHash = tx.Hash()
+		w.Sent = append(w.Sent, tx.Hash())
+	}
+	if err == nil {
+		w.Status = WithdrawalBroadcast
+		return q.save(w)
+	}
+
+	w.Attempts++
+	w.Error = err.Error()
+	if w.Attempts < maxWithdrawalAttempts {
+		return q.save(w)
+	}
+	// only reversed when no attempt made it to the node
+	if found, checkErr := q.sentTx(w); checkErr != nil || found {
+		return checkErr
+	}
+	return q.reverse(w, WithdrawalFailed, err.Error())
+}
+
+// sentTx looks for the transactions w sent, and those replacing them, on
+// the node. When it finds one w is broadcast with it.
+func (q *WithdrawalQueue) sentTx(w *Withdrawal) (bool, error) {
+	for _, sent := range w.Sent {
+		for _, hash := range q.ex.nonces.Hashes(sent) {
+			_, _, err := q.client.TransactionByHash(context.Background(), hash)
+			if errors.Is(err, ethereum.NotFound) {
+				continue
+			}
+			if err != nil {
+				return false, err
+			}
+			w.TxHash = hash
+			w.Status = WithdrawalBroadcast
+			return true, q.save(w)
+		}
+	}
+	return false, nil
+}
+
+// confirm settles w once its transaction has enough confirmations at head.
+func (q *WithdrawalQueue) confirm(w *Withdrawal, head uint64) error {
+	// a stuck transaction may have been replaced by one paying more
+	var receipt *types.Receipt
+	for _, hash := range q.ex.nonces.Hashes(w.TxHash) {
+		// not mined yet, or the node is still indexing it, a node that is
+		// down already failed reading the head
+		if r, err := q.client.TransactionReceipt(context.Background(), hash); err == nil {
+			receipt = r
+			break
+		}
+	}
+	if receipt == nil {
+		return nil
+	}
+	if receipt.TxHash != w.TxHash {
+		w.TxHash = receipt.TxHash
+		w.Sent = append(w.Sent, receipt.TxHash)
+		if err := q.save(w); err != nil {
+			return err
+		}
+	}
+	if head+1 < receipt.BlockNumber.Uint64()+max(q.Confirmations, 1) {
+		return nil
+	}
+	w.Block = receipt.BlockNumber.Uint64()
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return q.reverse(w, WithdrawalFailed, "transaction reverted")
+	}
+	w.Status = WithdrawalConfirmed
+	w.Error = ""
+	return q.save(w)
+}
+
+// reverse closes w with status and credits it back to its user. The status
+// is journaled first, so a credit a crash cut off is made when the queue is
+// opened again.
+func (q *WithdrawalQueue) reverse(w *Withdrawal, status WithdrawalStatus, reason string) error {
+	prevStatus, prevError := w.Status, w.Error
+	w.Status, w.Error = status, reason
+	if err := q.save(w); err != nil {
+		w.Status, w.Error = prevStatus, prevError
+		return err
+	}
+	q.creditBack(w)
+	return nil
+}
+
+// creditBack credits w back to its user unless it was already.
+func (q *WithdrawalQueue) creditBack(w *Withdrawal) {
+	err := q.ex.ledger.ReverseWithdrawal(reversedRef(w.Id), w.UserId, w.Asset, w.Amount)
+	if err != nil && !errors.Is(err, ErrBooked) {
+		fmt.Printf("crediting back withdrawal %d of user %d failed: %s\n", w.Id, w.UserId, err)
+	}
+}
+
+func (q *WithdrawalQueue) handleRequestWithdrawal(c echo.Context) error {
+	var req WithdrawalRequest
+	decoder := json.NewDecoder(c.Request().Body)
+	// a destination in the body is refused rather than ignored
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	w, err := q.Request(&req)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errorCode(err) == ErrCodeUnknownUser {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, &w)
+}
+
+func (q *WithdrawalQueue) handleGetWithdrawal(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid withdrawal ID"})
+	}
+	w, ok := q.Withdrawal(id)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": ErrWithdrawalNotFound.Error()})
+	}
+	return c.JSON(http.StatusOK, &w)
+}
+
+func (q *WithdrawalQueue) handleApproveWithdrawal(c echo.Context) error {
+	return q.decide(c, q.Approve)
+}
+
+func (q *WithdrawalQueue) handleRejectWithdrawal(c echo.Context) error {
+	return q.decide(c, q.Reject)
+}
+
+// decide approves or rejects the withdrawal of the request.
+func (q *WithdrawalQueue) decide(c echo.Context, decision func(id int64) (Withdrawal, error)) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid withdrawal ID"})
+	}
+	w, err := decision(id)
+	if err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, ErrWithdrawalNotFound) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, &w)
+}
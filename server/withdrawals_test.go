@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Madhav-Gupta-28/crypto-exchange/orderbook"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithdrawalQueue(t *testing.T) {
+	exchangeKey, err := crypto.HexToECDSA(exchangePrivateKey)
+	assert.Nil(t, err)
+	userKey, userAddress := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		crypto.PubkeyToAddress(exchangeKey.PublicKey): {Balance: new(big.Int).Mul(big.NewInt(10), big.NewInt(1e18))},
+	})
+	defer backend.Close()
+	client := backend.Client()
+
+	ex := NewExchange("", client)
+	defer ex.Close()
+	ex.AddUser(&User{Id: 1, PrivateKey: userKey})
+	ex.AddUser(&User{Id: 2})
+	assert.Nil(t, ex.ledger.Deposit(1, AssetETH, orderbook.AmountFromInt(5)))
+	q := NewWithdrawalQueue(ex, 2)
+	q.ApprovalThresholds[AssetETH] = orderbook.AmountFromInt(2)
+
+	small, err := q.Request(&WithdrawalRequest{UserId: 1, Asset: AssetETH, Amount: orderbook.MustParseAmount("1.5")})
+	assert.Nil(t, err)
+	assert.Equal(t, small.Status, WithdrawalPending)
+	assert.Equal(t, small.To, userAddress)
+	large, err := q.Request(&WithdrawalRequest{UserId: 1, Asset: AssetETH, Amount: orderbook.AmountFromInt(3)})
+	assert.Nil(t, err)
+	assert.Equal(t, large.Status, WithdrawalAwaitingApproval)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("0.5", "0"))
+
+	_, err = q.Request(&WithdrawalRequest{UserId: 1, Asset: AssetETH, Amount: orderbook.AmountFromInt(1)})
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	// without a key a user has no address to withdraw to
+	_, err = q.Request(&WithdrawalRequest{UserId: 2, Asset: AssetETH, Amount: orderbook.AmountFromInt(1)})
+	assert.NotNil(t, err)
+
+	assert.Nil(t, q.Process())
+	small, _ = q.Withdrawal(small.Id)
+	assert.Equal(t, small.Status, WithdrawalBroadcast)
+	large, _ = q.Withdrawal(large.Id)
+	assert.Equal(t, large.Status, WithdrawalAwaitingApproval)
+
+	backend.Commit()
+	assert.Nil(t, q.Process())
+	small, _ = q.Withdrawal(small.Id)
+	assert.Equal(t, small.Status, WithdrawalBroadcast)
+	backend.Commit()
+	assert.Nil(t, q.Process())
+	small, _ = q.Withdrawal(small.Id)
+	assert.Equal(t, small.Status, WithdrawalConfirmed)
+	onChain, err := client.BalanceAt(context.Background(), userAddress, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, onChain.String(), "1500000000000000000")
+
+	large, err = q.Reject(large.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, large.Status, WithdrawalRejected)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("3.5", "0"))
+	_, err = q.Approve(large.Id)
+	assert.ErrorIs(t, err, ErrWithdrawalState)
+
+	e := echo.New()
+	e.POST("/withdrawals", q.handleRequestWithdrawal)
+	e.GET("/withdrawals/:id", q.handleGetWithdrawal)
+	e.POST("/admin/withdrawals/:id/approve", q.handleApproveWithdrawal)
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := request(http.MethodPost, "/withdrawals", `{"UserId":1,"Asset":"ETH","Amount":"2.5"}`)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Contains(t, rec.Body.String(), `"Status":"AWAITING_APPROVAL"`)
+	assert.Equal(t, request(http.MethodPost, "/withdrawals", `{"UserId":3,"Asset":"ETH","Amount":"1"}`).Code, http.StatusNotFound)
+	// nobody picks where the funds of a user go
+	_, stranger := newKey(t)
+	rec = request(http.MethodPost, "/withdrawals", `{"UserId":1,"Asset":"ETH","Amount":"0.5","To":"`+stranger.Hex()+`"}`)
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("1", "0"))
+	assert.Equal(t, request(http.MethodGet, "/withdrawals/99", "").Code, http.StatusNotFound)
+	assert.Equal(t, request(http.MethodPost, "/admin/withdrawals/99/approve", "").Code, http.StatusNotFound)
+	assert.Equal(t, request(http.MethodPost, "/admin/withdrawals/3/approve", "").Code, http.StatusOK)
+	assert.Equal(t, request(http.MethodPost, "/admin/withdrawals/3/approve", "").Code, http.StatusConflict)
+
+	assert.Nil(t, q.Process())
+	backend.Commit()
+	backend.Commit()
+	assert.Nil(t, q.Process())
+	rec = request(http.MethodGet, "/withdrawals/3", "")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Contains(t, rec.Body.String(), `"Status":"CONFIRMED"`)
+	onChain, _ = client.BalanceAt(context.Background(), userAddress, nil)
+	assert.Equal(t, onChain.String(), "4000000000000000000")
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("1", "0"))
+	assertBalanced(t, ex.ledger)
+}
+
+func TestFailedWithdrawalsAreCreditedBack(t *testing.T) {
+	exchangeKey, err := crypto.HexToECDSA(exchangePrivateKey)
+	assert.Nil(t, err)
+	userKey, _ := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		crypto.PubkeyToAddress(exchangeKey.PublicKey): {Balance: big.NewInt(1e18)},
+		// the hot wallet holds no tokens
+		testTokenAddress: testToken(6, map[common.Address]*big.Int{}),
+	})
+	defer backend.Close()
+
+	ex := NewExchange("", backend.Client())
+	defer ex.Close()
+	ex.AddUser(&User{Id: 1, PrivateKey: userKey})
+	assert.Nil(t, ex.RegisterToken(USDC, testTokenAddress))
+	assert.Nil(t, ex.ledger.Deposit(1, AssetUSDC, orderbook.AmountFromInt(10)))
+	q := NewWithdrawalQueue(ex, 1)
+
+	w, err := q.Request(&WithdrawalRequest{UserId: 1, Asset: AssetUSDC, Amount: orderbook.AmountFromInt(10)})
+	assert.Nil(t, err)
+	assertBalance(t, ex.ledger, 1, AssetUSDC, balance("0", "0"))
+
+	for i := 1; i < maxWithdrawalAttempts; i++ {
+		assert.Nil(t, q.Process())
+		w, _ = q.Withdrawal(w.Id)
+		assert.Equal(t, w.Status, WithdrawalPending)
+		assert.Equal(t, w.Attempts, i)
+	}
+	assert.Nil(t, q.Process())
+	w, _ = q.Withdrawal(w.Id)
+	assert.Equal(t, w.Status, WithdrawalFailed)
+	assert.NotEmpty(t, w.Error)
+	assertBalance(t, ex.ledger, 1, AssetUSDC, balance("10", "0"))
+	assertBalanced(t, ex.ledger)
+}
+
+func TestWithdrawalQueueRecovers(t *testing.T) {
+	exchangeKey, err := crypto.HexToECDSA(exchangePrivateKey)
+	assert.Nil(t, err)
+	userKey, userAddress := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		crypto.PubkeyToAddress(exchangeKey.PublicKey): {Balance: new(big.Int).Mul(big.NewInt(10), big.NewInt(1e18))},
+	})
+	defer backend.Close()
+	client := backend.Client()
+
+	dir := t.TempDir()
+	open := func() (*Exchange, *WithdrawalQueue) {
+		ex := NewExchange("", client)
+		ex.AddUser(&User{Id: 1, PrivateKey: userKey})
+		assert.Nil(t, ex.RecoverLedger(filepath.Join(dir, ledgerDir)))
+		q, err := OpenWithdrawalQueue(ex, 1, filepath.Join(dir, withdrawalsDir))
+		assert.Nil(t, err)
+		q.ApprovalThresholds[AssetETH] = orderbook.AmountFromInt(2)
+		return ex, q
+	}
+
+	ex, q := open()
+	assert.Nil(t, ex.ledger.Deposit(1, AssetETH, orderbook.AmountFromInt(5)))
+	pending, err := q.Request(&WithdrawalRequest{UserId: 1, Asset: AssetETH, Amount: orderbook.AmountFromInt(1)})
+	assert.Nil(t, err)
+	rejected, err := q.Request(&WithdrawalRequest{UserId: 1, Asset: AssetETH, Amount: orderbook.AmountFromInt(3)})
+	assert.Nil(t, err)
+	_, err = q.Request(&WithdrawalRequest{UserId: 1, Asset: AssetETH, Amount: orderbook.AmountFromInt(2)})
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	// the crash came after the rejection was journaled, before it was
+	// credited back
+	q.withdrawals[rejected.Id].Status = WithdrawalRejected
+	assert.Nil(t, q.save(q.withdrawals[rejected.Id]))
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("1", "0"))
+	assert.Nil(t, q.Close())
+	assert.Nil(t, ex.Close())
+
+	ex, q = open()
+	defer ex.Close()
+	defer q.Close()
+	assert.Equal(t, len(q.all()), 2)
+	recovered, ok := q.Withdrawal(pending.Id)
+	assert.True(t, ok)
+	assert.Equal(t, recovered, pending)
+	w, _ := q.Withdrawal(rejected.Id)
+	assert.Equal(t, w.Status, WithdrawalRejected)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("4", "0"))
+
+	// the withdrawal the ledger did not take is gone, its id is free
+	next, err := q.Request(&WithdrawalRequest{UserId: 1, Asset: AssetETH, Amount: orderbook.AmountFromInt(1)})
+	assert.Nil(t, err)
+	assert.Equal(t, next.Id, rejected.Id+1)
+
+	assert.Nil(t, q.Process())
+	backend.Commit()
+	assert.Nil(t, q.Process())
+	w, _ = q.Withdrawal(pending.Id)
+	assert.Equal(t, w.Status, WithdrawalConfirmed)
+	onChain, err := client.BalanceAt(context.Background(), userAddress, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, onChain.String(), "2000000000000000000")
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("3", "0"))
+	assertBalanced(t, ex.ledger)
+}
+
+func TestWithdrawalsTheNodeTookAreNotReversed(t *testing.T) {
+	exchangeKey, err := crypto.HexToECDSA(exchangePrivateKey)
+	assert.Nil(t, err)
+	userKey, _ := newKey(t)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		crypto.PubkeyToAddress(exchangeKey.PublicKey): {Balance: big.NewInt(1e18)},
+	})
+	defer backend.Close()
+
+	ex := NewExchange("", backend.Client())
+	defer ex.Close()
+	ex.AddUser(&User{Id: 1, PrivateKey: userKey})
+	assert.Nil(t, ex.ledger.Deposit(1, AssetETH, orderbook.MustParseAmount("0.5")))
+	q := NewWithdrawalQueue(ex, 1)
+	sent, err := q.Request(&WithdrawalRequest{UserId: 1, Asset: AssetETH, Amount: orderbook.MustParseAmount("0.1")})
+	assert.Nil(t, err)
+	assert.Nil(t, q.Process())
+
+	// the send of the last attempt got to the node although it failed
+	w := q.withdrawals[sent.Id]
+	w.Status, w.Attempts, w.TxHash = WithdrawalPending, maxWithdrawalAttempts-1, common.Hash{}
+	assert.Nil(t, q.Process())
+	assert.Equal(t, w.Status, WithdrawalBroadcast)
+	assert.Equal(t, w.TxHash, w.Sent[0])
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("0.4", "0"))
+
+	backend.Commit()
+	assert.Nil(t, q.Process())
+	assert.Equal(t, w.Status, WithdrawalConfirmed)
+	assertBalance(t, ex.ledger, 1, AssetETH, balance("0.4", "0"))
+}